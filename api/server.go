@@ -31,20 +31,21 @@ import (
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/golang/protobuf/proto"
 	"github.com/rs/xid"
 	"github.com/zorino/kaamer/internal/helper/duration"
 	"github.com/zorino/kaamer/pkg/kvstore"
 	"github.com/zorino/kaamer/pkg/search"
+	"github.com/zorino/kaamer/pkg/statsdb"
 )
 
 /* global variables */
 var kvStores *kvstore.KVStores
 var dbStats *kvstore.KStats
+var dbReport *statsdb.Report
 var tmpFolder = "/tmp/"
 var nbOfThreads = 0
 
-func NewServer(dbPath string, portNumber int, newNbThreads int, newTmpFolder string) {
+func NewServer(dbPath string, portNumber int, newNbThreads int, newTmpFolder string) error {
 
 	runtime.GOMAXPROCS(512)
 
@@ -62,22 +63,37 @@ func NewServer(dbPath string, portNumber int, newNbThreads int, newTmpFolder str
 	fmt.Printf(" + Opening kAAmer Database.. ")
 	startTime := time.Now()
 
-	kvStores = kvstore.KVStoresNew(dbPath, 12, true, false, true)
+	var err error
+	kvStores, err = kvstore.KVStoresNew(dbPath, 12, true, false, true)
+	if err != nil {
+		return err
+	}
 	defer kvStores.Close()
 
-	dbStatsByte, ok := kvStores.ProteinStore.GetValue([]byte("db_stats"))
-	if !ok {
-		fmt.Println("No database stats, aborting !")
-		os.Exit(1)
+	if dbStats, err = kvStores.GetStats(); err != nil {
+		return fmt.Errorf("%w (incomplete makedb ?)", err)
+	}
+
+	if kSettings, err := kvStores.GetSettings(); err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		return err
+	} else if !kSettings.DatabaseIndexed {
+		return fmt.Errorf("%w (run kaamer-db -index)", kvstore.ErrNotIndexed)
+	}
+
+	// saved by kaamer-db -stats and the indexing
+	if dbReport, err = statsdb.GetReport(kvStores); err != nil && !errors.Is(err, statsdb.ErrMissingReport) {
+		return err
 	}
-	dbStats = &kvstore.KStats{}
-	proto.Unmarshal(dbStatsByte, dbStats)
 
 	elapsed := time.Since(startTime)
 	elapsed = elapsed.Round(time.Second)
 	out := fmt.Sprintf("done [%s]\n", duration.FmtDuration(elapsed))
 	fmt.Printf(out)
 
+	if kvStores.KmerIndex != nil {
+		fmt.Printf(" + Serving kmers from the exported index (%d kmers)\n", kvStores.KmerIndex.NumberOfKmers())
+	}
+
 	r := chi.NewRouter()
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -107,11 +123,7 @@ func NewServer(dbPath string, portNumber int, newNbThreads int, newTmpFolder str
 	/* Start server */
 	fmt.Printf(" + kAAmer server listening on port %d with %d CPU workers\n", portNumber, nbOfThreads)
 
-	err := http.ListenAndServe(port.String(), r)
-	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
+	return http.ListenAndServe(port.String(), r)
 
 }
 
@@ -122,18 +134,109 @@ func APIRoutes(r chi.Router, path string, kvStores *kvstore.KVStores) {
 		r.Post("/search/protein", searchProtein)
 		r.Post("/search/fastq", searchFastq)
 		r.Post("/search/nucleotide", searchNucleotide)
-		r.Get("/dbinfo", func(w http.ResponseWriter, r *http.Request) {
-			b, err := json.Marshal(dbStats)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			w.Write([]byte(string(b)))
-		})
+		r.Get("/dbinfo", getDBInfo)
+		r.Get("/protein/{entryId}", getProtein)
+		r.Get("/search/names", searchNames)
 	})
 
 }
 
+// getDBInfo returns the database stats
+// detailed=true : full report saved by kaamer-db -stats
+func getDBInfo(w http.ResponseWriter, r *http.Request) {
+
+	var info interface{} = dbStats
+
+	if detailed, _ := strconv.ParseBool(r.URL.Query().Get("detailed")); detailed {
+		if dbReport == nil {
+			w.WriteHeader(404)
+			fmt.Fprintln(w, "Database has no report (run kaamer-db -stats)")
+			return
+		}
+		info = dbReport
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+
+}
+
+func getProtein(w http.ResponseWriter, r *http.Request) {
+
+	if kSettings, _ := kvStores.GetSettings(); !kSettings.IDsIndexed {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "Database has no EntryId index (run kaamer-db -index)")
+		return
+	}
+
+	entryId := chi.URLParam(r, "entryId")
+	prot, ok := kvStores.ProteinStore.GetProteinByEntryId(entryId, true)
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Protein %s not found\n", entryId)
+		return
+	}
+
+	b, err := json.Marshal(prot)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+
+}
+
+// searchNames queries the protein names index
+// q : beta-lactamase, "class A beta-lactamase", lactam*
+// field : ProteinName, GeneName or Organism (all by default)
+// limit : maximum number of proteins (100 by default, 0 for all)
+func searchNames(w http.ResponseWriter, r *http.Request) {
+
+	if kSettings, _ := kvStores.GetSettings(); !kSettings.NamesIndexed {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "Database has no protein names index (run kaamer-db -index)")
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "Invalid limit "+l)
+			return
+		}
+	}
+
+	proteins, err := kvStores.ProteinStore.SearchNames(r.URL.Query().Get("q"), r.URL.Query().Get("field"), limit)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	b, err := json.Marshal(proteins)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+
+}
+
 func searchFastq(w http.ResponseWriter, r *http.Request) {
 
 	searchOptions := search.SearchOptions{
@@ -156,7 +259,7 @@ func searchFastq(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		fmt.Fprintln(w, err.Error())
 	} else {
-		search.NewSearchResult(searchOptions, *dbStats, kvStores, nbOfThreads, w, r)
+		runSearch(searchOptions, w, r)
 	}
 
 }
@@ -184,7 +287,7 @@ func searchNucleotide(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		fmt.Fprintln(w, err.Error())
 	} else {
-		search.NewSearchResult(searchOptions, *dbStats, kvStores, nbOfThreads, w, r)
+		runSearch(searchOptions, w, r)
 	}
 
 }
@@ -212,7 +315,26 @@ func searchProtein(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		fmt.Fprintln(w, err.Error())
 	} else {
-		search.NewSearchResult(searchOptions, *dbStats, kvStores, nbOfThreads, w, r)
+		runSearch(searchOptions, w, r)
+	}
+
+}
+
+// runSearch replies 400 to a query file that can't be read,
+// the errors met once the results are being written are only logged
+func runSearch(searchOptions search.SearchOptions, w http.ResponseWriter, r *http.Request) {
+
+	if err := search.CheckQueryFile(searchOptions.File); err != nil {
+		if searchOptions.InputType != "path" {
+			os.Remove(searchOptions.File)
+		}
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	if _, err := search.NewSearchResult(searchOptions, *dbStats, kvStores, nbOfThreads, w, r); err != nil {
+		fmt.Printf("Search error : %s\n", err.Error())
 	}
 
 }
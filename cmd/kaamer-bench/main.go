@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/pkg/profile"
+	"github.com/zorino/kaamer/pkg/indexdb"
 	"github.com/zorino/kaamer/pkg/kvstore"
 	"github.com/zorino/kaamer/pkg/makedb"
 )
@@ -54,6 +55,15 @@ var (
 	makedbOffset = flag.Uint("offset", 0, "offset to process raw file")
 	makedbLenght = flag.Uint("length", uint(MaxInt), "process x number of files")
 	noIndex      = flag.Bool("noindex", false, "prevent the indexing of database")
+	kmerSize     = flag.Int("k", kvstore.DefaultKmerSize, "kmer size")
+	alphabet     = flag.String("alphabet", kvstore.LiteralAlphabet, "kmer alphabet")
+	seed         = flag.String("seed", "", "spaced seed mask")
+	compress     = flag.Bool("compress", false, "compress protein sequences")
+	dedup        = flag.Bool("dedup", false, "deduplicate identical sequences")
+	headerTmpl   = flag.String("header", "", "FASTA header template")
+	schemaFile   = flag.String("schema", "", "TSV schema file")
+	stopCount    = flag.Uint64("stopcount", 0, "maximum number of proteins of a kmer")
+	stopFrac     = flag.Float64("stopfrac", 0, "maximum fraction of proteins of a kmer")
 
 	// LoadingMode = map[string]options.FileLoadingMode{"memorymap": options.MemoryMap, "fileio": options.FileIO}
 )
@@ -80,17 +90,29 @@ func main() {
 
   -func makedb (profile a database build)
     (input)
-      -i            input file
+      -i            input files (comma separated files, glob patterns or directories, - for stdin)
       -f            input file format (embl, tsv, fasta)
       -d            badger database directory (output)
       -t            number of threads to use (default all)
+      -k            kmer size between 5 and 12 (default 7)
+      -alphabet     (literal, murphy15, murphy10, murphy8, seb14, seb10)
+                    reduced amino acid alphabet for kmers (default literal)
+      -seed         spaced seed mask (ex. 1101011011) used instead of -k contiguous kmers
       -offset       start processing raw uniprot file at protein number x
       -length       process x number of proteins (-1 == infinity)
+      -header       FASTA header dialect (plain, uniprot, uniref, ncbi), a regular expression with named
+                    groups (EntryId and features) or a file of them (default plain)
+      -schema       TSV schema file, one column by line : column name or number <tab> EntryId,
+                    Sequence or feature name [<tab> list:separator] (default the header names)
+      -stopcount    drop the kmers shared by more than x proteins from the index (stop kmers)
+      -stopfrac     drop the kmers shared by more than a fraction of the proteins (ex. 0.01)
 
     (flag)
       -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
                     (to limit the number of open files)
       -noindex      will NOT index the database - need to be done afterward with -index
+      -compress     compress the protein sequences (stored apart from the annotations)
+      -dedup        collapse identical sequences into one protein listing every member entry
 
 `
 
@@ -135,10 +157,13 @@ func main() {
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go NewMonitor(1, &stop, &wg)
-			var kvStores *kvstore.KVStores
-			kvStores = kvstore.KVStoresNew(*dbPath, *nbThreads, true, false, true)
+			kvStores, err := kvstore.KVStoresNew(*dbPath, *nbThreads, true, false, true)
 			stop = true
 			wg.Wait()
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
 			defer kvStores.Close()
 		}
 	case "makedb":
@@ -156,9 +181,30 @@ func main() {
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go NewMonitor(10, &stop, &wg)
-			makedb.NewMakedb(*dbPath, *inputPath, *inputFmt, *nbThreads, *makedbOffset, *makedbLenght, *maxSize, *noIndex)
+			err := makedb.NewMakedb(makedb.MakedbOptions{
+				DBPath:         *dbPath,
+				InputPath:      *inputPath,
+				InputFmt:       *inputFmt,
+				NbOfThreads:    *nbThreads,
+				Offset:         *makedbOffset,
+				Length:         *makedbLenght,
+				MaxSize:        *maxSize,
+				NoIndex:        *noIndex,
+				KmerSize:       *kmerSize,
+				Alphabet:       *alphabet,
+				Seed:           *seed,
+				Compress:       *compress,
+				Dedup:          *dedup,
+				HeaderTemplate: *headerTmpl,
+				SchemaFile:     *schemaFile,
+				StopKmers:      indexdb.StopKmerOptions{MaxProteins: *stopCount, MaxFraction: *stopFrac},
+			})
 			stop = true
 			wg.Wait()
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
 		}
 	default:
 		os.Remove("cpu.pprof")
@@ -17,19 +17,28 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
 
 	server "github.com/zorino/kaamer/api"
+	"github.com/zorino/kaamer/pkg/adddb"
 	"github.com/zorino/kaamer/pkg/backupdb"
 	"github.com/zorino/kaamer/pkg/downloaddb"
+	"github.com/zorino/kaamer/pkg/exportdb"
+	"github.com/zorino/kaamer/pkg/filterdb"
 	"github.com/zorino/kaamer/pkg/gcdb"
 	"github.com/zorino/kaamer/pkg/indexdb"
+	"github.com/zorino/kaamer/pkg/kvstore"
 	"github.com/zorino/kaamer/pkg/makedb"
 	"github.com/zorino/kaamer/pkg/mergedb"
+	"github.com/zorino/kaamer/pkg/migratedb"
+	"github.com/zorino/kaamer/pkg/removedb"
 	"github.com/zorino/kaamer/pkg/restoredb"
+	"github.com/zorino/kaamer/pkg/statsdb"
+	"github.com/zorino/kaamer/pkg/verifydb"
 )
 
 const (
@@ -54,27 +63,110 @@ func main() {
 
   -make             make the protein database
     (input)
-      -i            input file
-      -f            input format (embl, tsv, fasta)
+      -i            input files (comma separated files, glob patterns or directories, - for stdin)
+      -f            input format (embl, gbk, xml, gff3, tsv, fasta)
       -d            badger database directory (output)
       -t            number of threads to use (default all)
+      -k            kmer size between 5 and 12 (default 7)
+      -alphabet     (literal, murphy15, murphy10, murphy8, seb14, seb10)
+                    reduced amino acid alphabet for kmers (default literal)
+      -seed         spaced seed mask (ex. 1101011011) used instead of -k contiguous kmers
       -offset       start processing raw uniprot file at protein number x
       -length       process x number of proteins (-1 == infinity)
+      -header       FASTA header dialect (plain, uniprot, uniref, ncbi), a regular expression with named
+                    groups (EntryId and features) or a file of them (default plain)
+      -schema       TSV schema file, one column by line : column name or number <tab> EntryId,
+                    Sequence or feature name [<tab> list:separator] (default the header names)
+      -stopcount    drop the kmers shared by more than x proteins from the index (stop kmers)
+      -stopfrac     drop the kmers shared by more than a fraction of the proteins (ex. 0.01)
 
     (flag)
       -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
                     (to limit the number of open files)
       -noindex      will NOT index the database - need to be done afterward with -index
+      -compress     compress the protein sequences (stored apart from the annotations)
+      -dedup        collapse identical sequences into one protein listing every member entry
 
   -index            index the database for kmer samples association (kcomb_store)
     (input)
       -d            database directory
       -t            number of threads to use (default all)
+      -stopcount    drop the kmers shared by more than x proteins from the index (stop kmers)
+      -stopfrac     drop the kmers shared by more than a fraction of the proteins (ex. 0.01)
 
     (flag)
       -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
                     (to limit the number of open files)
 
+  -add              add the proteins of an input file to an indexed database
+                    (the proteins with an EntryId already in the database are skipped)
+    (input)
+      -i            input files (comma separated files, glob patterns or directories, - for stdin)
+      -f            input format (embl, gbk, xml, gff3, tsv, fasta)
+      -header       FASTA header dialect or template (see -make)
+      -schema       TSV schema file (see -make)
+      -d            database directory
+      -t            number of threads to use (default all)
+
+    (flag)
+      -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
+                    (to limit the number of open files)
+
+  -remove           remove protein entries (obsolete or withdrawn) from an indexed database
+    (input)
+      -d            database directory
+      -t            number of threads to use (default all)
+      -ids          EntryIds to remove (comma separated or a file with one EntryId by line)
+      -organism     remove the proteins of organisms containing this text
+      -taxonomy     remove the proteins with a taxonomy (FullTaxonomy) containing this text
+      -taxids       remove the proteins of these TaxIds (comma separated or a file with one TaxId by line)
+
+    (flag)
+      -ec           remove the proteins with an EC number
+      -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
+                    (to limit the number of open files)
+
+  -filter           make a sub-database from the proteins of a database matching feature filters
+    (input)
+      -d            database directory
+      -o            output directory of the sub-database
+      -t            number of threads to use (default all)
+      -organism     keep the proteins of organisms containing this text
+      -taxonomy     keep the proteins with a taxonomy (FullTaxonomy) containing this text
+      -taxids       keep the proteins of these TaxIds (comma separated or a file with one TaxId by line)
+      -stopcount    drop the kmers shared by more than x proteins from the index (stop kmers)
+      -stopfrac     drop the kmers shared by more than a fraction of the proteins (ex. 0.01)
+
+    (flag)
+      -ec           keep the proteins with an EC number
+      -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
+                    (to limit the number of open files)
+      -noindex      will NOT index the sub-database - need to be done afterward with -index
+
+  -export           export the indexed database to an immutable kmer index file
+                    used by the server for faster kmer lookups (redo after -index)
+    (input)
+      -d            database directory
+      -t            number of threads to use (default all)
+
+  -stats            report the content of a database (kcomb set sizes, kmer occupancy,
+                    annotation coverage, protein lengths and top organisms)
+                    and save it for /api/dbinfo?detailed=true
+    (input)
+      -d            database directory
+      -t            number of threads to use (default all)
+      -fmt          report format (text, json) (default text)
+      -o            output file (default stdout)
+      -top          number of top organisms (default 10)
+
+  -verify           check the consistency of a database (kmer -> kcomb -> protein links,
+                    stats and settings, stats counts) and exit with 1 on errors
+    (input)
+      -d            database directory
+      -t            number of threads to use (default all)
+      -sample       fraction of the kmers and kcomb sets checked for huge databases
+                    (default 1, the counts are always checked)
+
   -download         download databases (Uniprot, RefSeq, KeggPathways, BiocycPathways)
     (input)
       -o            output file (default: uniprotkb.txt.gz)
@@ -89,11 +181,20 @@ func main() {
                     plastid, protozoa, viral, vertebrate_mammalian, vertebrate_other
 
       -ncbi_nt      download a single NCBI genome genbank file from nuccore and transform to TSV to make a DB
+                    (-make -f tsv with the TSV or -make -f gbk with the genbank file)
 
     (flag)
       -kegg         download kegg pathways protein association and merge into database
       -biocyc       download biocyc pathways protein association and merge into database
 
+  -migrate          upgrade a database to the current format version
+    (input)
+      -d            database directory
+
+    (flag)
+      -maxsize      will maximize the size of tables (.sst) and vlog (.log) files
+                    (to limit the number of open files)
+
   -merge            merge 2 unindexed databases made with makedb
     (input)
       -dbs          databases directory
@@ -142,6 +243,15 @@ func main() {
 	var makedbLenght = flag.Uint("length", uint(MaxInt), "process x number of files")
 	var maxSize = flag.Bool("maxsize", false, "to maximize badger output file size")
 	var noIndex = flag.Bool("noindex", false, "prevent the indexing of database")
+	var kmerSize = flag.Int("k", kvstore.DefaultKmerSize, "kmer size")
+	var alphabet = flag.String("alphabet", kvstore.LiteralAlphabet, "kmer alphabet")
+	var seed = flag.String("seed", "", "spaced seed mask")
+	var compress = flag.Bool("compress", false, "compress protein sequences")
+	var dedup = flag.Bool("dedup", false, "deduplicate identical sequences")
+	var headerTemplate = flag.String("header", "", "FASTA header template")
+	var schemaFile = flag.String("schema", "", "TSV schema file")
+	var stopCount = flag.Uint64("stopcount", 0, "maximum number of proteins of a kmer")
+	var stopFrac = flag.Float64("stopfrac", 0, "maximum fraction of proteins of a kmer")
 
 	var indexOpt = flag.Bool("index", false, "program")
 
@@ -152,6 +262,28 @@ func main() {
 	var keggOpt = flag.Bool("kegg", false, "download kegg pathways")
 	var biocycOpt = flag.Bool("biocyc", false, "download biocyc pathways")
 
+	var addOpt = flag.Bool("add", false, "program")
+
+	var removeOpt = flag.Bool("remove", false, "program")
+	var removeIds = flag.String("ids", "", "EntryIds to remove")
+
+	var filterOpt = flag.Bool("filter", false, "program")
+	var filterOrganism = flag.String("organism", "", "organism filter")
+	var filterTaxonomy = flag.String("taxonomy", "", "taxonomy filter")
+	var filterTaxIds = flag.String("taxids", "", "taxids filter")
+	var filterEC = flag.Bool("ec", false, "EC number filter")
+
+	var exportOpt = flag.Bool("export", false, "program")
+
+	var statsOpt = flag.Bool("stats", false, "program")
+	var statsFmt = flag.String("fmt", "text", "report format")
+	var topOrganisms = flag.Int("top", statsdb.DefaultTopOrganisms, "number of top organisms")
+
+	var verifyOpt = flag.Bool("verify", false, "program")
+	var verifySample = flag.Float64("sample", 1, "fraction of the kmers and kcomb sets checked")
+
+	var migrateOpt = flag.Bool("migrate", false, "program")
+
 	var mergedbOpt = flag.Bool("merge", false, "program")
 	var dbsPath = flag.String("dbs", "", "db path argument")
 	var outPath = flag.String("o", "", "db path argument")
@@ -171,7 +303,7 @@ func main() {
 	flag.Parse()
 
 	if _, err := os.Stat(*tmpFolder); os.IsNotExist(err) {
-		fmt.Printf("Directory %s does not exist !\n", tmpFolder)
+		fmt.Printf("Directory %s does not exist !\n", *tmpFolder)
 		os.Exit(1)
 	}
 
@@ -180,7 +312,7 @@ func main() {
 		if *dbPath == "" {
 			fmt.Println("No db path !")
 		} else {
-			server.NewServer(*dbPath, *portNumber, *nbThreads, *tmpFolder)
+			exitOnError(server.NewServer(*dbPath, *portNumber, *nbThreads, *tmpFolder))
 		}
 		os.Exit(0)
 	}
@@ -192,31 +324,31 @@ func main() {
 				fmt.Println("Invalid taxon !")
 				os.Exit(1)
 			} else {
-				downloaddb.DownloadUniprot(*outPath, *uniprotOpt)
+				exitOnError(downloaddb.DownloadUniprot(*outPath, *uniprotOpt))
 			}
 		} else if *refseqOpt != "" {
 			if !downloaddb.NCBI_refseq_valid[*refseqOpt] {
 				fmt.Println("Invalid taxon !")
 				os.Exit(1)
 			} else {
-				downloaddb.DownloadRefseq(*outPath, *refseqOpt)
+				exitOnError(downloaddb.DownloadRefseq(*outPath, *refseqOpt))
 			}
 		} else if *keggOpt != false {
 			if *dbPath == "" {
 				fmt.Println("No input db path !")
 				os.Exit(1)
 			} else {
-				downloaddb.DownloadKEGG(*dbPath)
+				exitOnError(downloaddb.DownloadKEGG(*dbPath))
 			}
 		} else if *biocycOpt != false {
 			if *dbPath == "" {
 				fmt.Println("No input db path !")
 				os.Exit(1)
 			} else {
-				downloaddb.DownloadBiocyc(*dbPath)
+				exitOnError(downloaddb.DownloadBiocyc(*dbPath))
 			}
 		} else if *ncbigenomeOpt != "" {
-			downloaddb.DownloadGenbankGenome(*ncbigenomeOpt)
+			exitOnError(downloaddb.DownloadGenbankGenome(*ncbigenomeOpt))
 		} else {
 			fmt.Println("Need uniprot, refseq, kegg or biocyc option !")
 			os.Exit(1)
@@ -237,7 +369,24 @@ func main() {
 			fmt.Println("No input format (-f) !")
 			os.Exit(1)
 		} else {
-			makedb.NewMakedb(*dbPath, *inputPath, *inputFmt, *nbThreads, *makedbOffset, *makedbLenght, *maxSize, *noIndex)
+			exitOnError(makedb.NewMakedb(makedb.MakedbOptions{
+				DBPath:         *dbPath,
+				InputPath:      *inputPath,
+				InputFmt:       *inputFmt,
+				NbOfThreads:    *nbThreads,
+				Offset:         *makedbOffset,
+				Length:         *makedbLenght,
+				MaxSize:        *maxSize,
+				NoIndex:        *noIndex,
+				KmerSize:       *kmerSize,
+				Alphabet:       *alphabet,
+				Seed:           *seed,
+				Compress:       *compress,
+				Dedup:          *dedup,
+				HeaderTemplate: *headerTemplate,
+				SchemaFile:     *schemaFile,
+				StopKmers:      indexdb.StopKmerOptions{MaxProteins: *stopCount, MaxFraction: *stopFrac},
+			}))
 		}
 
 		os.Exit(0)
@@ -249,17 +398,104 @@ func main() {
 			fmt.Println("No db path !")
 			os.Exit(1)
 		} else {
-			indexdb.NewIndexDB(*dbPath, *nbThreads, *maxSize)
+			exitOnError(indexdb.NewIndexDB(*dbPath, *nbThreads, *maxSize, indexdb.StopKmerOptions{MaxProteins: *stopCount, MaxFraction: *stopFrac}))
 		}
 
 		os.Exit(0)
 	}
 
+	if *addOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else if *inputPath == "" {
+			fmt.Println("No input file !")
+			os.Exit(1)
+		} else if *inputFmt == "" {
+			fmt.Println("No input format (-f) !")
+			os.Exit(1)
+		} else {
+			exitOnError(adddb.NewAddDB(*dbPath, *inputPath, *inputFmt, *headerTemplate, *schemaFile, *nbThreads, *maxSize))
+		}
+		os.Exit(0)
+	}
+
+	if *removeOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else {
+			entryIds, err := filterdb.ReadList(*removeIds)
+			exitOnError(err)
+			taxIds, err := filterdb.ReadList(*filterTaxIds)
+			exitOnError(err)
+			filter := &filterdb.Filter{Organism: *filterOrganism, Taxonomy: *filterTaxonomy, WithEC: *filterEC, TaxIds: taxIds}
+			exitOnError(removedb.NewRemoveDB(*dbPath, entryIds, filter, *nbThreads, *maxSize))
+		}
+		os.Exit(0)
+	}
+
+	if *filterOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else if *outPath == "" {
+			fmt.Println("No output db path (-o) !")
+			os.Exit(1)
+		} else {
+			taxIds, err := filterdb.ReadList(*filterTaxIds)
+			exitOnError(err)
+			filter := &filterdb.Filter{Organism: *filterOrganism, Taxonomy: *filterTaxonomy, WithEC: *filterEC, TaxIds: taxIds}
+			exitOnError(filterdb.NewFilterDB(*dbPath, *outPath, filter, *nbThreads, *maxSize, *noIndex, indexdb.StopKmerOptions{MaxProteins: *stopCount, MaxFraction: *stopFrac}))
+		}
+		os.Exit(0)
+	}
+
+	if *exportOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else {
+			exitOnError(exportdb.NewExportDB(*dbPath, *nbThreads))
+		}
+		os.Exit(0)
+	}
+
+	if *statsOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else {
+			exitOnError(statsdb.NewStatsDB(*dbPath, *nbThreads, *statsFmt, *outPath, *topOrganisms))
+		}
+		os.Exit(0)
+	}
+
+	if *verifyOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else {
+			exitOnError(verifydb.NewVerifyDB(*dbPath, *nbThreads, *verifySample))
+		}
+		os.Exit(0)
+	}
+
+	if *migrateOpt == true {
+		if *dbPath == "" {
+			fmt.Println("No db path !")
+			os.Exit(1)
+		} else {
+			exitOnError(migratedb.NewMigrateDB(*dbPath, *nbThreads, *maxSize))
+		}
+		os.Exit(0)
+	}
+
 	if *mergedbOpt == true {
 		if *dbsPath == "" || *outPath == "" {
 			fmt.Println("Need to have a valid databases path !")
 		} else {
-			mergedb.NewMergedb(*dbsPath, *outPath, *maxSize)
+			exitOnError(mergedb.NewMergedb(*dbsPath, *outPath, *maxSize))
 		}
 		os.Exit(0)
 	}
@@ -268,7 +504,7 @@ func main() {
 		if *dbPath == "" {
 			fmt.Println("No db path !")
 		} else {
-			gcdb.NewGC(*dbPath, *gcIteration, *gcRatio, *maxSize)
+			exitOnError(gcdb.NewGC(*dbPath, *gcIteration, *gcRatio, *maxSize))
 		}
 		os.Exit(0)
 	}
@@ -279,7 +515,7 @@ func main() {
 		} else if *outPath == "" {
 			fmt.Println("Need to have a valid backup directory path !")
 		} else {
-			backupdb.Backupdb(*dbPath, *outPath)
+			exitOnError(backupdb.Backupdb(*dbPath, *outPath))
 		}
 		os.Exit(0)
 	}
@@ -290,7 +526,7 @@ func main() {
 		} else if *outPath == "" {
 			fmt.Println("Need to have a valid restore directory path !")
 		} else {
-			restoredb.RestoreDB(*dbPath, *outPath, *maxSize)
+			exitOnError(restoredb.RestoreDB(*dbPath, *outPath, *maxSize))
 		}
 		os.Exit(0)
 	}
@@ -299,3 +535,13 @@ func main() {
 	os.Exit(0)
 
 }
+
+// exitOnError reports the error of a program and exits
+// (declining a data provider license is not an error)
+func exitOnError(err error) {
+	if err == nil || errors.Is(err, downloaddb.ErrLicenseNotAccepted) {
+		return
+	}
+	fmt.Println(err.Error())
+	os.Exit(1)
+}
@@ -78,9 +78,27 @@ func main() {
       -gop          gap open penalty (default: 11)
       -gex          gap extension penalty (default: 1)
 
+
+  // Protein
+
+  -get              get the full record of database proteins by EntryId
+                    (needs a database indexed with its EntryIds)
+
+    (input)
+
+      -h            server host (default http://localhost:8321)
+
+      -id           EntryIds (comma separated)
+
+      -o            output file (default stdout)
+
+      -fmt          (json, fasta) output format (default json)
+
 `
 
 	var searchOpt = flag.Bool("search", false, "program")
+	var getOpt = flag.Bool("get", false, "program")
+	var entryIds = flag.String("id", "", "entry ids")
 
 	var serverHost = flag.String("h", "http://localhost:8321", "server URL")
 	var inputFile = flag.String("i", "", "input file")
@@ -180,6 +198,39 @@ func main() {
 
 	}
 
+	if *getOpt == true {
+
+		ids := searchcli.SplitEntryIds(*entryIds)
+		if len(ids) < 1 {
+			fmt.Println("No EntryId !")
+			os.Exit(1)
+		}
+
+		// tsv is the search default
+		if *outputFormat == "tsv" {
+			*outputFormat = "json"
+		}
+		if *outputFormat != "json" && *outputFormat != "fasta" {
+			fmt.Println("Invalid output format ! use json or fasta !")
+			os.Exit(1)
+		}
+
+		if !strings.Contains(*serverHost, "http://") && !strings.Contains(*serverHost, "https://") {
+			fmt.Println("Server URL (-h) needs the http(s):// !")
+			os.Exit(1)
+		}
+
+		searchcli.NewProteinRequest(searchcli.ProteinRequestOptions{
+			ServerHost: *serverHost,
+			EntryIds:   ids,
+			OutFormat:  *outputFormat,
+			OutputFile: *outputFile,
+		})
+
+		os.Exit(0)
+
+	}
+
 	fmt.Println(usage)
 	os.Exit(0)
 
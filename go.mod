@@ -1,6 +1,6 @@
 module github.com/zorino/kaamer
 
-go 1.12
+go 1.13
 
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
@@ -0,0 +1,485 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package adddb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/makedb"
+	"github.com/zorino/kaamer/pkg/statsdb"
+)
+
+// temporary database of the added proteins (inside the database directory)
+const addDirectory = "add.tmp"
+
+// NewAddDB adds the proteins of an input file to an indexed database
+// the input is first made into a temporary database with the kmer settings of dbPath,
+// its proteins get new ids after the ones of dbPath (proteins with an EntryId already in dbPath are skipped)
+// and the kmers point to new kcomb sets holding the added proteins (the kcomb sets in use are never modified)
+func NewAddDB(dbPath string, inputPath string, inputFmt string, headerTemplate string, schemaFile string, nbOfThreads int, maxSize bool) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, false, false)
+	if err != nil {
+		return err
+	}
+	kSettings, err := kvStores.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		kvStores.Close()
+		return err
+	}
+	if !kSettings.DatabaseIndexed {
+		kvStores.Close()
+		return fmt.Errorf("%w (use -merge to add an unindexed database)", kvstore.ErrNotIndexed)
+	}
+	seed, kmerSize, alphabet := kvStores.KmerStore.Seed(), kvStores.KmerStore.KmerSize(), kvStores.KmerStore.Alphabet()
+	if err := kvStores.Close(); err != nil {
+		return err
+	}
+
+	// proteins to add as an unindexed database
+	addPath := dbPath + "/" + addDirectory
+	os.RemoveAll(addPath)
+	defer os.RemoveAll(addPath)
+	err = makedb.NewMakedb(makedb.MakedbOptions{
+		DBPath:         addPath,
+		InputPath:      inputPath,
+		InputFmt:       inputFmt,
+		NbOfThreads:    nbOfThreads,
+		Length:         uint(math.MaxUint32),
+		MaxSize:        maxSize,
+		NoIndex:        true,
+		KmerSize:       kmerSize,
+		Alphabet:       alphabet,
+		Seed:           seed,
+		HeaderTemplate: headerTemplate,
+		SchemaFile:     schemaFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	kvStoresAdd, err := kvstore.KVStoresNew(addPath, nbOfThreads, maxSize, false, true)
+	if err != nil {
+		return err
+	}
+	defer kvStoresAdd.Close()
+
+	kvStores, err = kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
+	if err != nil {
+		return err
+	}
+	if err := addDB(kvStores, kvStoresAdd, kSettings, nbOfThreads); err != nil {
+		kvStores.Close()
+		return err
+	}
+
+	// the exported kmer index is stale
+	kvstore.RemoveKmerIndex(dbPath)
+
+	return kvStores.Close()
+
+}
+
+// addDB adds the proteins and kmers of kvStoresAdd to kvStores and updates its stats
+func addDB(kvStores *kvstore.KVStores, kvStoresAdd *kvstore.KVStores, kSettings *kvstore.KSettings, nbOfThreads int) error {
+
+	dbStats, err := kvStores.GetStats()
+	if err != nil {
+		return err
+	}
+
+	idMap, addStats, err := addProteins(kvStores, kvStoresAdd, kSettings, nbOfThreads)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Adding %d proteins\n", len(idMap))
+	if len(idMap) == 0 {
+		return nil
+	}
+
+	stopKmers, err := addKmers(kvStores, kvStoresAdd, idMap, dbStats, nbOfThreads)
+	if err != nil {
+		if rollbackErr := removeProteins(kvStores, idMap); rollbackErr != nil {
+			return fmt.Errorf("%w (added proteins not removed : %s)", err, rollbackErr.Error())
+		}
+		return err
+	}
+
+	// the added ids are never given again, even once removed
+	lastId := uint32(0)
+	for _, id := range idMap {
+		if id > lastId {
+			lastId = id
+		}
+	}
+	kSettings.LastProteinId = lastId
+	if err := kvStores.SaveSettings(kSettings); err != nil {
+		return err
+	}
+
+	dbStats.NumberOfProteins += addStats.NumberOfProteins
+	dbStats.NumberOfAA += addStats.NumberOfAA
+	dbStats.NumberOfKmers += addStats.NumberOfKmers
+	dbStats.StopKmers = stopKmers
+	if dbStats.NumberOfDuplicates > 0 {
+		dbStats.DedupRatio = float64(dbStats.NumberOfDuplicates) / float64(dbStats.NumberOfProteins+dbStats.NumberOfDuplicates)
+	}
+	for _, feature := range addStats.Features {
+		if !hasFeature(dbStats.Features, feature) {
+			dbStats.Features = append(dbStats.Features, feature)
+		}
+	}
+	if dbStats.NumberOfKCombSets, err = kvStores.KCombStore.CountKeys(nil); err != nil {
+		return err
+	}
+	if err := kvStores.SaveStats(dbStats); err != nil {
+		return err
+	}
+
+	return statsdb.RemoveReport(kvStores)
+
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// addProteins stores the proteins of kvStoresAdd under new ids (with their EntryId and names index)
+// and returns the new id of each added protein and their stats
+func addProteins(kvStores *kvstore.KVStores, kvStoresAdd *kvstore.KVStores, kSettings *kvstore.KSettings, nbOfThreads int) (map[uint32]uint32, *kvstore.KStats, error) {
+
+	addStats, err := kvStoresAdd.GetStats()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// last protein id ever used by the database
+	lastId, err := kvStores.LastProteinId(nbOfThreads)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// proteins to add in their input order
+	addIds := []uint32{}
+	err = kvStoresAdd.ProteinStore.Storage.Iterate(nil, func(key []byte, val []byte) error {
+		if kvstore.IsProteinKey(key) {
+			addIds = append(addIds, binary.BigEndian.Uint32(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(lastId)+uint64(len(addIds)) > math.MaxUint32 {
+		return nil, nil, errors.New("No protein id left in the database")
+	}
+
+	idMap := make(map[uint32]uint32)
+	stats := &kvstore.KStats{Features: addStats.Features}
+	kmerSize := kvStores.KmerStore.KmerSize()
+	nbOfSkipped := 0
+	// EntryIds added by this run (duplicates of the input)
+	seenEntryIds := make(map[string]bool)
+
+	kvStores.ProteinStore.OpenInsertChannel()
+
+	for start := 0; start < len(addIds) && err == nil; start += 1000 {
+		end := start + 1000
+		if end > len(addIds) {
+			end = len(addIds)
+		}
+		proteinIds := make([][]byte, 0, end-start)
+		for _, id := range addIds[start:end] {
+			proteinId := make([]byte, 4)
+			binary.BigEndian.PutUint32(proteinId, id)
+			proteinIds = append(proteinIds, proteinId)
+		}
+		var proteins []*kvstore.Protein
+		if proteins, err = kvStoresAdd.ProteinStore.GetProteins(proteinIds, true); err != nil {
+			break
+		}
+		for i, prot := range proteins {
+			if prot == nil {
+				continue
+			}
+			if kSettings.IDsIndexed {
+				if _, ok := kvStores.ProteinStore.GetProteinKey(prot.EntryId); ok || seenEntryIds[prot.EntryId] {
+					nbOfSkipped++
+					continue
+				}
+				if prot.EntryId != "" {
+					seenEntryIds[prot.EntryId] = true
+				}
+			}
+			lastId++
+			proteinId := make([]byte, 4)
+			binary.BigEndian.PutUint32(proteinId, lastId)
+			if err = kvStores.ProteinStore.AddProteinToChannel(proteinId, prot); err != nil {
+				break
+			}
+			if kSettings.IDsIndexed && prot.EntryId != "" {
+				kvStores.ProteinStore.AddValueToChannel(kvstore.EntryIdKey(prot.EntryId), proteinId, false)
+			}
+			if kSettings.NamesIndexed {
+				kvStores.ProteinStore.AddNamesToChannel(proteinId, prot)
+			}
+			idMap[addIds[start+i]] = lastId
+			stats.NumberOfProteins++
+			stats.NumberOfAA += uint64(prot.Length)
+			if int(prot.Length) >= kmerSize {
+				stats.NumberOfKmers += uint64(int(prot.Length) - kmerSize + 1)
+			}
+		}
+	}
+
+	if closeErr := kvStores.ProteinStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if nbOfSkipped > 0 {
+		fmt.Printf("# Skipped %d proteins already in the database or the input\n", nbOfSkipped)
+	}
+
+	return idMap, stats, nil
+
+}
+
+// removeProteins deletes the added proteins with their EntryId and names index
+// (the kmers replaced before an error may still point to their ids, missing proteins are skipped by the search)
+func removeProteins(kvStores *kvstore.KVStores, idMap map[uint32]uint32) error {
+
+	proteinStore := kvStores.ProteinStore
+	batch := proteinStore.Storage.NewBatch()
+	for _, id := range idMap {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		prot, ok := proteinStore.GetProtein(proteinId, false)
+		if !ok {
+			continue
+		}
+		if err := batch.Delete(proteinId); err != nil {
+			return err
+		}
+		if err := batch.Delete(kvstore.SequenceKey(proteinId)); err != nil {
+			return err
+		}
+		if val, ok := proteinStore.GetProteinKey(prot.EntryId); ok && bytes.Equal(val, proteinId) {
+			if err := batch.Delete(kvstore.EntryIdKey(prot.EntryId)); err != nil {
+				return err
+			}
+		}
+		for _, key := range kvstore.NameKeys(proteinId, prot) {
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return batch.Flush()
+
+}
+
+// addKmers adds the new protein ids to the kcomb set of their kmers and returns the updated stop kmers
+// a kmer shared by more proteins than the stop kmer threshold of the database becomes a stop kmer,
+// the replaced kcomb sets left without kmer are deleted
+func addKmers(kvStores *kvstore.KVStores, kvStoresAdd *kvstore.KVStores, idMap map[uint32]uint32, dbStats *kvstore.KStats, nbOfThreads int) ([]*kvstore.StopKmer, error) {
+
+	fmt.Println("# Adding the kmers to the key combination store")
+
+	stopKmers := make(map[string]*kvstore.StopKmer)
+	for _, stopKmer := range dbStats.StopKmers {
+		stopKmers[stopKmer.Kmer] = stopKmer
+	}
+	threshold := dbStats.StopKmerThreshold
+
+	kmerUpdates := make(map[string][]byte)
+	nbOfReplaced := 0
+	replacedCombKeys := make(map[string]bool)
+	mu := new(sync.Mutex)
+
+	kvStores.KCombStore.OpenKCombBatch()
+
+	err := kvStoresAdd.KmerStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+
+		proteinIds := make(map[uint32]bool)
+		for _, val := range kvstore.RemoveDuplicatesFromSlice(values) {
+			if id, ok := idMap[binary.BigEndian.Uint32(val)]; ok {
+				proteinIds[id] = true
+			}
+		}
+		if len(proteinIds) == 0 {
+			return nil
+		}
+
+		combKey, err := kvStores.KmerStore.Storage.Get(key)
+		if err != nil && err != kvstore.ErrKeyNotFound {
+			return err
+		}
+		exists := err == nil
+
+		if exists && bytes.Equal(combKey, kvstore.StopKmerValue) {
+			kmer := kvStores.KmerStore.DecodeKmer(key)
+			mu.Lock()
+			if stopKmer, ok := stopKmers[kmer]; ok {
+				stopKmer.NumberOfProteins += uint64(len(proteinIds))
+			}
+			mu.Unlock()
+			return nil
+		}
+
+		// proteins of the current kcomb set
+		if exists {
+			combVal, err := kvStores.KCombStore.Storage.Get(combKey)
+			if err != nil {
+				return fmt.Errorf("kmer %x kcomb : %w", key, err)
+			}
+			ids, err := kvStores.KCombStore.DecodeProteinKeys(combVal)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				proteinIds[id] = true
+			}
+		}
+
+		var newVal []byte
+		if threshold > 0 && uint64(len(proteinIds)) > threshold {
+			newVal = kvstore.StopKmerValue
+			kmer := kvStores.KmerStore.DecodeKmer(key)
+			mu.Lock()
+			stopKmers[kmer] = &kvstore.StopKmer{Kmer: kmer, NumberOfProteins: uint64(len(proteinIds))}
+			mu.Unlock()
+		} else {
+			keys := make([][]byte, 0, len(proteinIds))
+			for id := range proteinIds {
+				proteinId := make([]byte, 4)
+				binary.BigEndian.PutUint32(proteinId, id)
+				keys = append(keys, proteinId)
+			}
+			newCombKey, err := kvStores.KCombStore.CreateKCombKey(keys)
+			if err != nil {
+				return err
+			}
+			newVal = newCombKey
+		}
+
+		mu.Lock()
+		kmerUpdates[string(key)] = newVal
+		if exists {
+			nbOfReplaced++
+			if !bytes.Equal(combKey, newVal) {
+				replacedCombKeys[string(combKey)] = true
+			}
+		}
+		mu.Unlock()
+
+		return nil
+
+	})
+
+	if closeErr := kvStores.KCombStore.CloseKCombBatch(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the kmer_store keeps all the versions, the replaced ones are discarded
+	batch := kvStores.KmerStore.Storage.NewBatch()
+	for key, val := range kmerUpdates {
+		if err := batch.Replace([]byte(key), val); err != nil {
+			return nil, err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("# %d kmers updated (%d new)\n", len(kmerUpdates), len(kmerUpdates)-nbOfReplaced)
+
+	if err := removeOrphanKCombSets(kvStores, replacedCombKeys, nbOfThreads); err != nil {
+		return nil, err
+	}
+
+	stopKmerList := make([]*kvstore.StopKmer, 0, len(stopKmers))
+	for _, stopKmer := range stopKmers {
+		stopKmerList = append(stopKmerList, stopKmer)
+	}
+	sort.Slice(stopKmerList, func(i, j int) bool {
+		return stopKmerList[i].NumberOfProteins > stopKmerList[j].NumberOfProteins
+	})
+
+	return stopKmerList, nil
+
+}
+
+// removeOrphanKCombSets deletes the replaced kcomb sets that no kmer points to anymore
+func removeOrphanKCombSets(kvStores *kvstore.KVStores, replacedCombKeys map[string]bool, nbOfThreads int) error {
+
+	if len(replacedCombKeys) == 0 {
+		return nil
+	}
+
+	mu := new(sync.Mutex)
+	err := kvStores.KmerStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		mu.Lock()
+		delete(replacedCombKeys, string(values[0]))
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := kvStores.KCombStore.Storage.NewBatch()
+	for combKey := range replacedCombKeys {
+		if err := batch.Delete([]byte(combKey)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("# %d kcomb sets left without kmer removed\n", len(replacedCombKeys))
+
+	return nil
+
+}
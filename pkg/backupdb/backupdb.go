@@ -17,16 +17,15 @@ limitations under the License.
 package backupdb
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
 
-	"github.com/dgraph-io/badger/v3"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-func Backupdb(dbPath string, output string) {
+func Backupdb(dbPath string, output string) error {
 
 	// For SSD throughput (as done in badger/graphdb) see :
 	// https://groups.google.com/forum/#!topic/golang-nuts/jPb_h3TvlKE/discussion
@@ -42,24 +41,42 @@ func Backupdb(dbPath string, output string) {
 		os.Mkdir(output, 0700)
 	}
 
-	kvStores1 := kvstore.KVStoresNew(dbPath, nbOfThreads, true, false, true)
+	kvStores1, err := kvstore.KVStoresNew(dbPath, nbOfThreads, true, false, true)
+	if err != nil {
+		return err
+	}
+
+	err = Backup(kvStores1.KmerStore.Storage, output+"/kmer_store.bdg")
+	if err == nil {
+		err = Backup(kvStores1.ProteinStore.Storage, output+"/protein_store.bdg")
+	}
 
-	Backup(kvStores1.KmerStore.DB, output+"/kmer_store.bdg")
-	Backup(kvStores1.ProteinStore.DB, output+"/protein_store.bdg")
+	if closeErr := kvStores1.Close(); err == nil {
+		err = closeErr
+	}
 
-	kvStores1.Close()
+	return err
 
 }
 
-func Backup(db *badger.DB, bckFile string) {
+func Backup(storage kvstore.Storage, bckFile string) error {
+
+	// badger backup format only
+	badgerStorage, ok := storage.(*kvstore.BadgerStorage)
+	if !ok {
+		return errors.New("Backup is only supported for badger stores")
+	}
 
 	f, err := os.Create(bckFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
 	fmt.Printf("# Backup %s\n", bckFile)
-	db.Backup(f, 0)
+	if _, err := badgerStorage.DB.Backup(f, 0); err != nil {
+		f.Close()
+		return err
+	}
 
-	f.Close()
+	return f.Close()
 }
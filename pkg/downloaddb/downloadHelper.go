@@ -1,11 +1,9 @@
 package downloaddb
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -15,6 +13,9 @@ import (
 	"github.com/jlaffaye/ftp"
 )
 
+// ErrLicenseNotAccepted is returned when the terms of a data provider are declined
+var ErrLicenseNotAccepted = errors.New("License not accepted")
+
 // WriteCounter counts the number of bytes written to it. It implements to the io.Writer
 // interface and we can pass this into io.TeeReader() which will report progress on each
 // write cycle.
@@ -39,75 +40,76 @@ func (wc WriteCounter) PrintProgress() {
 	fmt.Printf("\r  Downloading... %s complete", humanize.Bytes(wc.Total))
 }
 
-func IODownloadFTP(dstFile *os.File, host string, path string) {
+func IODownloadFTP(dstFile *os.File, host string, path string) error {
 
 	c, err := ftp.Dial(host, ftp.DialWithTimeout(5*time.Second))
 	if err != nil {
-		fmt.Println("Error c.Dial")
-		log.Fatal(err.Error())
+		return fmt.Errorf("FTP dial %s : %w", host, err)
 	}
 
 	err = c.Login("anonymous", "anonymous")
 	if err != nil {
-		fmt.Println("Error c.Login")
-		log.Fatal(err.Error())
+		c.Quit()
+		return fmt.Errorf("FTP login %s : %w", host, err)
 	}
 
 	reader, err := c.Retr(path)
 	if err != nil {
-		fmt.Println("Error c.Retr")
-		log.Fatal(err.Error())
+		c.Quit()
+		return fmt.Errorf("FTP retrieve %s%s : %w", host, path, err)
 	}
 
 	_, err = io.Copy(dstFile, reader)
-
-	if err := c.Quit(); err != nil {
-		log.Fatal(err)
+	reader.Close()
+	if err != nil {
+		c.Quit()
+		return err
 	}
 
+	return c.Quit()
+
 }
 
-func IOListFTP(host string, path string) []*ftp.Entry {
+func IOListFTP(host string, path string) ([]*ftp.Entry, error) {
 
 	c, err := ftp.Dial(host, ftp.DialWithTimeout(5*time.Second))
 	if err != nil {
-		fmt.Println("Error c.Dial")
-		log.Fatal(err.Error())
+		return nil, fmt.Errorf("FTP dial %s : %w", host, err)
 	}
 
 	err = c.Login("anonymous", "anonymous")
 	if err != nil {
-		fmt.Println("Error c.Login")
-		log.Fatal(err.Error())
+		c.Quit()
+		return nil, fmt.Errorf("FTP login %s : %w", host, err)
 	}
 
 	listing, err := c.List(path)
 	if err != nil {
-		fmt.Println("Error c.Retr")
-		log.Fatal(err.Error())
+		c.Quit()
+		return nil, fmt.Errorf("FTP list %s%s : %w", host, path, err)
 	}
 
 	if err := c.Quit(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return listing
+	return listing, nil
 
 }
 
-func IODownloadHTTP(dstFile *os.File, url string) {
+func IODownloadHTTP(dstFile *os.File, url string) error {
 	// Search the corresponding ID in the API
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP get %s : %s", url, resp.Status)
+	}
 
-	_, err = io.Copy(dstFile, bytes.NewReader(body))
+	_, err = io.Copy(dstFile, resp.Body)
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	return err
 
 }
@@ -18,18 +18,13 @@ package downloaddb
 
 import (
 	"bufio"
-	"bytes"
-	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
 
-	"github.com/dgraph-io/badger/v3"
-	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
@@ -38,7 +33,7 @@ var (
 	KEGG_API = "http://rest.kegg.jp"
 )
 
-func DownloadKEGG(dbPath string) {
+func DownloadKEGG(dbPath string) error {
 
 	// TODO add to CLI
 	fmt.Println("## Notice ##")
@@ -53,57 +48,31 @@ func DownloadKEGG(dbPath string) {
 
 	if strings.ToLower(answer) != "y" {
 		fmt.Println("I am sorry you couldn't accept that license")
-		os.Exit(0)
+		return ErrLicenseNotAccepted
 	}
 
-	kvStores := kvstore.KVStoresNew(dbPath, 2, true, true, false)
+	kvStores, err := kvstore.KVStoresNew(dbPath, 2, true, true, false)
+	if err != nil {
+		return err
+	}
 
 	proteinStore := kvStores.ProteinStore
 
-	stream := proteinStore.DB.NewStream()
-
 	proteinStore.OpenInsertChannel()
 
-	// -- Optional settings
-	stream.NumGo = 1                      // Set number of goroutines to use for iteration.
-	stream.Prefix = nil                   // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
-
-	// ChooseKey is called concurrently for every key. If left nil, assumes true by default.
-	stream.ChooseKey = nil
-
-	// KeyToList is called concurrently for chosen keys. This can be used to convert
-	// Badger data into custom key-values. If nil, uses stream.ToList, a default
-	// implementation, which picks all valid key-values.
-
-	// stream.KeyToList = nil
-	stream.KeyToList = func(key []byte, it *badger.Iterator) (*pb.KVList, error) {
-
-		valCopy := []byte{}
-		keyCopy := []byte{}
-
-		for ; it.Valid(); it.Next() {
-
-			item := it.Item()
-			if item.IsDeletedOrExpired() {
-				break
-			}
-			if item.DiscardEarlierVersions() {
-				break
-			}
-			if !bytes.Equal(key, item.Key()) {
-				break
-			}
+	// Stream proteins
+	err = proteinStore.Storage.Stream(nil, 1, func(key []byte, values [][]byte) error {
 
-			valCopy, err := item.ValueCopy(valCopy)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
 
-			keyCopy = item.KeyCopy(keyCopy)
+		for _, val := range values {
 
 			prot := &kvstore.Protein{}
-			proto.Unmarshal(valCopy, prot)
+			if err := proto.Unmarshal(val, prot); err != nil {
+				return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+			}
 
 			keggIds := []string{}
 			if ids, ok := prot.Features["KEGG_ID"]; ok {
@@ -123,7 +92,7 @@ func DownloadKEGG(dbPath string) {
 						fmt.Println(strings.Join(pathways, ";"))
 						newVal, err := proto.Marshal(prot)
 						if err == nil {
-							proteinStore.AddValueToChannel(keyCopy, newVal, false)
+							proteinStore.AddValueToChannel(key, newVal, false)
 						}
 					}
 				}
@@ -131,25 +100,20 @@ func DownloadKEGG(dbPath string) {
 
 		}
 
-		return nil, nil
-
-	}
-
-	// -- End of optional settings.
+		return nil
 
-	// Send is called serially, while Stream.Orchestrate is running.
-	stream.Send = nil
-
-	// // Run the stream
-	// Run the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		log.Fatal(err.Error)
-	}
+	})
 
 	// Done.
-	proteinStore.CloseInsertChannel()
+	if closeErr := proteinStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
 	proteinStore.Flush()
-	kvStores.Close()
+	if closeErr := kvStores.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
 
 }
 
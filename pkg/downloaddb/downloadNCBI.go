@@ -21,11 +21,12 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
 const (
@@ -51,7 +52,7 @@ var (
 	}
 )
 
-func DownloadRefseq(outputFile string, taxon string) {
+func DownloadRefseq(outputFile string, taxon string) error {
 
 	if outputFile == "" {
 		outputFile = "refseq-" + taxon + ".gpff.gz"
@@ -59,78 +60,90 @@ func DownloadRefseq(outputFile string, taxon string) {
 
 	dstFile, err := os.Create(outputFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
+	defer dstFile.Close()
 
 	refseq_path := NCBI_refseq_ftp_path + taxon
 
-	entries := IOListFTP(NCBI_refseq_ftp_host, refseq_path)
+	entries, err := IOListFTP(NCBI_refseq_ftp_host, refseq_path)
+	if err != nil {
+		return err
+	}
 
 	for _, e := range entries {
 		if strings.Contains(e.Name, ".nonredundant_protein.") && strings.Contains(e.Name, ".gpff.gz") {
 			fmt.Printf("# Downloading %s into %s..\n", e.Name, outputFile)
-			IODownloadFTP(dstFile, NCBI_refseq_ftp_host, (refseq_path + "/" + e.Name))
+			if err := IODownloadFTP(dstFile, NCBI_refseq_ftp_host, (refseq_path + "/" + e.Name)); err != nil {
+				return err
+			}
 		}
 	}
 
-	err = dstFile.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return dstFile.Close()
 
 }
 
-func DownloadGenbankGenome(genomeId string) {
+func DownloadGenbankGenome(genomeId string) error {
 
 	// Search the corresponding ID in the API
 	url := NCBI_eutil_api_path + "esearch.fcgi?db=nucleotide&term=" + genomeId
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	var eSearchResult struct {
 		Id string `xml:"IdList>Id"`
 	}
 	if err := xml.Unmarshal(body, &eSearchResult); err != nil {
-		log.Fatal(err)
+		return kvstore.BadFormatError("esearch result : %s", err.Error())
+	}
+	if eSearchResult.Id == "" {
+		return fmt.Errorf("Genome %s not found", genomeId)
 	}
 
 	// Download the genome
 	genomeFileName := genomeId + ".gbk"
 	dstFile, err := os.Create(genomeFileName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
 	url = NCBI_eutil_api_path + "efetch.fcgi?db=nucleotide&rettype=gb&id=" + eSearchResult.Id
-	IODownloadHTTP(dstFile, url)
-	dstFile.Close()
+	err = IODownloadHTTP(dstFile, url)
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
 
-	ParseGenbank(genomeFileName)
+	return ParseGenbank(genomeFileName)
 
 }
 
-func ParseGenbank(gbkFile string) {
+func ParseGenbank(gbkFile string) error {
 
-	outputFile, err := os.Create(strings.Replace(gbkFile, ".gbk", ".tsv", -1))
+	var scanner *bufio.Scanner
 
+	file, err := os.Open(gbkFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	var scanner *bufio.Scanner
+	defer file.Close()
 
-	file, err := os.Open(gbkFile)
+	outputFile, err := os.Create(strings.Replace(gbkFile, ".gbk", ".tsv", -1))
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
-	defer file.Close()
+	defer outputFile.Close()
 
 	reader := bufio.NewReader(file)
 	scanner = bufio.NewScanner(reader)
@@ -216,7 +229,10 @@ func ParseGenbank(gbkFile string) {
 
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 
-	outputFile.Close()
+	return outputFile.Close()
 
 }
@@ -18,7 +18,6 @@ package downloaddb
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 )
@@ -43,7 +42,7 @@ var (
 	}
 )
 
-func DownloadUniprot(outputFile string, taxon string) {
+func DownloadUniprot(outputFile string, taxon string) error {
 
 	if outputFile == "" {
 		outputFile = "uniprotkb-" + taxon + ".dat.gz"
@@ -53,35 +52,43 @@ func DownloadUniprot(outputFile string, taxon string) {
 
 	dstFileLicense, err := os.Create(outputPath + "/LICENSE")
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
+	defer dstFileLicense.Close()
 
 	dstFile, err := os.Create(outputFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
+	defer dstFile.Close()
 
 	license_path := Uniprot_ftp_taxonomic_path + "LICENSE"
 	sprot_path := Uniprot_ftp_taxonomic_path + "uniprot_sprot_" + taxon + ".dat.gz"
 	trembl_path := Uniprot_ftp_taxonomic_path + "uniprot_trembl_" + taxon + ".dat.gz"
 
 	fmt.Println("# Downloading uniprotkb - LICENSE..")
-	IODownloadFTP(dstFileLicense, Uniprot_ftp_host, license_path)
+	if err := IODownloadFTP(dstFileLicense, Uniprot_ftp_host, license_path); err != nil {
+		return err
+	}
 	fmt.Printf("# Downloading uniprotkb - swissprot (%s)..\n", taxon)
-	IODownloadFTP(dstFile, Uniprot_ftp_host, sprot_path)
+	if err := IODownloadFTP(dstFile, Uniprot_ftp_host, sprot_path); err != nil {
+		return err
+	}
 	fmt.Printf("# Downloading uniprotkb - trembl (%s)..\n", taxon)
-	IODownloadFTP(dstFile, Uniprot_ftp_host, trembl_path)
+	if err := IODownloadFTP(dstFile, Uniprot_ftp_host, trembl_path); err != nil {
+		return err
+	}
 
-	err = dstFile.Close()
-	if err != nil {
-		log.Fatal(err)
+	if err := dstFile.Close(); err != nil {
+		return err
 	}
 
-	err = dstFileLicense.Close()
-	if err != nil {
-		log.Fatal(err)
+	if err := dstFileLicense.Close(); err != nil {
+		return err
 	}
 
 	fmt.Printf("See LICENSE : %s\n", outputPath+"/LICENSE")
 
+	return nil
+
 }
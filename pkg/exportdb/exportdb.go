@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exportdb
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// NewExportDB writes the immutable kmer index used by the server for searches
+func NewExportDB(dbPath string, nbOfThreads int) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	// the previous export would otherwise be loaded by the read-only stores
+	kvstore.RemoveKmerIndex(dbPath)
+
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, false, false, true)
+	if err != nil {
+		return err
+	}
+	defer kvStores.Close()
+
+	if kSettings, err := kvStores.GetSettings(); err != nil {
+		return err
+	} else if !kSettings.DatabaseIndexed {
+		return fmt.Errorf("%w (run kaamer-db -index)", kvstore.ErrNotIndexed)
+	}
+
+	indexPath := dbPath + "/" + kvstore.KmerIndexFile
+	fmt.Printf("# Exporting kmer index to %s\n", indexPath)
+	if err := kvstore.WriteKmerIndex(kvStores, indexPath); err != nil {
+		return fmt.Errorf("Kmer index export failed : %w", err)
+	}
+
+	kmerIndex, err := kvstore.OpenKmerIndex(indexPath)
+	if err != nil {
+		return fmt.Errorf("Kmer index export failed : %w", err)
+	}
+	fmt.Printf("# Exported %d kmers\n", kmerIndex.NumberOfKmers())
+
+	return kmerIndex.Close()
+
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filterdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zorino/kaamer/pkg/indexdb"
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// Filter on the protein features, a protein entry is kept when it matches every predicate set
+type Filter struct {
+	Organism string          // Organism containing the text (case insensitive)
+	Taxonomy string          // FullTaxonomy containing the text (case insensitive)
+	WithEC   bool            // EC number present
+	TaxIds   map[string]bool // TaxId in the list
+}
+
+func (f *Filter) IsEmpty() bool {
+	return f.Organism == "" && f.Taxonomy == "" && !f.WithEC && len(f.TaxIds) == 0
+}
+
+func (f *Filter) Match(protein *kvstore.Protein) bool {
+
+	if f.Organism != "" && !containsFold(protein.Features["Organism"], f.Organism) {
+		return false
+	}
+	if f.Taxonomy != "" && !containsFold(protein.Features["FullTaxonomy"], f.Taxonomy) {
+		return false
+	}
+	if f.WithEC && protein.Features["EC"] == "" {
+		return false
+	}
+	if len(f.TaxIds) > 0 && !f.TaxIds[protein.Features["TaxId"]] {
+		return false
+	}
+
+	return true
+
+}
+
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// ReadList reads a comma separated list (of TaxIds or EntryIds) or a file with one item by line
+func ReadList(arg string) (map[string]bool, error) {
+
+	items := make(map[string]bool)
+	if arg == "" {
+		return items, nil
+	}
+
+	file, err := os.Open(arg)
+	if os.IsNotExist(err) {
+		for _, item := range strings.Split(arg, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items[item] = true
+			}
+		}
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if item := strings.TrimSpace(scanner.Text()); item != "" {
+			items[item] = true
+		}
+	}
+
+	return items, scanner.Err()
+
+}
+
+// NewFilterDB makes the database outPath from the proteins of dbPath matching the filter
+// the members of deduplicated proteins are filtered on their own annotations
+func NewFilterDB(dbPath string, outPath string, filter *Filter, nbOfThreads int, maxSize bool, noIndex bool, stopKmers indexdb.StopKmerOptions) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	if filter.IsEmpty() {
+		return errors.New("No filter (-organism, -taxonomy, -ec or -taxids) !")
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(outPath); err == nil {
+		return fmt.Errorf("Output directory %s already exists", outPath)
+	}
+
+	kvStoresIn, err := kvstore.KVStoresNew(dbPath, nbOfThreads, false, false, true)
+	if err != nil {
+		return err
+	}
+	defer kvStoresIn.Close()
+
+	dbStatsIn, err := kvStoresIn.GetStats()
+	if err != nil {
+		return fmt.Errorf("%s : %w", dbPath, err)
+	}
+	kSettingsIn, err := kvStoresIn.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		return err
+	}
+
+	fmt.Printf("# Filtering database %s into %s\n", dbPath, outPath)
+
+	os.Mkdir(outPath, 0700)
+
+	kvStoresOut, err := kvstore.KVStoresNew(outPath, nbOfThreads, maxSize, false, false)
+	if err != nil {
+		return err
+	}
+	if seed := kvStoresIn.KmerStore.Seed(); seed != "" {
+		kvStoresOut.KmerStore.SetSeed(seed)
+	} else {
+		kvStoresOut.KmerStore.SetKmerSize(kvStoresIn.KmerStore.KmerSize())
+	}
+	if err := kvStoresOut.KmerStore.SetAlphabet(kvStoresIn.KmerStore.Alphabet()); err != nil {
+		kvStoresOut.Close()
+		return err
+	}
+	kvStoresOut.ProteinStore.SetSequenceEncoding(kvStoresIn.ProteinStore.SequenceEncoding())
+	kvStoresOut.OpenInsertChannel()
+
+	err = filterProteins(kvStoresIn, kvStoresOut, filter, dbStatsIn.Features, nbOfThreads)
+
+	// Settings of the source database (completed by indexdb)
+	if err == nil {
+		kSettings := &kvstore.KSettings{
+			FormatVersion:    kvstore.CurrentFormatVersion,
+			CreationDate:     time.Now().Format("2006-01-02"),
+			OriginalFile:     kSettingsIn.OriginalFile,
+			KmerSize:         int32(kvStoresOut.KmerStore.KmerSize()),
+			Alphabet:         kvStoresOut.KmerStore.Alphabet(),
+			Seed:             kvStoresOut.KmerStore.Seed(),
+			SequenceEncoding: kvStoresOut.ProteinStore.SequenceEncoding(),
+		}
+		var data []byte
+		if data, err = proto.Marshal(kSettings); err == nil {
+			kvStoresOut.ProteinStore.AddValueToChannel([]byte("db_settings"), data, true)
+		}
+	}
+
+	if closeErr := kvStoresOut.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+	if closeErr := kvStoresOut.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !noIndex {
+		return indexdb.NewIndexDB(outPath, nbOfThreads, maxSize, stopKmers)
+	}
+
+	return nil
+
+}
+
+// filterProteins adds the proteins matching the filter with their kmers and the stats of the new database
+func filterProteins(kvStoresIn *kvstore.KVStores, kvStoresOut *kvstore.KVStores, filter *Filter, features []string, nbOfThreads int) error {
+
+	timeStart := time.Now()
+	kmerSize := kvStoresOut.KmerStore.KmerSize()
+	kStats := &kvstore.KStats{Features: features}
+	nbOfEntries := uint64(0)
+	mu := new(sync.Mutex)
+
+	err := kvStoresIn.ProteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+
+		prot := &kvstore.Protein{}
+		if err := proto.Unmarshal(values[0], prot); err != nil {
+			return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+		}
+
+		// a member matching the filter replaces a representative that does not
+		entries := []*kvstore.Protein{}
+		for _, entry := range append([]*kvstore.Protein{prot}, prot.Members...) {
+			if filter.Match(entry) {
+				entries = append(entries, &kvstore.Protein{EntryId: entry.EntryId, Length: entry.Length, Features: entry.Features})
+			}
+		}
+
+		mu.Lock()
+		nbOfEntries += uint64(1 + len(prot.Members))
+		mu.Unlock()
+
+		if len(entries) == 0 {
+			return nil
+		}
+
+		val, err := kvStoresIn.ProteinStore.Storage.Get(kvstore.SequenceKey(key))
+		if err != nil {
+			return fmt.Errorf("protein %x sequence : %w", key, err)
+		}
+		protein := entries[0]
+		if protein.Sequence, err = kvStoresIn.ProteinStore.DecodeSequence(val); err != nil {
+			return err
+		}
+		protein.Length = int32(len(protein.Sequence))
+		if len(entries) > 1 {
+			protein.Members = entries[1:]
+		}
+
+		proteinId := append([]byte{}, key...)
+		if err := kvStoresOut.ProteinStore.AddProteinToChannel(proteinId, protein); err != nil {
+			return err
+		}
+		for i := 0; i < int(protein.Length)-kmerSize+1; i++ {
+			kmerKey := kvStoresOut.KmerStore.CreateBytesKey(protein.Sequence[i : i+kmerSize])
+			kvStoresOut.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		kStats.NumberOfProteins++
+		kStats.NumberOfAA += uint64(protein.Length)
+		if int(protein.Length) >= kmerSize {
+			kStats.NumberOfKmers += uint64(int(protein.Length) - kmerSize + 1)
+		}
+		kStats.NumberOfDuplicates += uint64(len(protein.Members))
+		if kStats.NumberOfProteins%10000 == 0 {
+			fmt.Printf("Filtered %d proteins in %f minutes\n", kStats.NumberOfProteins, time.Since(timeStart).Minutes())
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	if kStats.NumberOfDuplicates > 0 {
+		kStats.DedupRatio = float64(kStats.NumberOfDuplicates) / float64(kStats.NumberOfProteins+kStats.NumberOfDuplicates)
+	}
+
+	fmt.Printf("# Kept %d of %d protein entries\n", kStats.NumberOfProteins+kStats.NumberOfDuplicates, nbOfEntries)
+
+	data, err := proto.Marshal(kStats)
+	if err != nil {
+		return err
+	}
+	kvStoresOut.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
+
+	return nil
+
+}
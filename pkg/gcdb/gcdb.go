@@ -23,10 +23,13 @@ import (
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-func NewGC(dbPath string, iteration int, ratio float64, maxSize bool) {
+func NewGC(dbPath string, iteration int, ratio float64, maxSize bool) error {
 
 	runtime.GOMAXPROCS(128)
-	kvStores := kvstore.KVStoresNew(dbPath, runtime.NumCPU(), maxSize, true, false)
+	kvStores, err := kvstore.KVStoresNew(dbPath, runtime.NumCPU(), maxSize, true, false)
+	if err != nil {
+		return err
+	}
 
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
@@ -40,6 +43,6 @@ func NewGC(dbPath string, iteration int, ratio float64, maxSize bool) {
 	}(wg)
 	wg.Wait()
 
-	kvStores.Close()
+	return kvStores.Close()
 
 }
@@ -17,21 +17,49 @@ limitations under the License.
 package indexdb
 
 import (
-	"bytes"
-	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/dgraph-io/badger/v3"
-	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/statsdb"
 )
 
-func NewIndexDB(dbPath string, nbOfThreads int, maxSize bool) {
+var ErrAlreadyIndexed = errors.New("Database is already indexed")
+
+// Stop kmers are the kmers shared by more proteins than the threshold,
+// they are dropped from the index and skipped by the search (0 : no limit)
+type StopKmerOptions struct {
+	MaxProteins uint64  // number of proteins
+	MaxFraction float64 // fraction of the database proteins
+}
+
+// Threshold returns the maximum number of proteins of a kmer (0 : no limit)
+func (stopKmers StopKmerOptions) Threshold(nbOfProteins uint64) uint64 {
+
+	threshold := stopKmers.MaxProteins
+
+	if stopKmers.MaxFraction > 0 {
+		fractionThreshold := uint64(stopKmers.MaxFraction * float64(nbOfProteins))
+		if fractionThreshold < 1 {
+			fractionThreshold = 1
+		}
+		if threshold == 0 || fractionThreshold < threshold {
+			threshold = fractionThreshold
+		}
+	}
+
+	return threshold
+
+}
+
+func NewIndexDB(dbPath string, nbOfThreads int, maxSize bool, stopKmers StopKmerOptions) error {
 
 	// For SSD throughput (as done in badger/graphdb) see :
 	// https://groups.google.com/forum/#!topic/golang-nuts/jPb_h3TvlKE/discussion
@@ -41,115 +69,221 @@ func NewIndexDB(dbPath string, nbOfThreads int, maxSize bool) {
 		nbOfThreads = 1
 	}
 
-	newKmerStore := CreateNewKmerStore(dbPath, nbOfThreads)
-	kvStores1 := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
-	IndexStore(kvStores1, newKmerStore, nbOfThreads)
-	AddSettings(kvStores1, dbPath)
+	kvStores1, err := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
+	if err != nil {
+		return err
+	}
+	kSettings, err := kvStores1.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		kvStores1.Close()
+		return err
+	}
+	if kSettings.DatabaseIndexed {
+		if kSettings.IDsIndexed && kSettings.NamesIndexed {
+			kvStores1.Close()
+			return ErrAlreadyIndexed
+		}
+		// databases indexed before the EntryId / names indexes
+		if err := IndexProteins(kvStores1, nbOfThreads, !kSettings.IDsIndexed, !kSettings.NamesIndexed); err != nil {
+			kvStores1.Close()
+			return err
+		}
+		kSettings.IDsIndexed = true
+		kSettings.NamesIndexed = true
+		if err := kvStores1.SaveSettings(kSettings); err != nil {
+			kvStores1.Close()
+			return err
+		}
+		return kvStores1.Close()
+	}
+
+	// leftover of an interrupted indexing
+	os.RemoveAll(dbPath + "/kmer_store.new")
+	kvstore.RemoveKmerIndex(dbPath)
+
+	dbStats, err := kvStores1.GetStats()
+	if err != nil {
+		kvStores1.Close()
+		return err
+	}
+	threshold := stopKmers.Threshold(dbStats.NumberOfProteins)
+	if threshold > 0 {
+		fmt.Printf("# Dropping kmers shared by more than %d proteins\n", threshold)
+	}
+
+	newKmerStore, err := CreateNewKmerStore(dbPath, nbOfThreads)
+	if err != nil {
+		kvStores1.Close()
+		return err
+	}
+	dbStats.StopKmerThreshold = threshold
+	dbStats.StopKmers, err = IndexStore(kvStores1, newKmerStore, nbOfThreads, threshold)
+	if err != nil {
+		newKmerStore.Close()
+		kvStores1.Close()
+		return err
+	}
+	dbStats.NumberOfKCombSets, err = kvStores1.KCombStore.CountKeys(nil)
+	if err != nil {
+		newKmerStore.Close()
+		kvStores1.Close()
+		return err
+	}
 	newKmerStore.GarbageCollect(1000, 0.5)
 	kvStores1.KCombStore.GarbageCollect(1000, 0.5)
-	newKmerStore.Close()
-	kvStores1.Close()
+	if err := newKmerStore.Close(); err != nil {
+		kvStores1.Close()
+		return err
+	}
+	if err := kvStores1.Close(); err != nil {
+		return err
+	}
 
 	fmt.Println("Replacing kmer_store directory with the new indexed one")
-	os.RemoveAll(dbPath + "/kmer_store")
-	os.Rename(dbPath+"/kmer_store.new", dbPath+"/kmer_store")
+	if err := os.RemoveAll(dbPath + "/kmer_store"); err != nil {
+		return err
+	}
+	if err := os.Rename(dbPath+"/kmer_store.new", dbPath+"/kmer_store"); err != nil {
+		return err
+	}
 
-	kvStores := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("# Flattening KmerStore...\n")
-	kvStores.KmerStore.DB.Flatten(2)
+	kvStores.KmerStore.Storage.Flatten(2)
 	fmt.Printf("# Flattening ProteinStore...\n")
-	kvStores.ProteinStore.DB.Flatten(2)
+	kvStores.ProteinStore.Storage.Flatten(2)
 	fmt.Printf("# Flattening KCombStore...\n")
-	kvStores.KCombStore.DB.Flatten(2)
-	kvStores.Close()
+	kvStores.KCombStore.Storage.Flatten(2)
+	if err := IndexProteins(kvStores, nbOfThreads, true, true); err != nil {
+		kvStores.Close()
+		return err
+	}
+	if err := kvStores.SaveStats(dbStats); err != nil {
+		kvStores.Close()
+		return err
+	}
+	// Only flag the database as indexed once the new kmer_store is in place
+	if err := AddSettings(kvStores, dbPath); err != nil {
+		kvStores.Close()
+		return err
+	}
+	if err := statsdb.RemoveReport(kvStores); err != nil {
+		kvStores.Close()
+		return err
+	}
+
+	return kvStores.Close()
 
 }
 
-func IndexStore(kvStores1 *kvstore.KVStores, newKmerStore *kvstore.KVStore, nbOfThreads int) {
+// IndexStore creates the kcomb_store and the new kmer_store (kmer -> kcomb key)
+// kmers shared by more than threshold proteins are stored as stop kmers and returned
+func IndexStore(kvStores1 *kvstore.KVStores, newKmerStore *kvstore.KVStore, nbOfThreads int, threshold uint64) ([]*kvstore.StopKmer, error) {
 
 	fmt.Println("# Creating key combination store")
 
-	// Stream keys
-	stream := kvStores1.KmerStore.KVStore.DB.NewStream()
-
-	kvStores1.KCombStore.KVStore.OpenInsertChannel()
+	kvStores1.KCombStore.OpenKCombBatch()
 	newKmerStore.OpenInsertChannel()
-	// db.NewStreamAt(readTs) for managed mode.
 
-	// -- Optional settings
-	stream.NumGo = nbOfThreads            // Set number of goroutines to use for iteration.
-	stream.Prefix = nil                   // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
+	stopKmers := []*kvstore.StopKmer{}
+	mu := new(sync.Mutex)
 
-	// ChooseKey is called concurrently for every key. If left nil, assumes true by default.
-	stream.ChooseKey = nil
+	// Stream keys with all their protein ids (versions)
+	err := kvStores1.KmerStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
 
-	// KeyToList is called concurrently for chosen keys. This can be used to convert
-	// Badger data into custom key-values. If nil, uses stream.ToList, a default
-	// implementation, which picks all valid key-values.
+		if threshold > 0 && uint64(len(values)) > threshold {
+			if nbOfProteins := uint64(len(kvstore.RemoveDuplicatesFromSlice(values))); nbOfProteins > threshold {
+				mu.Lock()
+				stopKmers = append(stopKmers, &kvstore.StopKmer{Kmer: kvStores1.KmerStore.DecodeKmer(key), NumberOfProteins: nbOfProteins})
+				mu.Unlock()
+				newKmerStore.AddValueToChannel(key, kvstore.StopKmerValue, true)
+				return nil
+			}
+		}
 
-	// stream.KeyToList = nil
-	stream.KeyToList = func(key []byte, it *badger.Iterator) (*pb.KVList, error) {
+		combKey, err := kvStores1.KCombStore.CreateKCombKey(values)
+		if err != nil {
+			return err
+		}
 
-		keys := [][]byte{}
-		valCopy := []byte{}
-		keyCopy := []byte{}
-		// list := &pb.KVList{}
+		newKmerStore.AddValueToChannel(key, combKey, true)
 
-		for ; it.Valid(); it.Next() {
+		return nil
 
-			item := it.Item()
-			if item.IsDeletedOrExpired() {
-				break
-			}
-			if item.DiscardEarlierVersions() {
-				break
-			}
-			if !bytes.Equal(key, item.Key()) {
-				break
-			}
-
-			valCopy, err := item.ValueCopy(valCopy)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+	})
 
-			keys = append(keys, valCopy)
-
-			keyCopy = item.KeyCopy(keyCopy)
+	// Done.
+	if closeErr := kvStores1.KCombStore.CloseKCombBatch(); err == nil {
+		err = closeErr
+	}
+	kvStores1.KCombStore.KVStore.Flush()
+	if closeErr := newKmerStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+	newKmerStore.Flush()
+	if err != nil {
+		return nil, err
+	}
 
-		}
+	sort.Slice(stopKmers, func(i, j int) bool {
+		return stopKmers[i].NumberOfProteins > stopKmers[j].NumberOfProteins
+	})
+	if len(stopKmers) > 0 {
+		fmt.Printf("# %d stop kmers dropped from the index\n", len(stopKmers))
+	}
 
-		combKey, combVal := kvStores1.KCombStore.CreateKCKeyValue(keys)
-		if combVal != nil {
-			kvStores1.KCombStore.AddValueToChannel(combKey, combVal, true)
-		}
+	return stopKmers, nil
 
-		newKmerStore.AddValueToChannel(keyCopy, combKey, true)
+}
 
-		return nil, nil
+// IndexProteins adds the EntryId -> protein id index and / or
+// the inverted index of the protein names to the protein_store
+func IndexProteins(kvStores *kvstore.KVStores, nbOfThreads int, entryIds bool, names bool) error {
 
+	if entryIds {
+		fmt.Println("# Creating EntryId index")
+	}
+	if names {
+		fmt.Println("# Creating protein names index")
 	}
 
-	// -- End of optional settings.
+	proteinStore := kvStores.ProteinStore
+	proteinStore.OpenInsertChannel()
 
-	// Send is called serially, while Stream.Orchestrate is running.
-	stream.Send = nil
+	err := proteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+		prot := &kvstore.Protein{}
+		if err := proto.Unmarshal(values[0], prot); err != nil {
+			return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+		}
+		if entryIds {
+			// members of a deduplicated protein point to their representative
+			for _, entry := range append([]*kvstore.Protein{prot}, prot.Members...) {
+				if entry.EntryId != "" {
+					proteinStore.AddValueToChannel(kvstore.EntryIdKey(entry.EntryId), key, false)
+				}
+			}
+		}
+		if names {
+			proteinStore.AddNamesToChannel(key, prot)
+		}
+		return nil
+	})
 
-	// Run the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		log.Fatal(err.Error)
+	if closeErr := proteinStore.CloseInsertChannel(); err == nil {
+		err = closeErr
 	}
 
-	// Done.
-	kvStores1.KCombStore.KVStore.CloseInsertChannel()
-	kvStores1.KCombStore.KVStore.Flush()
-	newKmerStore.CloseInsertChannel()
-	newKmerStore.Flush()
+	return err
 
 }
 
-func CreateNewKmerStore(dbPath string, nbOfThreads int) *kvstore.KVStore {
+func CreateNewKmerStore(dbPath string, nbOfThreads int) (*kvstore.KVStore, error) {
 
 	// kmer_store options
 	k_opts := badger.DefaultOptions(dbPath + "/kmer_store.new")
@@ -161,13 +295,17 @@ func CreateNewKmerStore(dbPath string, nbOfThreads int) *kvstore.KVStore {
 	k_opts.ValueLogMaxEntries = kvstore.MaxValueLogEntries
 	k_opts.NumCompactors = 8
 
-	newKmerStore := kvstore.K_New(k_opts, 1000, nbOfThreads)
+	storage, err := kvstore.BadgerStorageNew(k_opts)
+	if err != nil {
+		return nil, err
+	}
+	newKmerStore := kvstore.K_New(storage, 1000, nbOfThreads)
 
-	return newKmerStore.KVStore
+	return newKmerStore.KVStore, nil
 
 }
 
-func AddSettings(kvStores *kvstore.KVStores, dbPath string) {
+func AddSettings(kvStores *kvstore.KVStores, dbPath string) error {
 
 	var dbName string
 
@@ -178,21 +316,24 @@ func AddSettings(kvStores *kvstore.KVStores, dbPath string) {
 		dbName = _dbPathS[len(_dbPathS)-2]
 	}
 
-	// Add settings to protein store
-	ksettings := &kvstore.KSettings{
-		Name:            dbName,
-		Port:            8321,
-		DatabaseIndexed: true,
-		IDsIndexed:      false,
+	// Add settings to protein store (keeping the ones set by makedb)
+	ksettings, err := kvStores.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		return err
 	}
-	data, err := proto.Marshal(ksettings)
-	if err != nil {
-		log.Fatal(err.Error())
+	ksettings.Name = dbName
+	ksettings.Port = 8321
+	ksettings.DatabaseIndexed = true
+	ksettings.IDsIndexed = true
+	ksettings.NamesIndexed = true
+	if ksettings.KmerSize == 0 {
+		ksettings.KmerSize = int32(kvStores.KmerStore.KmerSize())
+	}
+	if ksettings.Alphabet == "" {
+		ksettings.Alphabet = kvStores.KmerStore.Alphabet()
 	}
+	ksettings.KCombEncoding = kvStores.KCombStore.Encoding()
 
-	kvStores.ProteinStore.KVStore.OpenInsertChannel()
-	kvStores.ProteinStore.AddValueToChannel([]byte("db_settings"), data, true)
-	kvStores.ProteinStore.KVStore.CloseInsertChannel()
-	kvStores.ProteinStore.Flush()
+	return kvStores.SaveSettings(ksettings)
 
 }
@@ -0,0 +1,46 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors of the kaamer packages (test them with errors.Is)
+// ErrMissingStats : the database has no stats (incomplete makedb)
+// ErrMissingSettings : the database has no settings (older or incomplete database)
+// ErrBadFormat : unsupported input or database format
+// ErrCorruptValue : stored value that can't be decoded
+// ErrNotIndexed : the database needs kaamer-db -index first
+var (
+	ErrMissingStats    = errors.New("Missing database stats")
+	ErrMissingSettings = errors.New("Missing database settings")
+	ErrBadFormat       = errors.New("Bad format")
+	ErrCorruptValue    = errors.New("Corrupt value")
+	ErrNotIndexed      = errors.New("Database is not indexed")
+)
+
+// BadFormatError returns an ErrBadFormat error with its details
+func BadFormatError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w : %s", ErrBadFormat, fmt.Sprintf(format, a...))
+}
+
+// CorruptValueError returns an ErrCorruptValue error with its details
+func CorruptValueError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w : %s", ErrCorruptValue, fmt.Sprintf(format, a...))
+}
@@ -18,24 +18,128 @@ package kvstore
 
 import (
 	"encoding/binary"
-	"github.com/dgraph-io/badger/v3"
+	"math"
+	"strings"
 )
 
+const (
+	DefaultKmerSize = 7
+	MinKmerSize     = 5
+	MaxKmerSize     = 12
+	LiteralAlphabet = "literal"
+)
+
+// Reduced amino acid alphabets (groups separated by commas)
+// each residue of a group is encoded as the first residue of the group
+var Alphabets = map[string]string{
+	LiteralAlphabet: "A,C,D,E,F,G,H,I,K,L,M,N,P,Q,R,S,T,U,V,W,Y",
+	"murphy15":      "LVIM,CU,A,G,S,T,P,FY,W,E,D,N,Q,KR,H",
+	"murphy10":      "LVIM,CU,A,G,ST,P,FYW,EDNQ,KR,H",
+	"murphy8":       "LVIMCU,AG,ST,P,FYW,EDNQ,KR,H",
+	"seb14":         "A,CU,D,EQ,FY,G,H,IV,KR,LM,N,P,ST,W",
+	"seb10":         "AST,CU,DN,EQ,FY,G,HW,ILMV,KR,P",
+}
+
 // Kmer Entries
 type K_ struct {
 	*KVStore
 	aaTable    map[[2]rune]uint32
 	aaBinTable map[uint32][2]rune
+	kmerSize   int
+	keySize    int
+	seed       string
+	seedPos    []int
+	alphabet   string
+	aaReduced  [256]byte
 }
 
-func K_New(opts badger.Options, flushSize int, nbOfThreads int) *K_ {
+func K_New(storage Storage, flushSize int, nbOfThreads int) *K_ {
 	var k K_
 	k.KVStore = new(KVStore)
 	k.aaTable, k.aaBinTable = NewAATable()
-	NewKVStore(k.KVStore, opts, flushSize, nbOfThreads)
+	k.SetKmerSize(DefaultKmerSize)
+	k.SetAlphabet(LiteralAlphabet)
+	NewKVStore(k.KVStore, storage, flushSize, nbOfThreads)
 	return &k
 }
 
+// SetKmerSize sets the (contiguous) kmer length used to encode / decode the keys
+func (k *K_) SetKmerSize(kmerSize int) {
+	k.SetSeed(strings.Repeat("1", kmerSize))
+}
+
+// SetSeed sets a spaced seed mask (ex. 1101011011) where only the 1 positions
+// of the kmer window are encoded in the key
+// aa pairs are packed on 9 bits and a trailing single aa on 5 bits,
+// keys that don't fit in 32 bits (weight > 7) use 64 bits
+func (k *K_) SetSeed(seed string) {
+	k.seed = seed
+	k.kmerSize = len(seed)
+	k.seedPos = []int{}
+	for i, c := range seed {
+		if c == '1' {
+			k.seedPos = append(k.seedPos, i)
+		}
+	}
+	weight := len(k.seedPos)
+	bits := 9*(weight/2) + 5*(weight%2)
+	if bits <= 32 {
+		k.keySize = 4
+	} else {
+		k.keySize = 8
+	}
+}
+
+// KmerSize returns the length of the kmer window (the seed span)
+func (k *K_) KmerSize() int {
+	return k.kmerSize
+}
+
+func (k *K_) Seed() string {
+	return k.seed
+}
+
+// ValidSeed checks that a seed mask is made of 0/1, starts and ends with a 1
+// and has a weight (number of 1) between MinKmerSize and MaxKmerSize
+func ValidSeed(seed string) bool {
+	if seed == "" || strings.Trim(seed, "01") != "" {
+		return false
+	}
+	if seed[0] != '1' || seed[len(seed)-1] != '1' {
+		return false
+	}
+	weight := strings.Count(seed, "1")
+	return weight >= MinKmerSize && weight <= MaxKmerSize
+}
+
+// SetAlphabet sets the (reduced) alphabet applied to kmers before encoding
+// unknown alphabets are an ErrBadFormat (the alphabet is unchanged)
+func (k *K_) SetAlphabet(name string) error {
+	groups, ok := Alphabets[name]
+	if !ok {
+		return BadFormatError("alphabet %s unrecognized", name)
+	}
+	k.alphabet = name
+	for i := range k.aaReduced {
+		k.aaReduced[i] = byte(i)
+	}
+	for _, group := range strings.Split(groups, ",") {
+		for i := 0; i < len(group); i++ {
+			k.aaReduced[group[i]] = group[0]
+		}
+	}
+	return nil
+}
+
+func (k *K_) Alphabet() string {
+	return k.alphabet
+}
+
+// KmerSpace returns the number of possible kmers (alphabet groups ^ seed weight)
+func (k *K_) KmerSpace() float64 {
+	return math.Pow(float64(len(strings.Split(Alphabets[k.alphabet], ","))), float64(len(k.seedPos)))
+}
+
 func NewAATable() (map[[2]rune]uint32, map[uint32][2]rune) {
 
 	aa := []rune{'A', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'K', 'L', 'M', 'N', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'Y'}
@@ -64,19 +168,20 @@ func NewAATable() (map[[2]rune]uint32, map[uint32][2]rune) {
 }
 
 func (k *K_) CreateBytesKey(kmer string) []byte {
-	// expect kmers of length 7
+	// expect kmers of length kmerSize
 	kmerInt := k.EncodeKmer(kmer)
-	byteArrayKmer := make([]byte, 4)
-	binary.BigEndian.PutUint32(byteArrayKmer, kmerInt)
-
-	// kmerString := fmt.Sprintf("%x", kmerInt)
-	// kmerHex := hex.EncodeToString(byteArrayKmer)
+	byteArrayKmer := make([]byte, k.keySize)
+	if k.keySize == 4 {
+		binary.BigEndian.PutUint32(byteArrayKmer, uint32(kmerInt))
+	} else {
+		binary.BigEndian.PutUint64(byteArrayKmer, kmerInt)
+	}
 
 	return byteArrayKmer
 }
 
 func (k *K_) CreateBytesVal(entry string) []byte {
-	// expect kmers of length 7
+	// expect at most 7 aa (3 pairs of 9 bits and a single aa of 5 bits)
 	entryInt := k.EncodeEntry(entry)
 	byteArrayKmer := make([]byte, 4)
 	binary.BigEndian.PutUint32(byteArrayKmer, entryInt)
@@ -87,58 +192,59 @@ func (k *K_) CreateBytesVal(entry string) []byte {
 	return byteArrayKmer
 }
 
-// expect kmers of length 7
-func (k *K_) EncodeKmer(kmer string) uint32 {
-
-	// fmt.Println("#Encoding")
+// expect kmers of length kmerSize
+func (k *K_) EncodeKmer(kmer string) uint64 {
 
-	kmerInt := uint32(0)
+	kmerInt := uint64(0)
+	shift := uint(k.keySize * 8)
+	pos := k.seedPos
 	i := 0
-	shiftIndex := uint8(1)
 
 	// aa pairs
-	for (i + 2) < len(kmer) {
-		// fmt.Printf("%s => %x\n", kmer[i:i+2], aaTable[kmer[i:i+2]])
-		_key := [2]rune{rune(kmer[i]), rune(kmer[i+1])}
-		kmerInt |= k.aaTable[_key] << (32 - (shiftIndex * 9))
-		shiftIndex++
+	for (i + 1) < len(pos) {
+		_key := [2]rune{rune(k.aaReduced[kmer[pos[i]]]), rune(k.aaReduced[kmer[pos[i+1]]])}
+		shift -= 9
+		kmerInt |= uint64(k.aaTable[_key]) << shift
 		i += 2
 	}
 
-	// last aa
-	_key := [2]rune{rune(kmer[len(kmer)-1]), '.'}
-	kmerInt |= k.aaTable[_key]
-
-	// fmt.Printf("%s => %x\n", kmer[len(kmer)-1:], aaTable[kmer[len(kmer)-1:]])
-	// fmt.Println(kmerInt)
+	// last aa (odd seed weight)
+	if i < len(pos) {
+		_key := [2]rune{rune(k.aaReduced[kmer[pos[i]]]), '.'}
+		kmerInt |= uint64(k.aaTable[_key])
+	}
 
 	return kmerInt
 
 }
 
-// expect kmers of length 7
+// expect keys made with the same seed
+// only the residues at the seed 1 positions are returned
 func (k *K_) DecodeKmer(key []byte) string {
 
-	kmerInt := binary.BigEndian.Uint32(key)
-	aa := (kmerInt >> 23) & 0x1FF
-	bb := (kmerInt >> 14) & 0x1FF
-	cc := (kmerInt >> 5) & 0x1FF
-	dd := (kmerInt) & 0x1F
-
-	// fmt.Println("#Decoding")
-	// fmt.Printf("%s => %x\n", aaBinTable[aa], aa)
-	// fmt.Printf("%s => %x\n", aaBinTable[bb], bb)
-	// fmt.Printf("%s => %x\n", aaBinTable[cc], cc)
-	// fmt.Printf("%s => %x\n", aaBinTable[dd], dd)
+	kmerInt := uint64(0)
+	if len(key) == 4 {
+		kmerInt = uint64(binary.BigEndian.Uint32(key))
+	} else {
+		kmerInt = binary.BigEndian.Uint64(key)
+	}
+	shift := uint(len(key) * 8)
 
 	kmer := ""
-	kmer += string(k.aaBinTable[aa][0])
-	kmer += string(k.aaBinTable[aa][1])
-	kmer += string(k.aaBinTable[bb][0])
-	kmer += string(k.aaBinTable[bb][1])
-	kmer += string(k.aaBinTable[cc][0])
-	kmer += string(k.aaBinTable[cc][1])
-	kmer += string(k.aaBinTable[dd][0])
+	weight := len(k.seedPos)
+	i := 0
+	for (i + 1) < weight {
+		shift -= 9
+		aa := uint32(kmerInt>>shift) & 0x1FF
+		kmer += string(k.aaBinTable[aa][0])
+		kmer += string(k.aaBinTable[aa][1])
+		i += 2
+	}
+
+	if i < weight {
+		aa := uint32(kmerInt) & 0x1F
+		kmer += string(k.aaBinTable[aa][0])
+	}
 
 	return kmer
 
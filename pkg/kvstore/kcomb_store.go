@@ -19,67 +19,214 @@ package kvstore
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
-	"math/rand"
+	"sort"
+	"sync"
 
 	"github.com/OneOfOne/xxhash"
-	"github.com/dgraph-io/badger/v3"
 	proto "github.com/golang/protobuf/proto"
 )
 
+// Encoding of the kcomb values (protein ids)
+// proto : KComb protobuf (databases indexed before format version 2)
+// delta : sorted ids as varint deltas
+const (
+	KCombEncodingProto = "proto"
+	KCombEncodingDelta = "delta"
+)
+
+// kcomb keys are a 64 bits hash
+const kcombKeySize = 8
+
+var ErrCorruptKComb = CorruptValueError("kcomb")
+
 // Hash store for values combination used in other stores
 type KC_ struct {
 	*KVStore
+	encoding string
+
+	// kcomb sets added by CreateKCombKey and not flushed yet
+	claimMu sync.Mutex
+	claims  map[string][]byte
+	batch   Batch
+	flushes uint64
 }
 
-func KC_New(opts badger.Options, flushSize int, nbOfThreads int) *KC_ {
+func KC_New(storage Storage, flushSize int, nbOfThreads int) *KC_ {
 	var kc KC_
 	kc.KVStore = new(KVStore)
-	NewKVStore(kc.KVStore, opts, flushSize, nbOfThreads)
+	kc.encoding = KCombEncodingDelta
+	NewKVStore(kc.KVStore, storage, flushSize, nbOfThreads)
 	return &kc
 }
 
-func (kc *KC_) CreateKCKeyValue(keys [][]byte) ([]byte, []byte) {
+func (kc *KC_) SetEncoding(encoding string) {
+	kc.encoding = encoding
+}
 
-	h := xxhash.New64()
+func (kc *KC_) Encoding() string {
+	return kc.encoding
+}
 
-	kComb := &KComb{}
+// EncodeProteinKeys encodes unique protein ids as a kcomb value
+func (kc *KC_) EncodeProteinKeys(proteinKeys []uint32) ([]byte, error) {
 
-	sortedKeys := RemoveDuplicatesFromSlice(keys)
+	if kc.encoding == KCombEncodingProto {
+		return proto.Marshal(&KComb{ProteinKeys: proteinKeys})
+	}
+
+	sortedKeys := append([]uint32{}, proteinKeys...)
+	sort.Slice(sortedKeys, func(i, j int) bool { return sortedKeys[i] < sortedKeys[j] })
+
+	val := make([]byte, 0, len(sortedKeys)*2)
+	buf := make([]byte, binary.MaxVarintLen32)
+	last := uint32(0)
+	for _, id := range sortedKeys {
+		n := binary.PutUvarint(buf, uint64(id-last))
+		val = append(val, buf[:n]...)
+		last = id
+	}
+
+	return val, nil
+
+}
+
+// DecodeProteinKeys decodes a kcomb value into its protein ids
+func (kc *KC_) DecodeProteinKeys(val []byte) ([]uint32, error) {
+
+	if kc.encoding == KCombEncodingProto {
+		kComb := &KComb{}
+		if err := proto.Unmarshal(val, kComb); err != nil {
+			return nil, CorruptValueError("kcomb : %s", err.Error())
+		}
+		return kComb.ProteinKeys, nil
+	}
+
+	// every id takes at least one byte
+	proteinKeys := make([]uint32, 0, len(val))
+	last := uint32(0)
+	for i := 0; i < len(val); {
+		delta := uint32(0)
+		for shift := uint(0); ; shift += 7 {
+			if i == len(val) || shift > 28 {
+				return nil, ErrCorruptKComb
+			}
+			b := val[i]
+			i++
+			delta |= uint32(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		last += delta
+		proteinKeys = append(proteinKeys, last)
+	}
 
+	return proteinKeys, nil
+
+}
+
+// OpenKCombBatch starts the creation of kcomb sets with CreateKCombKey
+func (kc *KC_) OpenKCombBatch() {
+	kc.claims = make(map[string][]byte)
+	kc.batch = kc.Storage.NewBatch()
+}
+
+// CloseKCombBatch writes the kcomb sets not flushed yet
+func (kc *KC_) CloseKCombBatch() error {
+	kc.claimMu.Lock()
+	defer kc.claimMu.Unlock()
+	err := kc.batch.Flush()
+	kc.claims = nil
+	kc.batch = nil
+	return err
+}
+
+// kCombKey is the key of sorted protein ids for a probe number,
+// the first probe is the hash of the ids and the next ones add the probe number to it
+func kCombKey(sortedKeys [][]byte, probe uint32) []byte {
+
+	h := xxhash.New64()
 	for _, k := range sortedKeys {
-		intId := binary.BigEndian.Uint32(k)
-		kComb.ProteinKeys = append(kComb.ProteinKeys, intId)
 		h.Write(k)
 	}
-	kComb.Count = 0
-
-	kCombPB, err := proto.Marshal(kComb)
-	if err != nil {
-		log.Fatal(err.Error())
+	if probe > 0 {
+		probeByte := make([]byte, 4)
+		binary.BigEndian.PutUint32(probeByte, probe)
+		h.Write(probeByte)
 	}
 
-	combKeyByte := make([]byte, 8)
+	combKeyByte := make([]byte, kcombKeySize)
 	binary.BigEndian.PutUint64(combKeyByte, h.Sum64())
 
-	val, hasKey := kc.GetValue(combKeyByte)
+	return combKeyByte
 
-	if bytes.Compare(val, kCombPB) == 0 {
-		return combKeyByte, nil
-	}
+}
+
+// CreateKCombKey returns the kcomb key of protein ids and adds the kcomb set to the store when missing
+// (between OpenKCombBatch and CloseKCombBatch). The keys are probed in a fixed order until the set or
+// a free key is found, so the same set always gets the same key unless its hash collides with another set.
+// Safe for concurrent use, the pending sets are checked along with the store.
+// Between sets whose 64 bits hashes collide, the first one created (worker order) gets the first probe :
+// the kmers always point to the right set but the keys of these sets can differ from one build to another.
+func (kc *KC_) CreateKCombKey(keys [][]byte) ([]byte, error) {
+
+	sortedKeys := RemoveDuplicatesFromSlice(keys)
 
-	proceedWithKey := (hasKey == false)
+	proteinKeys := make([]uint32, 0, len(sortedKeys))
+	for _, k := range sortedKeys {
+		proteinKeys = append(proteinKeys, binary.BigEndian.Uint32(k))
+	}
 
-	for !proceedWithKey {
-		token := make([]byte, 4)
-		rand.Read(token)
-		h.Write(token)
-		combKeyByte = make([]byte, 8)
-		binary.BigEndian.PutUint64(combKeyByte, h.Sum64())
-		_, hasKey := kc.GetValue(combKeyByte)
-		proceedWithKey = !hasKey
+	kCombVal, err := kc.EncodeProteinKeys(proteinKeys)
+	if err != nil {
+		return nil, err
 	}
 
-	return combKeyByte, kCombPB
+	for probe := uint32(0); ; {
+
+		combKey := kCombKey(sortedKeys, probe)
+
+		kc.claimMu.Lock()
+		flushes := kc.flushes
+		val, claimed := kc.claims[string(combKey)]
+		kc.claimMu.Unlock()
+
+		if !claimed {
+			val, err = kc.Storage.Get(combKey)
+			if err == ErrKeyNotFound {
+				val = nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if val != nil {
+			if bytes.Equal(val, kCombVal) {
+				return combKey, nil
+			}
+			// collision with another set
+			probe++
+			continue
+		}
+
+		kc.claimMu.Lock()
+		if val, claimed = kc.claims[string(combKey)]; claimed || kc.flushes != flushes {
+			// claimed or flushed since the store lookup, probe the same key again
+			kc.claimMu.Unlock()
+			continue
+		}
+		kc.claims[string(combKey)] = kCombVal
+		err = kc.batch.Set(combKey, kCombVal)
+		if err == nil && len(kc.claims) >= kc.FlushSize {
+			err = kc.batch.Flush()
+			kc.batch = kc.Storage.NewBatch()
+			kc.claims = make(map[string][]byte)
+			kc.flushes++
+		}
+		kc.claimMu.Unlock()
+
+		return combKey, err
+
+	}
 
 }
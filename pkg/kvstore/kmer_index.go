@@ -0,0 +1,347 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Immutable kmer index exported from an indexed database (kaamer-db -export)
+// sections of the file (little endian) :
+// header : magic (8 bytes), version, key size (uint32), number of kmers, number of kcombs (uint64)
+// keys : sorted kmer keys (number of kmers * key size)
+// kcombs : kcomb number of each kmer (uint32), stop kmers are marked since version 2
+// offsets : start of each kcomb in the protein ids + end of the last one (uint64)
+// ids : protein ids of every kcomb (uint32)
+const (
+	KmerIndexFile     = "kmer_index"
+	KmerIndexVersion  = 2
+	kmerIndexMagic    = "KAAMERKX"
+	kmerIndexHeader   = 32
+	kmerIndexNoComb   = ^uint32(0)
+	kmerIndexStopKmer = ^uint32(0) - 1
+)
+
+type KmerIndex struct {
+	data    []byte
+	keySize int
+	nbKmers int
+	nbCombs int
+	keys    []byte
+	kcombs  []byte
+	offsets []byte
+	ids     []byte
+}
+
+// OpenKmerIndex maps an exported kmer index file in memory
+func OpenKmerIndex(path string) (*KmerIndex, error) {
+
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < kmerIndexHeader || string(data[0:8]) != kmerIndexMagic {
+		unmapFile(data)
+		return nil, BadFormatError("not a kmer index file")
+	}
+
+	if version := binary.LittleEndian.Uint32(data[8:12]); version < 1 || version > KmerIndexVersion {
+		unmapFile(data)
+		return nil, BadFormatError("unsupported kmer index version")
+	}
+
+	keySize := int(binary.LittleEndian.Uint32(data[12:16]))
+	nbKmers := int(binary.LittleEndian.Uint64(data[16:24]))
+	nbCombs := int(binary.LittleEndian.Uint64(data[24:32]))
+
+	idx := &KmerIndex{data: data, keySize: keySize, nbKmers: nbKmers, nbCombs: nbCombs}
+
+	pos := kmerIndexHeader
+	sections := []struct {
+		section *[]byte
+		size    int
+	}{
+		{&idx.keys, nbKmers * keySize},
+		{&idx.kcombs, nbKmers * 4},
+		{&idx.offsets, (nbCombs + 1) * 8},
+	}
+	for _, s := range sections {
+		if pos+s.size > len(data) {
+			unmapFile(data)
+			return nil, CorruptValueError("truncated kmer index file")
+		}
+		*s.section = data[pos : pos+s.size]
+		pos += s.size
+	}
+	idx.ids = data[pos:]
+
+	if binary.LittleEndian.Uint64(idx.offsets[nbCombs*8:])*4 != uint64(len(idx.ids)) {
+		unmapFile(data)
+		return nil, CorruptValueError("truncated kmer index file")
+	}
+
+	return idx, nil
+
+}
+
+func (idx *KmerIndex) KeySize() int {
+	return idx.keySize
+}
+
+func (idx *KmerIndex) NumberOfKmers() int {
+	return idx.nbKmers
+}
+
+// Lookup returns the protein ids of a kmer key
+func (idx *KmerIndex) Lookup(key []byte) ([]uint32, error) {
+
+	ks := idx.keySize
+	if len(key) != ks {
+		return nil, ErrKeyNotFound
+	}
+
+	i := sort.Search(idx.nbKmers, func(i int) bool {
+		return bytes.Compare(idx.keys[i*ks:(i+1)*ks], key) >= 0
+	})
+	if i == idx.nbKmers || !bytes.Equal(idx.keys[i*ks:(i+1)*ks], key) {
+		return nil, ErrKeyNotFound
+	}
+
+	kcomb := binary.LittleEndian.Uint32(idx.kcombs[i*4:])
+	if kcomb == kmerIndexStopKmer {
+		return nil, ErrStopKmer
+	}
+	if kcomb == kmerIndexNoComb {
+		return nil, ErrKeyNotFound
+	}
+
+	// the kcomb numbers and offsets are checked here rather than for every kmer at opening
+	if int(kcomb) >= idx.nbCombs {
+		return nil, ErrCorruptKComb
+	}
+	start := binary.LittleEndian.Uint64(idx.offsets[kcomb*8:])
+	end := binary.LittleEndian.Uint64(idx.offsets[(kcomb+1)*8:])
+	if start > end || end > uint64(len(idx.ids)/4) {
+		return nil, ErrCorruptKComb
+	}
+	proteinKeys := make([]uint32, 0, end-start)
+	for j := start; j < end; j++ {
+		proteinKeys = append(proteinKeys, binary.LittleEndian.Uint32(idx.ids[j*4:]))
+	}
+
+	return proteinKeys, nil
+
+}
+
+func (idx *KmerIndex) Close() error {
+	return unmapFile(idx.data)
+}
+
+// WriteKmerIndex exports the kmer_store and kcomb_store of an indexed database
+// the file is written next to path and renamed once complete
+func WriteKmerIndex(kvStores *KVStores, path string) error {
+
+	dir := filepath.Dir(path)
+
+	keysFile, err := ioutil.TempFile(dir, KmerIndexFile+".keys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keysFile.Name())
+	defer keysFile.Close()
+
+	kcombsFile, err := ioutil.TempFile(dir, KmerIndexFile+".kcombs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(kcombsFile.Name())
+	defer kcombsFile.Close()
+
+	idsFile, err := ioutil.TempFile(dir, KmerIndexFile+".ids")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(idsFile.Name())
+	defer idsFile.Close()
+
+	offsetsFile, err := ioutil.TempFile(dir, KmerIndexFile+".offsets")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(offsetsFile.Name())
+	defer offsetsFile.Close()
+
+	combKeysFile, err := ioutil.TempFile(dir, KmerIndexFile+".combkeys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(combKeysFile.Name())
+	defer combKeysFile.Close()
+
+	buf := make([]byte, 8)
+
+	// kcombs protein ids in kcomb key order, a kcomb number is the rank of its key
+	// (the first version seen is the latest one)
+	nbCombs := uint64(0)
+	offset := uint64(0)
+	lastCombKey := []byte{}
+	idsWriter := bufio.NewWriter(idsFile)
+	offsetsWriter := bufio.NewWriter(offsetsFile)
+	combKeysWriter := bufio.NewWriter(combKeysFile)
+	writeOffset := func() error {
+		binary.LittleEndian.PutUint64(buf, offset)
+		_, err := offsetsWriter.Write(buf)
+		return err
+	}
+	if err := writeOffset(); err != nil {
+		return err
+	}
+	err = kvStores.KCombStore.Storage.Iterate(nil, func(key []byte, val []byte) error {
+		if len(key) != kcombKeySize || bytes.Equal(key, lastCombKey) {
+			return nil
+		}
+		lastCombKey = key
+		proteinKeys, err := kvStores.KCombStore.DecodeProteinKeys(val)
+		if err != nil {
+			return err
+		}
+		for _, id := range proteinKeys {
+			binary.LittleEndian.PutUint32(buf, id)
+			if _, err := idsWriter.Write(buf[0:4]); err != nil {
+				return err
+			}
+		}
+		if _, err := combKeysWriter.Write(key); err != nil {
+			return err
+		}
+		offset += uint64(len(proteinKeys))
+		nbCombs++
+		return writeOffset()
+	})
+	if err != nil {
+		return err
+	}
+	for _, w := range []*bufio.Writer{idsWriter, offsetsWriter, combKeysWriter} {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// sorted kcomb keys searched for the kcomb number of the kmers
+	combKeys, err := mapFile(combKeysFile.Name())
+	if err != nil {
+		return err
+	}
+	defer unmapFile(combKeys)
+	kcombNumber := func(combKey []byte) (uint32, bool) {
+		i := sort.Search(int(nbCombs), func(i int) bool {
+			return bytes.Compare(combKeys[i*kcombKeySize:(i+1)*kcombKeySize], combKey) >= 0
+		})
+		if i == int(nbCombs) || !bytes.Equal(combKeys[i*kcombKeySize:(i+1)*kcombKeySize], combKey) {
+			return 0, false
+		}
+		return uint32(i), true
+	}
+
+	// sorted kmer keys and their kcomb number
+	keySize := kvStores.KmerStore.keySize
+	nbKmers := uint64(0)
+	lastKey := []byte{}
+	keysWriter := bufio.NewWriter(keysFile)
+	kcombsWriter := bufio.NewWriter(kcombsFile)
+	err = kvStores.KmerStore.Storage.Iterate(nil, func(key []byte, val []byte) error {
+		if len(key) != keySize || bytes.Equal(key, lastKey) {
+			return nil
+		}
+		lastKey = key
+		kcomb, ok := kcombNumber(val)
+		if bytes.Equal(val, StopKmerValue) {
+			kcomb = kmerIndexStopKmer
+		} else if !ok {
+			kcomb = kmerIndexNoComb
+		}
+		binary.LittleEndian.PutUint32(buf, kcomb)
+		if _, err := keysWriter.Write(key); err != nil {
+			return err
+		}
+		if _, err := kcombsWriter.Write(buf[0:4]); err != nil {
+			return err
+		}
+		nbKmers++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := keysWriter.Flush(); err != nil {
+		return err
+	}
+	if err := kcombsWriter.Flush(); err != nil {
+		return err
+	}
+
+	// assemble the index file
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	header := make([]byte, kmerIndexHeader)
+	copy(header[0:8], kmerIndexMagic)
+	binary.LittleEndian.PutUint32(header[8:12], KmerIndexVersion)
+	binary.LittleEndian.PutUint32(header[12:16], uint32(keySize))
+	binary.LittleEndian.PutUint64(header[16:24], nbKmers)
+	binary.LittleEndian.PutUint64(header[24:32], nbCombs)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, f := range []*os.File{keysFile, kcombsFile, offsetsFile, idsFile} {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+
+}
+
+// RemoveKmerIndex deletes the exported kmer index of a database (stale after any kmer change)
+func RemoveKmerIndex(dbPath string) {
+	os.Remove(dbPath + "/" + KmerIndexFile)
+}
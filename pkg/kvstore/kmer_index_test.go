@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKmerIndexLookup(t *testing.T) {
+
+	kvStores := KVStoresMemoryNew(1)
+	kmerStore := kvStores.KmerStore
+
+	kvStores.KCombStore.OpenKCombBatch()
+	kCombKey, err := kvStores.KCombStore.CreateKCombKey(proteinIdsBytes(7, 3, 42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.KCombStore.CloseKCombBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kmerStore.Storage.Set(kmerStore.CreateBytesKey("MKVLAAG"), kCombKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := kmerStore.Storage.Set(kmerStore.CreateBytesKey("GGGGGGG"), StopKmerValue); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "kmer_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, KmerIndexFile)
+	if err := WriteKmerIndex(kvStores, path); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := OpenKmerIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proteinKeys, err := idx.Lookup(kmerStore.CreateBytesKey("MKVLAAG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(proteinKeys) != "[3 7 42]" {
+		t.Errorf("Lookup returned %v, expecting [3 7 42]", proteinKeys)
+	}
+	if _, err := idx.Lookup(kmerStore.CreateBytesKey("GGGGGGG")); err != ErrStopKmer {
+		t.Errorf("Lookup of a stop kmer returned %v, expecting ErrStopKmer", err)
+	}
+	if _, err := idx.Lookup(kmerStore.CreateBytesKey("WWWWWWW")); err != ErrKeyNotFound {
+		t.Errorf("Lookup of a missing kmer returned %v, expecting ErrKeyNotFound", err)
+	}
+	idx.Close()
+
+	// kcomb number out of the kcombs section
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcombs := data[kmerIndexHeader+2*kmerStore.keySize:]
+	for i := 0; i < 2; i++ {
+		if binary.LittleEndian.Uint32(kcombs[i*4:]) != kmerIndexStopKmer {
+			binary.LittleEndian.PutUint32(kcombs[i*4:], 5)
+		}
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = OpenKmerIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if _, err := idx.Lookup(kmerStore.CreateBytesKey("MKVLAAG")); err != ErrCorruptKComb {
+		t.Errorf("Lookup of a corrupt kcomb number returned %v, expecting ErrCorruptKComb", err)
+	}
+
+}
@@ -28,6 +28,13 @@ type KSettings struct {
 	DatabaseIndexed      bool     `protobuf:"varint,5,opt,name=DatabaseIndexed,proto3" json:"DatabaseIndexed,omitempty"`
 	IDsIndexed           bool     `protobuf:"varint,6,opt,name=IDsIndexed,proto3" json:"IDsIndexed,omitempty"`
 	NamesIndexed         bool     `protobuf:"varint,7,opt,name=NamesIndexed,proto3" json:"NamesIndexed,omitempty"`
+	KmerSize             int32    `protobuf:"varint,8,opt,name=KmerSize,proto3" json:"KmerSize,omitempty"`
+	Alphabet             string   `protobuf:"bytes,9,opt,name=Alphabet,proto3" json:"Alphabet,omitempty"`
+	Seed                 string   `protobuf:"bytes,10,opt,name=Seed,proto3" json:"Seed,omitempty"`
+	FormatVersion        int32    `protobuf:"varint,11,opt,name=FormatVersion,proto3" json:"FormatVersion,omitempty"`
+	KCombEncoding        string   `protobuf:"bytes,12,opt,name=KCombEncoding,proto3" json:"KCombEncoding,omitempty"`
+	SequenceEncoding     string   `protobuf:"bytes,13,opt,name=SequenceEncoding,proto3" json:"SequenceEncoding,omitempty"`
+	LastProteinId        uint32   `protobuf:"varint,14,opt,name=LastProteinId,proto3" json:"LastProteinId,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -107,6 +114,55 @@ func (m *KSettings) GetNamesIndexed() bool {
 	return false
 }
 
+func (m *KSettings) GetKmerSize() int32 {
+	if m != nil {
+		return m.KmerSize
+	}
+	return 0
+}
+
+func (m *KSettings) GetAlphabet() string {
+	if m != nil {
+		return m.Alphabet
+	}
+	return ""
+}
+
+func (m *KSettings) GetSeed() string {
+	if m != nil {
+		return m.Seed
+	}
+	return ""
+}
+
+func (m *KSettings) GetFormatVersion() int32 {
+	if m != nil {
+		return m.FormatVersion
+	}
+	return 0
+}
+
+func (m *KSettings) GetKCombEncoding() string {
+	if m != nil {
+		return m.KCombEncoding
+	}
+	return ""
+}
+
+func (m *KSettings) GetSequenceEncoding() string {
+	if m != nil {
+		return m.SequenceEncoding
+	}
+	return ""
+}
+
+func (m *KSettings) GetLastProteinId() uint32 {
+	if m != nil {
+		return m.LastProteinId
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*KSettings)(nil), "kvstore.KSettings")
 }
@@ -114,17 +170,24 @@ func init() {
 func init() { proto.RegisterFile("ksettings.proto", fileDescriptor_4e477fb09697567a) }
 
 var fileDescriptor_4e477fb09697567a = []byte{
-	// 190 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0xcf, 0x4b, 0xaa, 0xc2, 0x30,
-	0x14, 0xc6, 0x71, 0x72, 0x6f, 0x1f, 0x36, 0x08, 0x85, 0x8c, 0x32, 0x92, 0xd2, 0x51, 0x46, 0x4e,
-	0x5c, 0x82, 0x45, 0x28, 0x82, 0x4a, 0x5d, 0x41, 0x4a, 0x0f, 0x25, 0xb4, 0x26, 0x92, 0x1c, 0xc4,
-	0x2d, 0xbb, 0x0b, 0x49, 0x7c, 0xd0, 0x3a, 0xfb, 0xf8, 0xe7, 0x07, 0x49, 0x68, 0x3e, 0x38, 0x40,
-	0x54, 0xba, 0x77, 0xeb, 0xab, 0x35, 0x68, 0x58, 0x3a, 0xdc, 0x1c, 0x1a, 0x0b, 0xe5, 0x83, 0xd0,
-	0x6c, 0x7f, 0x7e, 0x1f, 0x32, 0x46, 0xa3, 0x83, 0xbc, 0x00, 0x27, 0x05, 0x11, 0x59, 0x13, 0xb6,
-	0x6f, 0x27, 0x63, 0x91, 0xff, 0x15, 0x44, 0xc4, 0x4d, 0xd8, 0xac, 0xa4, 0xcb, 0xad, 0x05, 0x89,
-	0xca, 0xe8, 0x4a, 0x22, 0xf0, 0xff, 0xe0, 0x67, 0xcd, 0x9b, 0xa3, 0x55, 0xbd, 0xd2, 0x72, 0xdc,
-	0xa9, 0x11, 0x78, 0xf4, 0x32, 0xd3, 0xc6, 0x04, 0xcd, 0x2b, 0x89, 0xb2, 0x95, 0x0e, 0x6a, 0xdd,
-	0xc1, 0x1d, 0x3a, 0x1e, 0x17, 0x44, 0x2c, 0x9a, 0xdf, 0xcc, 0x56, 0x94, 0xd6, 0x95, 0xfb, 0xa0,
-	0x24, 0xa0, 0x49, 0xf1, 0xb7, 0xf9, 0xd7, 0x7e, 0x45, 0x1a, 0xc4, 0xac, 0xb5, 0x49, 0xf8, 0xfb,
-	0xe6, 0x19, 0x00, 0x00, 0xff, 0xff, 0x3c, 0x54, 0x48, 0x74, 0x0e, 0x01, 0x00, 0x00,
+	// 296 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x64, 0x91, 0xcf, 0x4a, 0xc3, 0x40,
+	0x10, 0x87, 0x89, 0xfd, 0xbf, 0x36, 0x56, 0xf6, 0xb4, 0x78, 0x90, 0x50, 0x3c, 0x04, 0x0f, 0x5e,
+	0x7c, 0x02, 0x69, 0x2c, 0x84, 0x88, 0x96, 0x04, 0xbc, 0x6f, 0x9a, 0x21, 0x2e, 0x4d, 0x76, 0xeb,
+	0xee, 0x28, 0xe2, 0x6b, 0xfa, 0x42, 0xb2, 0x53, 0x0d, 0x8d, 0xde, 0x66, 0xbe, 0xf9, 0xf8, 0x65,
+	0x32, 0xcb, 0x16, 0x3b, 0x07, 0x88, 0x4a, 0xd7, 0xee, 0x66, 0x6f, 0x0d, 0x1a, 0x3e, 0xd9, 0xbd,
+	0x3b, 0x34, 0x16, 0x96, 0x5f, 0x03, 0x36, 0xcb, 0x8a, 0x9f, 0x21, 0xe7, 0x6c, 0xf8, 0x28, 0x5b,
+	0x10, 0x41, 0x14, 0xc4, 0xb3, 0x9c, 0x6a, 0xcf, 0x36, 0xc6, 0xa2, 0x38, 0x89, 0x82, 0x78, 0x94,
+	0x53, 0xcd, 0x97, 0x6c, 0xbe, 0xb2, 0x20, 0x51, 0x19, 0x9d, 0x48, 0x04, 0x31, 0x20, 0xbf, 0xc7,
+	0xbc, 0xf3, 0x64, 0x55, 0xad, 0xb4, 0x6c, 0xd6, 0xaa, 0x01, 0x31, 0x3c, 0x38, 0xc7, 0x8c, 0xc7,
+	0x6c, 0x91, 0x48, 0x94, 0xa5, 0x74, 0x90, 0xea, 0x0a, 0x3e, 0xa0, 0x12, 0xa3, 0x28, 0x88, 0xa7,
+	0xf9, 0x5f, 0xcc, 0x2f, 0x19, 0x4b, 0x13, 0xf7, 0x2b, 0x8d, 0x49, 0x3a, 0x22, 0xfe, 0x6b, 0x7e,
+	0xdb, 0xce, 0x98, 0x90, 0xd1, 0x63, 0xfc, 0x82, 0x4d, 0xb3, 0x16, 0x6c, 0xa1, 0x3e, 0x41, 0x4c,
+	0xe9, 0x6f, 0xba, 0xde, 0xcf, 0xee, 0x9a, 0xfd, 0x8b, 0x2c, 0x01, 0xc5, 0x8c, 0x36, 0xed, 0x7a,
+	0x7f, 0x81, 0x02, 0xa0, 0x12, 0xec, 0x70, 0x15, 0x5f, 0xf3, 0x2b, 0x16, 0xae, 0x8d, 0x6d, 0x25,
+	0x3e, 0x83, 0x75, 0xca, 0x68, 0x71, 0x4a, 0x81, 0x7d, 0xe8, 0xad, 0x6c, 0x65, 0xda, 0xf2, 0x5e,
+	0x6f, 0x4d, 0xa5, 0x74, 0x2d, 0xe6, 0x14, 0xd1, 0x87, 0xfc, 0x9a, 0x9d, 0x17, 0xf0, 0xfa, 0x06,
+	0x7a, 0x0b, 0x9d, 0x18, 0x92, 0xf8, 0x8f, 0xfb, 0xc4, 0x07, 0xe9, 0x70, 0x63, 0x0d, 0x82, 0xd2,
+	0x69, 0x25, 0xce, 0xa2, 0x20, 0x0e, 0xf3, 0x3e, 0x2c, 0xc7, 0xf4, 0xca, 0xb7, 0xdf, 0x03, 0x00,
+	0x0b, 0x73, 0x17, 0xe2, 0xf8, 0x01, 0x00, 0x00,
 }
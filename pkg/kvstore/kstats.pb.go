@@ -21,14 +21,18 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type KStats struct {
-	NumberOfProteins     uint64   `protobuf:"varint,1,opt,name=NumberOfProteins,proto3" json:"NumberOfProteins,omitempty"`
-	NumberOfAA           uint64   `protobuf:"varint,2,opt,name=NumberOfAA,proto3" json:"NumberOfAA,omitempty"`
-	NumberOfKmers        uint64   `protobuf:"varint,4,opt,name=NumberOfKmers,proto3" json:"NumberOfKmers,omitempty"`
-	NumberOfKCombSets    uint64   `protobuf:"varint,5,opt,name=NumberOfKCombSets,proto3" json:"NumberOfKCombSets,omitempty"`
-	Features             []string `protobuf:"bytes,6,rep,name=Features,proto3" json:"Features,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	NumberOfProteins     uint64      `protobuf:"varint,1,opt,name=NumberOfProteins,proto3" json:"NumberOfProteins,omitempty"`
+	NumberOfAA           uint64      `protobuf:"varint,2,opt,name=NumberOfAA,proto3" json:"NumberOfAA,omitempty"`
+	NumberOfKmers        uint64      `protobuf:"varint,4,opt,name=NumberOfKmers,proto3" json:"NumberOfKmers,omitempty"`
+	NumberOfKCombSets    uint64      `protobuf:"varint,5,opt,name=NumberOfKCombSets,proto3" json:"NumberOfKCombSets,omitempty"`
+	Features             []string    `protobuf:"bytes,6,rep,name=Features,proto3" json:"Features,omitempty"`
+	StopKmerThreshold    uint64      `protobuf:"varint,7,opt,name=StopKmerThreshold,proto3" json:"StopKmerThreshold,omitempty"`
+	StopKmers            []*StopKmer `protobuf:"bytes,8,rep,name=StopKmers,proto3" json:"StopKmers,omitempty"`
+	NumberOfDuplicates   uint64      `protobuf:"varint,9,opt,name=NumberOfDuplicates,proto3" json:"NumberOfDuplicates,omitempty"`
+	DedupRatio           float64     `protobuf:"fixed64,10,opt,name=DedupRatio,proto3" json:"DedupRatio,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
 }
 
 func (m *KStats) Reset()         { *m = KStats{} }
@@ -91,23 +95,105 @@ func (m *KStats) GetFeatures() []string {
 	return nil
 }
 
+func (m *KStats) GetStopKmerThreshold() uint64 {
+	if m != nil {
+		return m.StopKmerThreshold
+	}
+	return 0
+}
+
+func (m *KStats) GetStopKmers() []*StopKmer {
+	if m != nil {
+		return m.StopKmers
+	}
+	return nil
+}
+
+func (m *KStats) GetNumberOfDuplicates() uint64 {
+	if m != nil {
+		return m.NumberOfDuplicates
+	}
+	return 0
+}
+
+func (m *KStats) GetDedupRatio() float64 {
+	if m != nil {
+		return m.DedupRatio
+	}
+	return 0
+}
+
+type StopKmer struct {
+	Kmer                 string   `protobuf:"bytes,1,opt,name=Kmer,proto3" json:"Kmer,omitempty"`
+	NumberOfProteins     uint64   `protobuf:"varint,2,opt,name=NumberOfProteins,proto3" json:"NumberOfProteins,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StopKmer) Reset()         { *m = StopKmer{} }
+func (m *StopKmer) String() string { return proto.CompactTextString(m) }
+func (*StopKmer) ProtoMessage()    {}
+func (*StopKmer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_69d4a9d99f3c1d26, []int{1}
+}
+
+func (m *StopKmer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StopKmer.Unmarshal(m, b)
+}
+func (m *StopKmer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StopKmer.Marshal(b, m, deterministic)
+}
+func (m *StopKmer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StopKmer.Merge(m, src)
+}
+func (m *StopKmer) XXX_Size() int {
+	return xxx_messageInfo_StopKmer.Size(m)
+}
+func (m *StopKmer) XXX_DiscardUnknown() {
+	xxx_messageInfo_StopKmer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StopKmer proto.InternalMessageInfo
+
+func (m *StopKmer) GetKmer() string {
+	if m != nil {
+		return m.Kmer
+	}
+	return ""
+}
+
+func (m *StopKmer) GetNumberOfProteins() uint64 {
+	if m != nil {
+		return m.NumberOfProteins
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*KStats)(nil), "kvstore.KStats")
+	proto.RegisterType((*StopKmer)(nil), "kvstore.StopKmer")
 }
 
 func init() { proto.RegisterFile("kstats.proto", fileDescriptor_69d4a9d99f3c1d26) }
 
 var fileDescriptor_69d4a9d99f3c1d26 = []byte{
-	// 162 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xc9, 0x2e, 0x2e, 0x49,
-	0x2c, 0x29, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0xcf, 0x2e, 0x2b, 0x2e, 0xc9, 0x2f,
-	0x4a, 0x55, 0x3a, 0xc2, 0xc8, 0xc5, 0xe6, 0x1d, 0x0c, 0x92, 0x11, 0xd2, 0xe2, 0x12, 0xf0, 0x2b,
-	0xcd, 0x4d, 0x4a, 0x2d, 0xf2, 0x4f, 0x0b, 0x28, 0xca, 0x2f, 0x49, 0xcd, 0xcc, 0x2b, 0x96, 0x60,
-	0x54, 0x60, 0xd4, 0x60, 0x09, 0xc2, 0x10, 0x17, 0x92, 0xe3, 0xe2, 0x82, 0x89, 0x39, 0x3a, 0x4a,
-	0x30, 0x81, 0x55, 0x21, 0x89, 0x08, 0xa9, 0x70, 0xf1, 0xc2, 0x78, 0xde, 0xb9, 0xa9, 0x45, 0xc5,
-	0x12, 0x2c, 0x60, 0x25, 0xa8, 0x82, 0x42, 0x3a, 0x5c, 0x82, 0x70, 0x01, 0xe7, 0xfc, 0xdc, 0xa4,
-	0xe0, 0xd4, 0x92, 0x62, 0x09, 0x56, 0xb0, 0x4a, 0x4c, 0x09, 0x21, 0x29, 0x2e, 0x0e, 0xb7, 0xd4,
-	0xc4, 0x92, 0xd2, 0xa2, 0xd4, 0x62, 0x09, 0x36, 0x05, 0x66, 0x0d, 0xce, 0x20, 0x38, 0x3f, 0x89,
-	0x0d, 0xec, 0x2d, 0x63, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0xd7, 0x22, 0x74, 0x33, 0xe6, 0x00,
-	0x00, 0x00,
+	// 264 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0x41, 0x4b, 0xc3, 0x40,
+	0x10, 0x85, 0x49, 0x1a, 0xd3, 0x64, 0x54, 0xb0, 0x73, 0x5a, 0x3c, 0x48, 0x28, 0x1e, 0x82, 0x48,
+	0x04, 0xfd, 0x05, 0xc5, 0xe2, 0xc1, 0x82, 0xca, 0xc6, 0x3f, 0x90, 0xd8, 0x95, 0x86, 0x36, 0x6e,
+	0xd8, 0x99, 0xf8, 0xc7, 0xfd, 0x03, 0xb2, 0xab, 0x5b, 0x2b, 0xc9, 0x29, 0x99, 0xef, 0x3d, 0x1e,
+	0xcb, 0x7b, 0x70, 0xb2, 0x25, 0xae, 0x98, 0x8a, 0xce, 0x68, 0xd6, 0x38, 0xdd, 0x7e, 0x12, 0x6b,
+	0xa3, 0xe6, 0x5f, 0x21, 0xc4, 0xab, 0xd2, 0x2a, 0x78, 0x05, 0x67, 0x4f, 0x7d, 0x5b, 0x2b, 0xf3,
+	0xfc, 0xfe, 0x62, 0x34, 0xab, 0xe6, 0x83, 0x44, 0x90, 0x05, 0x79, 0x24, 0x07, 0x1c, 0x2f, 0x00,
+	0x3c, 0x5b, 0x2c, 0x44, 0xe8, 0x5c, 0x07, 0x04, 0x2f, 0xe1, 0xd4, 0x5f, 0xab, 0x56, 0x19, 0x12,
+	0x91, 0xb3, 0xfc, 0x87, 0x78, 0x0d, 0xb3, 0x3d, 0xb8, 0xd7, 0x6d, 0x5d, 0x2a, 0x26, 0x71, 0xe4,
+	0x9c, 0x43, 0x01, 0xcf, 0x21, 0x79, 0x50, 0x15, 0xf7, 0x46, 0x91, 0x88, 0xb3, 0x49, 0x9e, 0xca,
+	0xfd, 0x6d, 0x93, 0x4a, 0xd6, 0x9d, 0x8d, 0x7d, 0xdd, 0x18, 0x45, 0x1b, 0xbd, 0x5b, 0x8b, 0xe9,
+	0x4f, 0xd2, 0x40, 0xc0, 0x1b, 0x48, 0x3d, 0x24, 0x91, 0x64, 0x93, 0xfc, 0xf8, 0x76, 0x56, 0xfc,
+	0x36, 0x52, 0x78, 0x45, 0xfe, 0x79, 0xb0, 0x00, 0xf4, 0xef, 0x59, 0xf6, 0xdd, 0xae, 0x79, 0xab,
+	0x58, 0x91, 0x48, 0x5d, 0xfe, 0x88, 0x62, 0xeb, 0x59, 0xaa, 0x75, 0xdf, 0xc9, 0x8a, 0x1b, 0x2d,
+	0x20, 0x0b, 0xf2, 0x40, 0x1e, 0x90, 0xf9, 0x23, 0x24, 0x3e, 0x1c, 0x11, 0x22, 0xfb, 0x75, 0x55,
+	0xa7, 0xd2, 0xfd, 0x8f, 0x4e, 0x11, 0x8e, 0x4f, 0x51, 0xc7, 0x6e, 0xd1, 0xbb, 0xef, 0x01, 0x00,
+	0xe3, 0xa0, 0x39, 0xe4, 0xe1, 0x01, 0x00, 0x00,
 }
@@ -19,13 +19,10 @@ package kvstore
 import (
 	"bytes"
 	"crypto/sha1"
-	"errors"
 	"fmt"
-	"log"
 	"sort"
 	"sync"
-
-	"github.com/dgraph-io/badger/v3"
+	"sync/atomic"
 )
 
 type KV struct {
@@ -43,7 +40,7 @@ type TxBatch struct {
 
 // Key Value Store
 type KVStore struct {
-	DB *badger.DB
+	Storage Storage
 
 	TxBatchChannel     []TxBatch
 	TxBatchChannelWG   *sync.WaitGroup
@@ -54,17 +51,16 @@ type KVStore struct {
 	FlushSize    int
 	NilVal       []byte
 	Mu           sync.Mutex
+
+	insertErr   error // first write error of the insert channel workers
+	insertErrMu sync.Mutex
 }
 
-func NewKVStore(kv *KVStore, options badger.Options, flushSize int, nbOfThreads int) {
+func NewKVStore(kv *KVStore, storage Storage, flushSize int, nbOfThreads int) {
 
 	kv.NilVal = []byte{'0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0', '0'}
 
-	err := error(nil)
-	kv.DB, err = badger.Open(options)
-	if err != nil {
-		log.Fatal(err)
-	}
+	kv.Storage = storage
 
 	kv.BatchCounter = 0
 	kv.NbOfThreads = nbOfThreads
@@ -88,9 +84,25 @@ func (kv *KVStore) OpenInsertChannel() {
 
 }
 
-func (kv *KVStore) CloseInsertChannel() {
+// CloseInsertChannel waits for the pending writes and returns the first write error
+func (kv *KVStore) CloseInsertChannel() error {
 	close(kv.TxBatchChannelJobs)
 	kv.TxBatchChannelWG.Wait()
+
+	kv.insertErrMu.Lock()
+	defer kv.insertErrMu.Unlock()
+	err := kv.insertErr
+	kv.insertErr = nil
+
+	return err
+}
+
+func (kv *KVStore) setInsertError(err error) {
+	kv.insertErrMu.Lock()
+	if kv.insertErr == nil {
+		kv.insertErr = err
+	}
+	kv.insertErrMu.Unlock()
 }
 
 func (kv *KVStore) AddValueToChannel(key []byte, newVal []byte, unique bool) {
@@ -101,38 +113,41 @@ func (kv *KVStore) AddValueChanWorker() {
 
 	nbOfTxs := 0
 	keySeen := make(map[string]bool)
-	wb := kv.DB.NewWriteBatch()
+	wb := kv.Storage.NewBatch()
 
 	for i := range kv.TxBatchChannelJobs {
 
 		bufferFull := (nbOfTxs == kv.FlushSize)
 		if _, ok := keySeen[string(i.Key)]; ok || bufferFull {
-			wb.Flush()
-			wb = kv.DB.NewWriteBatch()
+			if err := wb.Flush(); err != nil {
+				kv.setInsertError(err)
+			}
+			wb = kv.Storage.NewBatch()
 			keySeen = make(map[string]bool)
 			nbOfTxs = 0
 		}
 		nbOfTxs++
 		keySeen[string(i.Key)] = true
-		err := wb.Set(i.Key, i.Val) // Will create txns as needed.
-		if err != nil {
-			log.Fatal(err.Error())
+		if err := wb.Set(i.Key, i.Val); err != nil { // Will create txns as needed.
+			kv.setInsertError(err)
 		}
 
 	}
 
-	wb.Flush()
+	if err := wb.Flush(); err != nil {
+		kv.setInsertError(err)
+	}
 	kv.TxBatchChannelWG.Done()
 
 }
 
-func (kv *KVStore) Close() {
+func (kv *KVStore) Close() error {
 	kv.Flush()
-	kv.DB.Close()
+	return kv.Storage.Close()
 }
 
 func (kv *KVStore) Flush() {
-	// kv.DB.Flatten(kv.NbOfThreads)
+	// kv.Storage.Flatten(kv.NbOfThreads)
 	kv.GarbageCollect(1000, 0.5)
 }
 
@@ -142,7 +157,7 @@ func (kv *KVStore) GarbageCollect(count int, ratio float64) {
 	numberOfGC := count
 	for i := 0; i < count; i++ {
 		numberOfGC = i + 1
-		err := kv.DB.RunValueLogGC(ratio)
+		err := kv.Storage.GarbageCollect(ratio)
 		if err != nil {
 			// fmt.Printf("DEBUG ValueLog GC failed with : %s \n", err.Error())
 			// stop iteration since we hit a GC error
@@ -154,9 +169,22 @@ func (kv *KVStore) GarbageCollect(count int, ratio float64) {
 
 }
 
+// CountKeys returns the number of keys starting with prefix (all the keys if nil)
+func (kv *KVStore) CountKeys(prefix []byte) (uint64, error) {
+
+	count := uint64(0)
+	err := kv.Storage.Stream(prefix, kv.NbOfThreads, func(_ []byte, _ [][]byte) error {
+		atomic.AddUint64(&count, 1)
+		return nil
+	})
+
+	return count, err
+
+}
+
 func (kv *KVStore) GetValue(key []byte) ([]byte, bool) {
 
-	val, err := kv.GetValueFromBadger(key)
+	val, err := kv.GetValueFromStorage(key)
 	if err == nil && val != nil {
 		return val, true
 	}
@@ -165,71 +193,31 @@ func (kv *KVStore) GetValue(key []byte) ([]byte, bool) {
 
 }
 
-func (kv *KVStore) UpdateValue(key []byte, val []byte) {
+func (kv *KVStore) UpdateValue(key []byte, val []byte) error {
 
-	txn := kv.DB.NewTransaction(true)
-	txn.Delete(key)
-	txn.Commit()
-	txn = kv.DB.NewTransaction(true)
-	txn.Set(key, val)
-	txn.Commit()
-
-}
-
-func (kv *KVStore) GetValueFromBadger(key []byte) ([]byte, error) {
-
-	var valCopy []byte
-
-	err := kv.DB.View(func(txn *badger.Txn) error {
-
-		item, errTx := txn.Get(key)
-
-		if errTx == nil {
-			item.Value(func(val []byte) error {
-				// Copying new value
-				valCopy = append([]byte{}, val...)
-				return nil
-			})
-		}
-		return errTx
+	if err := kv.Storage.Delete(key); err != nil {
+		return err
+	}
 
-	})
+	return kv.Storage.Set(key, val)
 
-	if err == nil {
-		return valCopy, err
-	}
+}
 
-	return nil, err
+func (kv *KVStore) GetValueFromStorage(key []byte) ([]byte, error) {
+	return kv.Storage.Get(key)
+}
 
+// GetValuesFromStorage returns the latest value of each key (nil for missing keys)
+func (kv *KVStore) GetValuesFromStorage(keys [][]byte) ([][]byte, error) {
+	return kv.Storage.GetMulti(keys)
 }
 
 func (kv *KVStore) GetValues(key []byte) ([][]byte, error) {
 
 	var values [][]byte
 
-	var iteratorOptions badger.IteratorOptions
-	iteratorOptions.PrefetchValues = true
-	iteratorOptions.PrefetchSize = 100
-	iteratorOptions.AllVersions = true
-
-	err := kv.DB.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(iteratorOptions)
-		defer it.Close()
-		for it.Seek(key); it.ValidForPrefix(key); it.Next() {
-			item := it.Item()
-			var valCopy []byte
-			err2 := item.Value(func(val []byte) error {
-				valCopy = append([]byte{}, val...)
-				return nil
-			})
-			if err2 != nil {
-				log.Fatal(err2.Error())
-				return err2
-			}
-			// val, _ := item.ValueCopy(nil)
-			values = append(values, valCopy)
-		}
-		// fmt.Printf("%x - %d iteration\n", key, iterator)
+	err := kv.Storage.Iterate(key, func(_ []byte, val []byte) error {
+		values = append(values, val)
 		return nil
 	})
 
@@ -241,9 +229,10 @@ func (kv *KVStore) GetValues(key []byte) ([][]byte, error) {
 
 }
 
-func (kv *KVStore) MergeCombinationKeys(combKeys [][]byte, threadId int) []byte {
+func (kv *KVStore) MergeCombinationKeys(combKeys [][]byte, threadId int) ([]byte, error) {
 
 	kv.Mu.Lock()
+	defer kv.Mu.Unlock()
 	ids := [][]byte{}
 
 	findKey := false
@@ -251,9 +240,9 @@ func (kv *KVStore) MergeCombinationKeys(combKeys [][]byte, threadId int) []byte
 		if bytes.Equal(combKey, kv.NilVal) {
 			continue
 		}
-		oldValues, err := kv.GetValueFromBadger(combKey)
-		if err != nil {
-			log.Fatal(err.Error())
+		oldValues, err := kv.GetValueFromStorage(combKey)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
 		}
 		if err == nil && oldValues != nil {
 			findKey = true
@@ -264,19 +253,17 @@ func (kv *KVStore) MergeCombinationKeys(combKeys [][]byte, threadId int) []byte
 	}
 
 	if !findKey {
-		return nil
+		return nil, nil
 	}
 
 	if len(ids) < 1 {
-		return nil
+		return nil, nil
 	}
 
 	newKey, newVal := CreateHashValue(ids, true)
 	kv.AddValueToChannel(newKey, newVal, false)
 
-	kv.Mu.Unlock()
-
-	return newKey
+	return newKey, nil
 
 }
 
@@ -323,7 +310,7 @@ func CreateHashValue(ids [][]byte, unique bool) ([]byte, []byte) {
 func SplitHashValue(hashValue []byte) ([][]byte, error) {
 
 	if len(hashValue)%20 != 0 {
-		return nil, errors.New("Wrong hash size")
+		return nil, CorruptValueError("wrong hash size")
 	}
 
 	values := [][]byte{}
@@ -17,9 +17,16 @@ limitations under the License.
 package kvstore
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
+	"os"
+	"sync"
 
 	"github.com/dgraph-io/badger/v3"
+	proto "github.com/golang/protobuf/proto"
 )
 
 // # Stores :
@@ -35,6 +42,8 @@ type KVStores struct {
 	KmerStore    *K_
 	KCombStore   *KC_
 	ProteinStore *P_
+	KmerIndex    *KmerIndex
+	ReadOnly     bool
 }
 
 const (
@@ -43,9 +52,45 @@ const (
 	MaxValueLogEntries  = 100000000
 )
 
-func KVStoresNew(dbPath string, nbOfThreads int, maxSize bool, syncWrite bool, readOnly bool) *KVStores {
+// kmer_store value of the stop kmers, kmers shared by too many proteins
+// that are dropped at indexing (see KStats.StopKmers)
+var (
+	StopKmerValue = []byte{0}
+	ErrStopKmer   = errors.New("Stop kmer")
+)
+
+// On-disk format version of the database (recorded in KSettings)
+// version 0 : no kmer encoding settings (literal 7-mers)
+// version 1 : kmer size, alphabet and seed recorded in KSettings at makedb
+// version 2 : kcomb values encoding recorded in KSettings at indexdb
+// version 3 : protein sequences stored apart from the annotations
+const (
+	CurrentFormatVersion = 3
+)
+
+// KVStoresNew opens the database stores and checks that their format is
+// compatible with this version of kaamer
+func KVStoresNew(dbPath string, nbOfThreads int, maxSize bool, syncWrite bool, readOnly bool) (*KVStores, error) {
+
+	kvStores, err := KVStoresOpen(dbPath, nbOfThreads, maxSize, syncWrite, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kvStores.CheckFormatVersion(); err != nil {
+		kvStores.Close()
+		return nil, fmt.Errorf("%s : %w", dbPath, err)
+	}
+
+	return kvStores, nil
+
+}
+
+// KVStoresOpen opens the database stores without any format check (see -migrate)
+func KVStoresOpen(dbPath string, nbOfThreads int, maxSize bool, syncWrite bool, readOnly bool) (*KVStores, error) {
 
 	var kvStores KVStores
+	kvStores.ReadOnly = readOnly
 
 	// kmer_store options
 	k_opts := badger.DefaultOptions(dbPath + "/kmer_store")
@@ -95,24 +140,266 @@ func KVStoresNew(dbPath string, nbOfThreads int, maxSize bool, syncWrite bool, r
 	}
 
 	// Open all store
-	kvStores.KmerStore = K_New(k_opts, 1000, nbOfThreads)
-	kvStores.KCombStore = KC_New(kc_opts, 1000, nbOfThreads)
-	kvStores.ProteinStore = P_New(p_opts, 1000, nbOfThreads)
+	kmerStorage, err := BadgerStorageNew(k_opts)
+	if err != nil {
+		return nil, err
+	}
+	kcombStorage, err := BadgerStorageNew(kc_opts)
+	if err != nil {
+		kmerStorage.Close()
+		return nil, err
+	}
+	proteinStorage, err := BadgerStorageNew(p_opts)
+	if err != nil {
+		kmerStorage.Close()
+		kcombStorage.Close()
+		return nil, err
+	}
+	kvStores.KmerStore = K_New(kmerStorage, 1000, nbOfThreads)
+	kvStores.KCombStore = KC_New(kcombStorage, 1000, nbOfThreads)
+	kvStores.ProteinStore = P_New(proteinStorage, 1000, nbOfThreads)
+
+	// Kmer encoding recorded at build time (literal 7-mers for older databases)
+	if kSettings, err := kvStores.GetSettings(); err == nil {
+		if err := checkKmerSettings(kSettings); err != nil {
+			kvStores.Close()
+			return nil, err
+		}
+		if kSettings.Seed != "" {
+			kvStores.KmerStore.SetSeed(kSettings.Seed)
+		} else if kSettings.KmerSize > 0 {
+			kvStores.KmerStore.SetKmerSize(int(kSettings.KmerSize))
+		}
+		if kSettings.Alphabet != "" {
+			if err := kvStores.KmerStore.SetAlphabet(kSettings.Alphabet); err != nil {
+				kvStores.Close()
+				return nil, err
+			}
+		}
+		if kSettings.KCombEncoding != "" {
+			kvStores.KCombStore.SetEncoding(kSettings.KCombEncoding)
+		}
+		if kSettings.SequenceEncoding != "" {
+			kvStores.ProteinStore.SetSequenceEncoding(kSettings.SequenceEncoding)
+		}
+	}
+
+	// Exported kmer index (see -export) used for read-only access
+	if readOnly {
+		indexPath := dbPath + "/" + KmerIndexFile
+		if _, err := os.Stat(indexPath); err == nil {
+			kmerIndex, err := OpenKmerIndex(indexPath)
+			if err != nil {
+				fmt.Printf("# Ignoring kmer index : %s\n", err.Error())
+			} else if kmerIndex.KeySize() != kvStores.KmerStore.keySize {
+				fmt.Println("# Ignoring kmer index : key size differs from the database")
+				kmerIndex.Close()
+			} else {
+				kvStores.KmerIndex = kmerIndex
+			}
+		}
+	}
+
+	return &kvStores, nil
+
+}
+
+// checkKmerSettings checks the kmer encoding of the settings (ErrBadFormat)
+func checkKmerSettings(kSettings *KSettings) error {
+	if kSettings.Seed != "" && !ValidSeed(kSettings.Seed) {
+		return BadFormatError("seed %s of the settings is invalid", kSettings.Seed)
+	}
+	if kSettings.Seed == "" && kSettings.KmerSize != 0 && (kSettings.KmerSize < MinKmerSize || kSettings.KmerSize > MaxKmerSize) {
+		return BadFormatError("kmer size %d of the settings is not between %d and %d", kSettings.KmerSize, MinKmerSize, MaxKmerSize)
+	}
+	if kSettings.Seed != "" && kSettings.KmerSize != 0 && int(kSettings.KmerSize) != len(kSettings.Seed) {
+		return BadFormatError("kmer size %d of the settings differs from the seed %s", kSettings.KmerSize, kSettings.Seed)
+	}
+	if _, ok := Alphabets[kSettings.Alphabet]; kSettings.Alphabet != "" && !ok {
+		return BadFormatError("alphabet %s of the settings unrecognized", kSettings.Alphabet)
+	}
+	return nil
+}
+
+// KVStoresMemoryNew creates empty in-memory stores (tests and small databases)
+// the kmer_store keeps all the versions of a key as done on disk
+func KVStoresMemoryNew(nbOfThreads int) *KVStores {
+
+	var kvStores KVStores
+
+	kvStores.KmerStore = K_New(MemoryStorageNew(math.MaxInt32), 1000, nbOfThreads)
+	kvStores.KCombStore = KC_New(MemoryStorageNew(1), 1000, nbOfThreads)
+	kvStores.ProteinStore = P_New(MemoryStorageNew(1), 1000, nbOfThreads)
 
 	return &kvStores
 
 }
 
+// GetSettings returns the database settings stored in the protein_store
+// (ErrMissingSettings when the database has none)
+func (kvStores *KVStores) GetSettings() (*KSettings, error) {
+
+	kSettings := &KSettings{}
+
+	data, ok := kvStores.ProteinStore.GetValue([]byte("db_settings"))
+	if !ok {
+		return kSettings, ErrMissingSettings
+	}
+
+	if err := proto.Unmarshal(data, kSettings); err != nil {
+		return kSettings, CorruptValueError("db_settings : %s", err.Error())
+	}
+
+	return kSettings, nil
+
+}
+
+// SaveSettings replaces the database settings stored in the protein_store
+func (kvStores *KVStores) SaveSettings(kSettings *KSettings) error {
+
+	data, err := proto.Marshal(kSettings)
+	if err != nil {
+		return err
+	}
+
+	return kvStores.ProteinStore.UpdateValue([]byte("db_settings"), data)
+
+}
+
+// GetStats returns the database statistics stored in the protein_store
+// (ErrMissingStats when the database has none)
+func (kvStores *KVStores) GetStats() (*KStats, error) {
+
+	kStats := &KStats{}
+
+	data, ok := kvStores.ProteinStore.GetValue([]byte("db_stats"))
+	if !ok {
+		return kStats, ErrMissingStats
+	}
+
+	if err := proto.Unmarshal(data, kStats); err != nil {
+		return kStats, CorruptValueError("db_stats : %s", err.Error())
+	}
+
+	return kStats, nil
+
+}
+
+// SaveStats replaces the database statistics stored in the protein_store
+func (kvStores *KVStores) SaveStats(kStats *KStats) error {
+
+	data, err := proto.Marshal(kStats)
+	if err != nil {
+		return err
+	}
+
+	return kvStores.ProteinStore.UpdateValue([]byte("db_stats"), data)
+
+}
+
+// LastProteinId returns the highest protein id ever used by the database
+// (the high-water mark of the settings or the highest protein key stored),
+// the ids of the removed proteins are never given again
+func (kvStores *KVStores) LastProteinId(nbOfThreads int) (uint32, error) {
+
+	kSettings, err := kvStores.GetSettings()
+	if err != nil && !errors.Is(err, ErrMissingSettings) {
+		return 0, err
+	}
+
+	lastId := kSettings.LastProteinId
+	mu := new(sync.Mutex)
+	err = kvStores.ProteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		if !IsProteinKey(key) {
+			return nil
+		}
+		mu.Lock()
+		if id := binary.BigEndian.Uint32(key); id > lastId {
+			lastId = id
+		}
+		mu.Unlock()
+		return nil
+	})
+
+	return lastId, err
+
+}
+
+// CheckFormatVersion returns an error if the database layout is not the current one
+// a database without settings nor stats is considered new (empty)
+func (kvStores *KVStores) CheckFormatVersion() error {
+
+	kSettings, err := kvStores.GetSettings()
+
+	if err == ErrMissingSettings {
+		if _, hasStats := kvStores.ProteinStore.GetValue([]byte("db_stats")); hasStats {
+			return BadFormatError("database has no format version (expecting %d), run kaamer-db -migrate", CurrentFormatVersion)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if kSettings.FormatVersion > CurrentFormatVersion {
+		return BadFormatError("database format version %d is newer than the supported version %d, upgrade kaamer", kSettings.FormatVersion, CurrentFormatVersion)
+	}
+
+	if kSettings.FormatVersion < CurrentFormatVersion {
+		return BadFormatError("database format version %d is older than version %d, run kaamer-db -migrate", kSettings.FormatVersion, CurrentFormatVersion)
+	}
+
+	return nil
+
+}
+
+// GetProteinKeys returns the protein ids associated with a kmer key
+// from the exported kmer index when loaded, otherwise from the kmer and kcomb stores
+// (ErrKeyNotFound for unknown kmers, ErrStopKmer for the ones dropped at indexing
+// and ErrCorruptKComb for a missing kcomb)
+func (kvStores *KVStores) GetProteinKeys(kmerKey []byte) ([]uint32, error) {
+
+	if kvStores.KmerIndex != nil {
+		return kvStores.KmerIndex.Lookup(kmerKey)
+	}
+
+	kCombId, err := kvStores.KmerStore.GetValueFromStorage(kmerKey)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(kCombId, StopKmerValue) {
+		return nil, ErrStopKmer
+	}
+	if len(kCombId) < 1 {
+		return nil, ErrKeyNotFound
+	}
+
+	kCombVal, err := kvStores.KCombStore.GetValueFromStorage(kCombId)
+	if err == ErrKeyNotFound {
+		return nil, ErrCorruptKComb
+	} else if err != nil {
+		return nil, err
+	}
+
+	return kvStores.KCombStore.DecodeProteinKeys(kCombVal)
+
+}
+
 func (kvStores *KVStores) OpenInsertChannel() {
 	kvStores.KmerStore.OpenInsertChannel()
 	kvStores.KCombStore.OpenInsertChannel()
 	kvStores.ProteinStore.OpenInsertChannel()
 }
 
-func (kvStores *KVStores) CloseInsertChannel() {
-	kvStores.KmerStore.CloseInsertChannel()
-	kvStores.KCombStore.CloseInsertChannel()
-	kvStores.ProteinStore.CloseInsertChannel()
+// CloseInsertChannel waits for the pending writes of the stores and returns the first write error
+func (kvStores *KVStores) CloseInsertChannel() error {
+	var firstErr error
+	for _, store := range []*KVStore{kvStores.KmerStore.KVStore, kvStores.KCombStore.KVStore, kvStores.ProteinStore.KVStore} {
+		if err := store.CloseInsertChannel(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func (kvStores *KVStores) Flush() {
@@ -122,9 +409,20 @@ func (kvStores *KVStores) Flush() {
 	kvStores.ProteinStore.Flush()
 }
 
-func (kvStores *KVStores) Close() {
-	// Last DB flushes
-	kvStores.KmerStore.Close()
-	kvStores.KCombStore.Close()
-	kvStores.ProteinStore.Close()
+func (kvStores *KVStores) Close() error {
+	var firstErr error
+	if kvStores.KmerIndex != nil {
+		firstErr = kvStores.KmerIndex.Close()
+	}
+	// Last DB flushes (no value log GC on read-only stores)
+	for _, store := range []*KVStore{kvStores.KmerStore.KVStore, kvStores.KCombStore.KVStore, kvStores.ProteinStore.KVStore} {
+		closeStore := store.Close
+		if kvStores.ReadOnly {
+			closeStore = store.Storage.Close
+		}
+		if err := closeStore(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
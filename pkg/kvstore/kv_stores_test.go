@@ -0,0 +1,217 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKmerEncoding(t *testing.T) {
+
+	kvStores := KVStoresMemoryNew(1)
+	kmerStore := kvStores.KmerStore
+
+	tests := []struct {
+		seed     string
+		alphabet string
+		kmer     string
+		keySize  int
+		decoded  string
+	}{
+		{"1111111", LiteralAlphabet, "MKVLAAG", 4, "MKVLAAG"},
+		{"111111", LiteralAlphabet, "WYCUPQ", 4, "WYCUPQ"},
+		{"11011011", LiteralAlphabet, "ACDEFGHI", 4, "ACEFHI"},
+		{"111111111111", LiteralAlphabet, "ACDEFGHIKLMN", 8, "ACDEFGHIKLMN"},
+		{"1111111", "murphy10", "IVMLYWQ", 4, "LLLLFFE"},
+	}
+
+	for _, test := range tests {
+		kmerStore.SetSeed(test.seed)
+		if err := kmerStore.SetAlphabet(test.alphabet); err != nil {
+			t.Fatal(err)
+		}
+		key := kmerStore.CreateBytesKey(test.kmer)
+		if len(key) != test.keySize {
+			t.Errorf("%s %s : key of %d bytes, expecting %d", test.seed, test.kmer, len(key), test.keySize)
+		}
+		if decoded := kmerStore.DecodeKmer(key); decoded != test.decoded {
+			t.Errorf("%s %s : decoded as %s, expecting %s", test.seed, test.kmer, decoded, test.decoded)
+		}
+	}
+
+	// unknown alphabets are rejected
+	if err := kmerStore.SetAlphabet("murphy11"); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("unknown alphabet : got %v, expecting ErrBadFormat", err)
+	}
+	if kmerStore.Alphabet() != "murphy10" {
+		t.Errorf("alphabet changed to %s by an unknown alphabet", kmerStore.Alphabet())
+	}
+
+	// distinct kmers get distinct keys
+	kmerStore.SetKmerSize(DefaultKmerSize)
+	kmerStore.SetAlphabet(LiteralAlphabet)
+	if string(kmerStore.CreateBytesKey("AAAAAAC")) == string(kmerStore.CreateBytesKey("AAAAAAD")) {
+		t.Error("different kmers encoded with the same key")
+	}
+
+}
+
+func proteinIdsBytes(ids ...uint32) [][]byte {
+	keys := [][]byte{}
+	for _, id := range ids {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, id)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestGetProteinKeys(t *testing.T) {
+
+	kvStores := KVStoresMemoryNew(1)
+	kmerStore := kvStores.KmerStore
+
+	kvStores.KCombStore.OpenKCombBatch()
+	kCombKey, err := kvStores.KCombStore.CreateKCombKey(proteinIdsBytes(7, 3, 42, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.KCombStore.CloseKCombBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kmerStore.Storage.Set(kmerStore.CreateBytesKey("MKVLAAG"), kCombKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := kmerStore.Storage.Set(kmerStore.CreateBytesKey("GGGGGGG"), StopKmerValue); err != nil {
+		t.Fatal(err)
+	}
+
+	proteinKeys, err := kvStores.GetProteinKeys(kmerStore.CreateBytesKey("MKVLAAG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(proteinKeys) != "[3 7 42]" {
+		t.Errorf("GetProteinKeys returned %v, expecting [3 7 42]", proteinKeys)
+	}
+
+	if _, err := kvStores.GetProteinKeys(kmerStore.CreateBytesKey("GGGGGGG")); err != ErrStopKmer {
+		t.Errorf("GetProteinKeys of a stop kmer returned %v, expecting ErrStopKmer", err)
+	}
+
+	if _, err := kvStores.GetProteinKeys(kmerStore.CreateBytesKey("WWWWWWW")); err != ErrKeyNotFound {
+		t.Errorf("GetProteinKeys of a missing kmer returned %v, expecting ErrKeyNotFound", err)
+	}
+
+	if err := kmerStore.Storage.Set(kmerStore.CreateBytesKey("CCCCCCC"), []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvStores.GetProteinKeys(kmerStore.CreateBytesKey("CCCCCCC")); err != ErrCorruptKComb {
+		t.Errorf("GetProteinKeys of a kmer without kcomb returned %v, expecting ErrCorruptKComb", err)
+	}
+
+	// the same set gets the same kcomb key
+	kvStores.KCombStore.OpenKCombBatch()
+	sameKey, err := kvStores.KCombStore.CreateKCombKey(proteinIdsBytes(42, 7, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.KCombStore.CloseKCombBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if string(sameKey) != string(kCombKey) {
+		t.Error("the same protein ids got a different kcomb key")
+	}
+
+}
+
+func TestKVStoresOpenSettings(t *testing.T) {
+
+	tests := []struct {
+		settings *KSettings
+		valid    bool
+	}{
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 7, Alphabet: LiteralAlphabet}, true},
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 15, Seed: "110101101101101", Alphabet: "murphy10"}, true},
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 40}, false},
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 16, Seed: "1111111111111111"}, false},
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 9, Seed: "1101011"}, false},
+		{&KSettings{FormatVersion: CurrentFormatVersion, KmerSize: 7, Alphabet: "murphy11"}, false},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "kvstores")
+		if err != nil {
+			t.Fatal(err)
+		}
+		kvStores, err := KVStoresOpen(dir, 1, false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kvStores.SaveSettings(test.settings); err != nil {
+			t.Fatal(err)
+		}
+		if err := kvStores.Close(); err != nil {
+			t.Fatal(err)
+		}
+		kvStores, err = KVStoresOpen(dir, 1, false, false, true)
+		if err == nil {
+			kvStores.Close()
+		}
+		if test.valid && err != nil {
+			t.Errorf("%v : %v", test.settings, err)
+		} else if !test.valid && !errors.Is(err, ErrBadFormat) {
+			t.Errorf("%v : got %v, expecting ErrBadFormat", test.settings, err)
+		}
+		os.RemoveAll(dir)
+	}
+
+}
+
+func TestLastProteinId(t *testing.T) {
+
+	kvStores := KVStoresMemoryNew(1)
+	kvStores.ProteinStore.OpenInsertChannel()
+	for _, id := range []uint32{1, 4} {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		if err := kvStores.ProteinStore.AddProteinToChannel(proteinId, &Protein{EntryId: fmt.Sprintf("P%d", id), Sequence: "MKVLAAG", Length: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvStores.ProteinStore.CloseInsertChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lastId, err := kvStores.LastProteinId(1); err != nil || lastId != 4 {
+		t.Fatalf("LastProteinId %d (%v), expecting the highest protein key 4", lastId, err)
+	}
+
+	// high-water mark of the removed proteins
+	if err := kvStores.SaveSettings(&KSettings{LastProteinId: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if lastId, err := kvStores.LastProteinId(1); err != nil || lastId != 9 {
+		t.Errorf("LastProteinId %d (%v), expecting the settings high-water mark 9", lastId, err)
+	}
+
+}
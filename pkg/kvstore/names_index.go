@@ -0,0 +1,249 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Inverted index of the protein names (see indexdb)
+// "nam/" + term + 0x00 + prot_id -> mask of the fields holding the term
+const (
+	namesKeyPrefix = "nam/"
+	namesKeySep    = 0x00
+)
+
+// Indexed features (a field mask bit each)
+var NameFields = []string{"ProteinName", "GeneName", "Organism"}
+
+// Minimum length of the prefix* terms, shorter prefixes match most of the postings
+const MinNamePrefix = 3
+
+var (
+	ErrEmptyQuery  = errors.New("Empty query")
+	ErrShortPrefix = errors.New("Prefix too short")
+)
+
+// Tokenize lowercases a text and splits it on anything else than letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func NameTermKey(term string, proteinId []byte) []byte {
+	key := make([]byte, 0, len(namesKeyPrefix)+len(term)+1+len(proteinId))
+	key = append(key, namesKeyPrefix...)
+	key = append(key, term...)
+	key = append(key, namesKeySep)
+	return append(key, proteinId...)
+}
+
+// NameFieldMask returns the mask of a feature name (all the fields if empty)
+func NameFieldMask(field string) (byte, bool) {
+	if field == "" {
+		return 0xFF, true
+	}
+	for i, f := range NameFields {
+		if strings.EqualFold(f, field) {
+			return 1 << uint(i), true
+		}
+	}
+	return 0, false
+}
+
+// nameTerms returns the terms of the protein name fields (and of its members) with their field mask
+func nameTerms(protein *Protein) map[string]byte {
+
+	terms := make(map[string]byte)
+	for _, prot := range append([]*Protein{protein}, protein.Members...) {
+		for i, field := range NameFields {
+			for _, term := range Tokenize(prot.Features[field]) {
+				terms[term] |= 1 << uint(i)
+			}
+		}
+	}
+
+	return terms
+
+}
+
+// AddNamesToChannel adds the terms of the protein name fields (and of its members) to the index
+func (p *P_) AddNamesToChannel(proteinId []byte, protein *Protein) {
+	for term, mask := range nameTerms(protein) {
+		p.AddValueToChannel(NameTermKey(term, proteinId), []byte{mask}, false)
+	}
+}
+
+// NameKeys returns the index keys of the protein name fields (and of its members)
+func NameKeys(proteinId []byte, protein *Protein) [][]byte {
+	keys := [][]byte{}
+	for term := range nameTerms(protein) {
+		keys = append(keys, NameTermKey(term, proteinId))
+	}
+	return keys
+}
+
+// postings returns the protein ids of a term (or of all the terms starting with it)
+func (p *P_) postings(term string, prefix bool, mask byte) (map[uint32]bool, error) {
+
+	keyPrefix := []byte(namesKeyPrefix + term)
+	if !prefix {
+		keyPrefix = append(keyPrefix, namesKeySep)
+	}
+
+	ids := make(map[uint32]bool)
+	err := p.Storage.Iterate(keyPrefix, func(key []byte, val []byte) error {
+		if len(key) < len(keyPrefix)+4 || len(val) < 1 || val[0]&mask == 0 {
+			return nil
+		}
+		ids[binary.BigEndian.Uint32(key[len(key)-4:])] = true
+		return nil
+	})
+
+	return ids, err
+
+}
+
+// SearchNames returns the proteins (without sequence) matching a query on the name fields
+// "a phrase" : consecutive terms
+// prefix*    : terms starting with prefix
+// term term  : all the terms
+// field restricts the query to one of NameFields (all if empty)
+func (p *P_) SearchNames(query string, field string, limit int) ([]*Protein, error) {
+
+	mask, ok := NameFieldMask(field)
+	if !ok {
+		return nil, errors.New("Unknown field " + field)
+	}
+
+	query = strings.TrimSpace(query)
+	phrase := []string{}
+	if len(query) > 1 && strings.HasPrefix(query, "\"") && strings.HasSuffix(query, "\"") {
+		phrase = Tokenize(query)
+	}
+
+	type queryTerm struct {
+		term   string
+		prefix bool
+	}
+	terms := []queryTerm{}
+	for _, word := range strings.Fields(query) {
+		tokens := Tokenize(word)
+		for i, token := range tokens {
+			isPrefix := len(phrase) == 0 && i == len(tokens)-1 && strings.HasSuffix(word, "*")
+			if isPrefix && utf8.RuneCountInString(token) < MinNamePrefix {
+				return nil, fmt.Errorf("%w : %s* (at least %d characters)", ErrShortPrefix, token, MinNamePrefix)
+			}
+			terms = append(terms, queryTerm{term: token, prefix: isPrefix})
+		}
+	}
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	// intersection of the term postings
+	var ids map[uint32]bool
+	for _, t := range terms {
+		termIds, err := p.postings(t.term, t.prefix, mask)
+		if err != nil {
+			return nil, err
+		}
+		if ids == nil {
+			ids = termIds
+			continue
+		}
+		for id := range ids {
+			if !termIds[id] {
+				delete(ids, id)
+			}
+		}
+	}
+
+	sortedIds := make([]uint32, 0, len(ids))
+	for id := range ids {
+		sortedIds = append(sortedIds, id)
+	}
+	sort.Slice(sortedIds, func(i, j int) bool { return sortedIds[i] < sortedIds[j] })
+
+	proteins := []*Protein{}
+	for start := 0; start < len(sortedIds) && (limit < 1 || len(proteins) < limit); start += 1000 {
+		end := start + 1000
+		if end > len(sortedIds) {
+			end = len(sortedIds)
+		}
+		proteinIds := make([][]byte, 0, end-start)
+		for _, id := range sortedIds[start:end] {
+			proteinId := make([]byte, 4)
+			binary.BigEndian.PutUint32(proteinId, id)
+			proteinIds = append(proteinIds, proteinId)
+		}
+		batch, err := p.GetProteins(proteinIds, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, prot := range batch {
+			if prot == nil || (len(phrase) > 0 && !hasPhrase(prot, phrase, mask)) {
+				continue
+			}
+			proteins = append(proteins, prot)
+			if limit > 0 && len(proteins) == limit {
+				break
+			}
+		}
+	}
+
+	return proteins, nil
+
+}
+
+func hasPhrase(protein *Protein, phrase []string, mask byte) bool {
+
+	for _, member := range protein.Members {
+		if hasPhrase(member, phrase, mask) {
+			return true
+		}
+	}
+
+	for i, field := range NameFields {
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		tokens := Tokenize(protein.Features[field])
+		for start := 0; start+len(phrase) <= len(tokens); start++ {
+			match := true
+			for j, term := range phrase {
+				if tokens[start+j] != term {
+					match = false
+					break
+				}
+			}
+			if match {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchNames(t *testing.T) {
+
+	kvStores := KVStoresMemoryNew(1)
+	proteinStore := kvStores.ProteinStore
+
+	names := []string{"class A beta-lactamase", "beta-galactosidase", "lactate dehydrogenase"}
+	proteinStore.OpenInsertChannel()
+	for i, name := range names {
+		proteinId := proteinIdsBytes(uint32(i + 1))[0]
+		protein := &Protein{EntryId: name, Sequence: "MKVLAAG", Length: 7, Features: map[string]string{"ProteinName": name}}
+		if err := proteinStore.AddProteinToChannel(proteinId, protein); err != nil {
+			t.Fatal(err)
+		}
+		proteinStore.AddNamesToChannel(proteinId, protein)
+	}
+	if err := proteinStore.CloseInsertChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		entries []string
+	}{
+		{"beta", []string{names[0], names[1]}},
+		{"lactam*", []string{names[0]}},
+		{"lac*", []string{names[0], names[2]}},
+		{`"class a beta"`, []string{names[0]}},
+		{`"beta class"`, []string{}},
+	}
+	for _, test := range tests {
+		proteins, err := proteinStore.SearchNames(test.query, "", 0)
+		if err != nil {
+			t.Fatalf("%s : %v", test.query, err)
+		}
+		if len(proteins) != len(test.entries) {
+			t.Errorf("%s : %d proteins, expecting %v", test.query, len(proteins), test.entries)
+			continue
+		}
+		for i, prot := range proteins {
+			if prot.EntryId != test.entries[i] {
+				t.Errorf("%s : protein %s, expecting %s", test.query, prot.EntryId, test.entries[i])
+			}
+		}
+	}
+
+	if _, err := proteinStore.SearchNames("la*", "", 0); !errors.Is(err, ErrShortPrefix) {
+		t.Errorf("SearchNames of a 2 characters prefix returned %v, expecting ErrShortPrefix", err)
+	}
+
+}
@@ -17,17 +17,362 @@ limitations under the License.
 package kvstore
 
 import (
-	"github.com/dgraph-io/badger/v3"
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Encoding of the protein sequences (stored apart from the annotations)
+// raw : sequence bytes
+// flate : huffman coded sequence (deflate)
+const (
+	SequenceEncodingRaw   = "raw"
+	SequenceEncodingFlate = "flate"
+	sequenceKeyPrefix     = 's'
+	entryIdKeyPrefix      = "eid/"
+	memberKeyPrefix       = "mem/"
+	duplicateKeyPrefix    = "md5/"
+)
+
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.HuffmanOnly)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	}}
 )
 
 // Hash store for values combination used in other stores
 type P_ struct {
 	*KVStore
+	sequenceEncoding string
 }
 
-func P_New(opts badger.Options, flushSize int, nbOfThreads int) *P_ {
+func P_New(storage Storage, flushSize int, nbOfThreads int) *P_ {
 	var p P_
 	p.KVStore = new(KVStore)
-	NewKVStore(p.KVStore, opts, flushSize, nbOfThreads)
+	p.sequenceEncoding = SequenceEncodingRaw
+	NewKVStore(p.KVStore, storage, flushSize, nbOfThreads)
 	return &p
 }
+
+func (p *P_) SetSequenceEncoding(encoding string) {
+	p.sequenceEncoding = encoding
+}
+
+func (p *P_) SequenceEncoding() string {
+	return p.sequenceEncoding
+}
+
+// IsProteinKey tells if a protein_store key is a protein id (and not an index or settings key)
+func IsProteinKey(key []byte) bool {
+	return len(key) == 4
+}
+
+// IsMemberKey tells if a protein_store key is a member not merged yet in its representative (see MergeMembers)
+func IsMemberKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(memberKeyPrefix))
+}
+
+// SequenceKey returns the key of a protein sequence (protein id prefixed by 's')
+func SequenceKey(proteinId []byte) []byte {
+	return append([]byte{sequenceKeyPrefix}, proteinId...)
+}
+
+// EntryIdKey returns the key of the EntryId index (EntryId prefixed by "eid/")
+func EntryIdKey(entryId string) []byte {
+	return []byte(entryIdKeyPrefix + entryId)
+}
+
+// MemberKey returns the key of a duplicated protein waiting to be merged
+// in its representative protein (see makedb -dedup)
+func MemberKey(representativeId []byte, proteinId []byte) []byte {
+	key := make([]byte, 0, len(memberKeyPrefix)+len(representativeId)+len(proteinId))
+	key = append(key, memberKeyPrefix...)
+	key = append(key, representativeId...)
+	return append(key, proteinId...)
+}
+
+// DuplicateKey returns the key of a protein waiting for its sequence deduplication (see SplitDuplicates)
+// "md5/" + md5 of the sequence + protein id
+func DuplicateKey(sequence string, proteinId []byte) []byte {
+	sum := md5.Sum([]byte(sequence))
+	key := make([]byte, 0, len(duplicateKeyPrefix)+len(sum)+len(proteinId))
+	key = append(key, duplicateKeyPrefix...)
+	key = append(key, sum[:]...)
+	return append(key, proteinId...)
+}
+
+// AddProteinToChannel stores the annotations of a protein under its id
+// and its sequence under the sequence key
+func (p *P_) AddProteinToChannel(proteinId []byte, protein *Protein) error {
+
+	sequence := protein.Sequence
+	protein.Sequence = ""
+	data, err := proto.Marshal(protein)
+	protein.Sequence = sequence
+	if err != nil {
+		return err
+	}
+
+	p.AddValueToChannel(proteinId, data, false)
+	p.AddValueToChannel(SequenceKey(proteinId), p.EncodeSequence(sequence), false)
+
+	return nil
+
+}
+
+// AddMemberToChannel stores the annotations of a protein sharing the sequence of a representative protein
+func (p *P_) AddMemberToChannel(representativeId []byte, proteinId []byte, protein *Protein) error {
+
+	member := &Protein{EntryId: protein.EntryId, Length: protein.Length, Features: protein.Features}
+	data, err := proto.Marshal(member)
+	if err != nil {
+		return err
+	}
+
+	p.AddValueToChannel(MemberKey(representativeId, proteinId), data, false)
+
+	return nil
+
+}
+
+// MergeMembers moves the stored members into the Members of their representative protein
+// and returns the number of members merged
+func (p *P_) MergeMembers() (uint64, error) {
+
+	batch := p.Storage.NewBatch()
+	nbOfMembers := uint64(0)
+
+	var representativeId []byte
+	var representative *Protein
+
+	saveRepresentative := func() error {
+		if representative == nil {
+			return nil
+		}
+		data, err := proto.Marshal(representative)
+		if err != nil {
+			return err
+		}
+		return batch.Set(representativeId, data)
+	}
+
+	err := p.Storage.Iterate([]byte(memberKeyPrefix), func(key []byte, val []byte) error {
+
+		if len(key) != len(memberKeyPrefix)+8 {
+			return nil
+		}
+
+		id := key[len(memberKeyPrefix) : len(memberKeyPrefix)+4]
+		if !bytes.Equal(id, representativeId) {
+			if err := saveRepresentative(); err != nil {
+				return err
+			}
+			representativeId = append([]byte{}, id...)
+			representative = nil
+			if data, err := p.Storage.Get(representativeId); err == nil {
+				representative = &Protein{}
+				if err := proto.Unmarshal(data, representative); err != nil {
+					return CorruptValueError("protein : %s", err.Error())
+				}
+			}
+		}
+
+		if representative != nil {
+			member := &Protein{}
+			if err := proto.Unmarshal(val, member); err != nil {
+				return CorruptValueError("protein member : %s", err.Error())
+			}
+			representative.Members = append(representative.Members, member)
+			nbOfMembers++
+		}
+
+		return batch.Delete(key)
+
+	})
+	if err != nil {
+		return nbOfMembers, err
+	}
+
+	if err := saveRepresentative(); err != nil {
+		return nbOfMembers, err
+	}
+
+	return nbOfMembers, batch.Flush()
+
+}
+
+// SplitDuplicates groups the proteins stored with a DuplicateKey by sequence, the smallest protein id
+// of a sequence is its representative and the others are moved to member keys (see MergeMembers).
+// representative is called with the sequence of each representative and member with each member
+func (p *P_) SplitDuplicates(representative func(proteinId []byte, sequence string) error, member func(protein *Protein)) error {
+
+	batch := p.Storage.NewBatch()
+	var sum []byte
+	var representativeId []byte
+
+	// the keys are sorted by md5 then by protein id
+	err := p.Storage.Iterate([]byte(duplicateKeyPrefix), func(key []byte, val []byte) error {
+
+		if len(key) != len(duplicateKeyPrefix)+md5.Size+4 {
+			return nil
+		}
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+
+		proteinId := key[len(duplicateKeyPrefix)+md5.Size:]
+		if !bytes.Equal(key[:len(duplicateKeyPrefix)+md5.Size], sum) {
+			sum = append([]byte{}, key[:len(duplicateKeyPrefix)+md5.Size]...)
+			representativeId = append([]byte{}, proteinId...)
+			data, err := p.Storage.Get(SequenceKey(representativeId))
+			if err != nil {
+				return err
+			}
+			sequence, err := p.DecodeSequence(data)
+			if err != nil {
+				return err
+			}
+			return representative(representativeId, sequence)
+		}
+
+		data, err := p.Storage.Get(proteinId)
+		if err != nil {
+			return err
+		}
+		prot := &Protein{}
+		if err := proto.Unmarshal(data, prot); err != nil {
+			return CorruptValueError("protein : %s", err.Error())
+		}
+		member(prot)
+		data, err = proto.Marshal(&Protein{EntryId: prot.EntryId, Length: prot.Length, Features: prot.Features})
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(MemberKey(representativeId, proteinId), data); err != nil {
+			return err
+		}
+		if err := batch.Delete(SequenceKey(proteinId)); err != nil {
+			return err
+		}
+		return batch.Delete(proteinId)
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return batch.Flush()
+
+}
+
+func (p *P_) EncodeSequence(sequence string) []byte {
+
+	if p.sequenceEncoding != SequenceEncodingFlate {
+		return []byte(sequence)
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write([]byte(sequence))
+	w.Close()
+	flateWriters.Put(w)
+
+	return buf.Bytes()
+
+}
+
+func (p *P_) DecodeSequence(val []byte) (string, error) {
+
+	if p.sequenceEncoding != SequenceEncodingFlate {
+		return string(val), nil
+	}
+
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(val), nil); err != nil {
+		return "", CorruptValueError("sequence : %s", err.Error())
+	}
+	sequence, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", CorruptValueError("sequence : %s", err.Error())
+	}
+
+	return string(sequence), nil
+
+}
+
+// GetProteins returns the proteins of a list of ids (nil for missing ids)
+// sequences are only fetched when needed
+func (p *P_) GetProteins(proteinIds [][]byte, withSequence bool) ([]*Protein, error) {
+
+	keys := proteinIds
+	if withSequence {
+		keys = make([][]byte, 0, 2*len(proteinIds))
+		keys = append(keys, proteinIds...)
+		for _, proteinId := range proteinIds {
+			keys = append(keys, SequenceKey(proteinId))
+		}
+	}
+
+	values, err := p.GetValuesFromStorage(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	proteins := make([]*Protein, len(proteinIds))
+	for i := range proteinIds {
+		if values[i] == nil {
+			continue
+		}
+		prot := &Protein{}
+		if err := proto.Unmarshal(values[i], prot); err != nil {
+			return nil, CorruptValueError("protein : %s", err.Error())
+		}
+		if withSequence && values[len(proteinIds)+i] != nil {
+			if prot.Sequence, err = p.DecodeSequence(values[len(proteinIds)+i]); err != nil {
+				return nil, err
+			}
+		}
+		proteins[i] = prot
+	}
+
+	return proteins, nil
+
+}
+
+func (p *P_) GetProtein(proteinId []byte, withSequence bool) (*Protein, bool) {
+
+	proteins, err := p.GetProteins([][]byte{proteinId}, withSequence)
+	if err != nil || proteins[0] == nil {
+		return nil, false
+	}
+
+	return proteins[0], true
+
+}
+
+// GetProteinKey returns the protein id of an EntryId (see indexdb)
+func (p *P_) GetProteinKey(entryId string) ([]byte, bool) {
+	return p.GetValue(EntryIdKey(entryId))
+}
+
+func (p *P_) GetProteinByEntryId(entryId string, withSequence bool) (*Protein, bool) {
+
+	proteinId, ok := p.GetProteinKey(entryId)
+	if !ok {
+		return nil, false
+	}
+
+	return p.GetProtein(proteinId, withSequence)
+
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"errors"
+)
+
+var (
+	ErrKeyNotFound = errors.New("Key not found")
+	ErrNoGarbage   = errors.New("No garbage to collect")
+)
+
+// Storage is the key value backend of a KVStore
+// a key can hold multiple values (versions) when the backend keeps them,
+// values are always returned from the newest to the oldest version
+type Storage interface {
+	// Get returns a copy of the latest value of a key (ErrKeyNotFound if missing)
+	Get(key []byte) ([]byte, error)
+	// GetMulti returns the latest value of each key (nil for missing keys)
+	GetMulti(keys [][]byte) ([][]byte, error)
+	// Iterate calls fn in key order for every value (all versions) of the keys with prefix
+	Iterate(prefix []byte, fn func(key []byte, val []byte) error) error
+	// Stream calls fn concurrently for every key with prefix and all its values
+	Stream(prefix []byte, nbOfThreads int, fn func(key []byte, values [][]byte) error) error
+	// NewBatch returns a write batch applied on Flush
+	NewBatch() Batch
+	Set(key []byte, val []byte) error
+	Delete(key []byte) error
+	// GarbageCollect reclaims space once (ErrNoGarbage when nothing was collected)
+	GarbageCollect(ratio float64) error
+	Flatten(workers int) error
+	Sync() error
+	Close() error
+}
+
+// Batch of writes
+type Batch interface {
+	Set(key []byte, val []byte) error
+	// Replace sets the value of a key and drops its older versions
+	Replace(key []byte, val []byte) error
+	Delete(key []byte) error
+	Flush() error
+}
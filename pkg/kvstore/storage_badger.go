@@ -0,0 +1,271 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// Badger (on-disk) storage
+type BadgerStorage struct {
+	DB *badger.DB
+}
+
+func BadgerStorageNew(opts badger.Options) (*BadgerStorage, error) {
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStorage{DB: db}, nil
+
+}
+
+func (s *BadgerStorage) Get(key []byte) ([]byte, error) {
+
+	var valCopy []byte
+
+	err := s.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		valCopy, err = item.ValueCopy(nil)
+		return err
+	})
+
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return valCopy, nil
+
+}
+
+func (s *BadgerStorage) GetMulti(keys [][]byte) ([][]byte, error) {
+
+	values := make([][]byte, len(keys))
+
+	err := s.DB.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if values[i], err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+
+}
+
+func (s *BadgerStorage) Iterate(prefix []byte, fn func(key []byte, val []byte) error) error {
+
+	var iteratorOptions badger.IteratorOptions
+	iteratorOptions.PrefetchValues = true
+	iteratorOptions.PrefetchSize = 100
+	iteratorOptions.AllVersions = true
+	iteratorOptions.Prefix = prefix
+
+	return s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(iteratorOptions)
+		defer it.Close()
+		// the versions older than a delete or a replace are not compacted yet
+		var deletedKey []byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if item.IsDeletedOrExpired() {
+				deletedKey = item.KeyCopy(deletedKey)
+				continue
+			}
+			if deletedKey != nil && bytes.Equal(item.Key(), deletedKey) {
+				continue
+			}
+			valCopy, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), valCopy); err != nil {
+				return err
+			}
+			if item.DiscardEarlierVersions() {
+				deletedKey = item.KeyCopy(deletedKey)
+			}
+		}
+		return nil
+	})
+
+}
+
+func (s *BadgerStorage) Stream(prefix []byte, nbOfThreads int, fn func(key []byte, values [][]byte) error) error {
+
+	// Orchestrate only logs the KeyToList errors, the first error (of fn or reading a value)
+	// is kept and the stream is cancelled (the remaining keys are not chosen)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var fnErr error
+	var fnErrMu sync.Mutex
+	setErr := func(err error) {
+		fnErrMu.Lock()
+		if fnErr == nil {
+			fnErr = err
+		}
+		fnErrMu.Unlock()
+		cancel()
+	}
+	failed := func() bool {
+		fnErrMu.Lock()
+		defer fnErrMu.Unlock()
+		return fnErr != nil
+	}
+
+	stream := s.DB.NewStream()
+
+	stream.NumGo = nbOfThreads            // Set number of goroutines to use for iteration.
+	stream.Prefix = prefix                // nil for iteration over the whole DB.
+	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
+
+	// ChooseKey is called concurrently for every key, false once fn failed
+	stream.ChooseKey = func(item *badger.Item) bool {
+		return !failed()
+	}
+
+	// KeyToList is called concurrently for chosen keys, all the versions
+	// of a key are collected and handed to fn
+	stream.KeyToList = func(key []byte, it *badger.Iterator) (*pb.KVList, error) {
+
+		values := [][]byte{}
+		keyCopy := []byte{}
+
+		for ; it.Valid(); it.Next() {
+
+			item := it.Item()
+			if item.IsDeletedOrExpired() {
+				break
+			}
+			if !bytes.Equal(key, item.Key()) {
+				break
+			}
+
+			valCopy, err := item.ValueCopy(nil)
+			if err != nil {
+				setErr(err)
+				return nil, nil
+			}
+
+			values = append(values, valCopy)
+			keyCopy = item.KeyCopy(keyCopy)
+
+			// last version kept (see Batch.Replace)
+			if item.DiscardEarlierVersions() {
+				break
+			}
+
+		}
+
+		if len(values) == 0 {
+			return nil, nil
+		}
+
+		if err := fn(keyCopy, values); err != nil {
+			setErr(err)
+		}
+
+		return nil, nil
+
+	}
+
+	// Send is called serially, while Stream.Orchestrate is running.
+	stream.Send = nil
+
+	err := stream.Orchestrate(ctx)
+
+	fnErrMu.Lock()
+	defer fnErrMu.Unlock()
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+
+}
+
+func (s *BadgerStorage) NewBatch() Batch {
+	return badgerBatch{s.DB.NewWriteBatch()}
+}
+
+type badgerBatch struct {
+	*badger.WriteBatch
+}
+
+// Replace marks the older versions of the key as discarded, Iterate and Stream
+// skip them right away and they are dropped at the next compaction
+func (b badgerBatch) Replace(key []byte, val []byte) error {
+	return b.SetEntry(badger.NewEntry(key, val).WithDiscard())
+}
+
+func (s *BadgerStorage) Set(key []byte, val []byte) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+}
+
+func (s *BadgerStorage) Delete(key []byte) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (s *BadgerStorage) GarbageCollect(ratio float64) error {
+	err := s.DB.RunValueLogGC(ratio)
+	if err == badger.ErrNoRewrite {
+		return ErrNoGarbage
+	}
+	return err
+}
+
+func (s *BadgerStorage) Flatten(workers int) error {
+	return s.DB.Flatten(workers)
+}
+
+func (s *BadgerStorage) Sync() error {
+	return s.DB.Sync()
+}
+
+func (s *BadgerStorage) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In-memory storage (tests and small databases)
+// values of a key are kept from the oldest to the newest version
+type MemoryStorage struct {
+	data              map[string][][]byte
+	numVersionsToKeep int
+	mu                sync.RWMutex
+}
+
+type memoryEntries struct {
+	keys   []string
+	values [][][]byte
+}
+
+func MemoryStorageNew(numVersionsToKeep int) *MemoryStorage {
+
+	if numVersionsToKeep < 1 {
+		numVersionsToKeep = 1
+	}
+
+	return &MemoryStorage{
+		data:              make(map[string][][]byte),
+		numVersionsToKeep: numVersionsToKeep,
+	}
+
+}
+
+func (s *MemoryStorage) Get(key []byte) ([]byte, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte{}, versions[len(versions)-1]...), nil
+
+}
+
+func (s *MemoryStorage) GetMulti(keys [][]byte) ([][]byte, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if versions, ok := s.data[string(key)]; ok {
+			values[i] = append([]byte{}, versions[len(versions)-1]...)
+		}
+	}
+
+	return values, nil
+
+}
+
+// entries returns a sorted snapshot of the keys with prefix and their values
+// (newest first) so that callbacks can write to the storage
+func (s *MemoryStorage) entries(prefix []byte) memoryEntries {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var e memoryEntries
+	for k := range s.data {
+		if strings.HasPrefix(k, string(prefix)) {
+			e.keys = append(e.keys, k)
+		}
+	}
+	sort.Strings(e.keys)
+
+	for _, k := range e.keys {
+		versions := s.data[k]
+		values := make([][]byte, len(versions))
+		for i, v := range versions {
+			values[len(versions)-1-i] = append([]byte{}, v...)
+		}
+		e.values = append(e.values, values)
+	}
+
+	return e
+
+}
+
+func (s *MemoryStorage) Iterate(prefix []byte, fn func(key []byte, val []byte) error) error {
+
+	e := s.entries(prefix)
+	for i, k := range e.keys {
+		for _, val := range e.values[i] {
+			if err := fn([]byte(k), val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+func (s *MemoryStorage) Stream(prefix []byte, nbOfThreads int, fn func(key []byte, values [][]byte) error) error {
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	e := s.entries(prefix)
+
+	jobs := make(chan int)
+	errs := make(chan error, nbOfThreads)
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < nbOfThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := fn([]byte(e.keys[j]), e.values[j]); err != nil {
+					errs <- err
+					// drain the remaining jobs
+					for range jobs {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	for j := range e.keys {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+
+}
+
+func (s *MemoryStorage) NewBatch() Batch {
+	return &memoryBatch{storage: s}
+}
+
+func (s *MemoryStorage) Set(key []byte, val []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, val)
+
+	return nil
+
+}
+
+func (s *MemoryStorage) set(key []byte, val []byte) {
+
+	k := string(key)
+	versions := append(s.data[k], append([]byte{}, val...))
+	if len(versions) > s.numVersionsToKeep {
+		versions = versions[len(versions)-s.numVersionsToKeep:]
+	}
+	s.data[k] = versions
+
+}
+
+func (s *MemoryStorage) Delete(key []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, string(key))
+
+	return nil
+
+}
+
+func (s *MemoryStorage) GarbageCollect(ratio float64) error {
+	return ErrNoGarbage
+}
+
+func (s *MemoryStorage) Flatten(workers int) error {
+	return nil
+}
+
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+type memoryBatch struct {
+	storage *MemoryStorage
+	entries []memoryWrite
+}
+
+type memoryWrite struct {
+	KV
+	delete  bool
+	replace bool
+}
+
+func (b *memoryBatch) Set(key []byte, val []byte) error {
+	b.entries = append(b.entries, memoryWrite{KV: KV{Key: append([]byte{}, key...), Val: append([]byte{}, val...)}})
+	return nil
+}
+
+func (b *memoryBatch) Replace(key []byte, val []byte) error {
+	b.entries = append(b.entries, memoryWrite{KV: KV{Key: append([]byte{}, key...), Val: append([]byte{}, val...)}, replace: true})
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.entries = append(b.entries, memoryWrite{KV: KV{Key: append([]byte{}, key...)}, delete: true})
+	return nil
+}
+
+func (b *memoryBatch) Flush() error {
+
+	b.storage.mu.Lock()
+	defer b.storage.mu.Unlock()
+
+	for _, e := range b.entries {
+		switch {
+		case e.delete:
+			delete(b.storage.data, string(e.Key))
+		case e.replace:
+			b.storage.data[string(e.Key)] = [][]byte{e.Val}
+		default:
+			b.storage.set(e.Key, e.Val)
+		}
+	}
+	b.entries = nil
+
+	return nil
+
+}
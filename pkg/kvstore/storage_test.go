@@ -0,0 +1,237 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// testStorages returns the storage backends to test and the cleanup closing them
+// (the badger store keeps all the versions as the kmer_store)
+func testStorages(t *testing.T) (map[string]Storage, func()) {
+
+	dir, err := ioutil.TempDir("", "kaamer-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badgerStorage, err := BadgerStorageNew(badger.DefaultOptions(dir).WithLogger(nil).WithNumVersionsToKeep(math.MaxInt32))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		badgerStorage.Close()
+		os.RemoveAll(dir)
+	}
+
+	return map[string]Storage{
+		"badger": badgerStorage,
+		"memory": MemoryStorageNew(1),
+	}, cleanup
+
+}
+
+func TestStreamCallbackError(t *testing.T) {
+
+	errCallback := errors.New("callback failed")
+
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			batch := storage.NewBatch()
+			for i := 0; i < 1000; i++ {
+				if err := batch.Set([]byte(fmt.Sprintf("k%04d", i)), []byte{byte(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := batch.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			err := storage.Stream([]byte("k"), 4, func(key []byte, values [][]byte) error {
+				if string(key) == "k0500" {
+					return errCallback
+				}
+				return nil
+			})
+			if !errors.Is(err, errCallback) {
+				t.Fatalf("Stream returned %v, expecting the callback error", err)
+			}
+
+			if err := storage.Stream([]byte("k"), 4, func(key []byte, values [][]byte) error { return nil }); err != nil {
+				t.Fatalf("Stream returned %v without a callback error", err)
+			}
+		})
+	}
+
+}
+
+func TestStorageReadWrite(t *testing.T) {
+
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.Set([]byte("a1"), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			batch := storage.NewBatch()
+			for _, key := range []string{"b1", "b2", "b3", "c1"} {
+				if err := batch.Set([]byte(key), []byte("v"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := batch.Delete([]byte("a1")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := storage.Get([]byte("b1")); err != ErrKeyNotFound {
+				t.Fatalf("Get returned %v before the batch flush, expecting ErrKeyNotFound", err)
+			}
+			if err := batch.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if val, err := storage.Get([]byte("b2")); err != nil || string(val) != "vb2" {
+				t.Fatalf("Get b2 returned %q, %v", val, err)
+			}
+			if _, err := storage.Get([]byte("a1")); err != ErrKeyNotFound {
+				t.Fatalf("Get of a deleted key returned %v, expecting ErrKeyNotFound", err)
+			}
+
+			values, err := storage.GetMulti([][]byte{[]byte("c1"), []byte("zz"), []byte("b1")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != 3 || string(values[0]) != "vc1" || values[1] != nil || string(values[2]) != "vb1" {
+				t.Fatalf("GetMulti returned %q", values)
+			}
+
+			keys := []string{}
+			err = storage.Iterate([]byte("b"), func(key []byte, val []byte) error {
+				keys = append(keys, string(key))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(keys) != "[b1 b2 b3]" {
+				t.Fatalf("Iterate on prefix b returned the keys %v", keys)
+			}
+
+			var mu sync.Mutex
+			streamed := map[string]string{}
+			err = storage.Stream([]byte("b"), 2, func(key []byte, values [][]byte) error {
+				mu.Lock()
+				streamed[string(key)] = string(values[0])
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(streamed) != 3 || streamed["b3"] != "vb3" {
+				t.Fatalf("Stream on prefix b returned %v", streamed)
+			}
+		})
+	}
+
+}
+
+func TestMemoryStorageVersions(t *testing.T) {
+
+	storage := MemoryStorageNew(2)
+	for _, val := range []string{"v1", "v2", "v3"} {
+		if err := storage.Set([]byte("k"), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if val, err := storage.Get([]byte("k")); err != nil || string(val) != "v3" {
+		t.Fatalf("Get returned %q, %v, expecting the latest version", val, err)
+	}
+
+	versions := []string{}
+	storage.Iterate([]byte("k"), func(_ []byte, val []byte) error {
+		versions = append(versions, string(val))
+		return nil
+	})
+	if fmt.Sprint(versions) != "[v3 v2]" {
+		t.Fatalf("Iterate returned the versions %v, expecting the 2 latest", versions)
+	}
+
+}
+
+func TestBatchReplace(t *testing.T) {
+
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+	storages["memory versions"] = MemoryStorageNew(10)
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			for _, val := range []string{"v1", "v2"} {
+				if err := storage.Set([]byte("k"), []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			batch := storage.NewBatch()
+			if err := batch.Replace([]byte("k"), []byte("v3")); err != nil {
+				t.Fatal(err)
+			}
+			if err := batch.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Set([]byte("k"), []byte("v4")); err != nil {
+				t.Fatal(err)
+			}
+
+			versions := []string{}
+			storage.Iterate([]byte("k"), func(_ []byte, val []byte) error {
+				versions = append(versions, string(val))
+				return nil
+			})
+			streamed := []string{}
+			storage.Stream([]byte("k"), 1, func(_ []byte, values [][]byte) error {
+				for _, val := range values {
+					streamed = append(streamed, string(val))
+				}
+				return nil
+			})
+
+			// the versions older than v3 are dropped
+			expected := "[v4 v3]"
+			if name == "memory" {
+				expected = "[v4]"
+			}
+			if fmt.Sprint(versions) != expected || fmt.Sprint(streamed) != expected {
+				t.Fatalf("Iterate %v and Stream %v after a replace, expecting %s", versions, streamed, expected)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"fmt"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// addProtein stores a protein and its kmers, with -dedup the kmers are only added
+// to the representative of the identical sequences (see MergeDuplicates)
+func (input *inputContext) addProtein(proteinId []byte, protein *kvstore.Protein) error {
+
+	kvStores := input.kvStores
+
+	if err := kvStores.ProteinStore.AddProteinToChannel(proteinId, protein); err != nil {
+		return err
+	}
+
+	if input.dedup {
+		kvStores.ProteinStore.AddValueToChannel(kvstore.DuplicateKey(protein.Sequence, proteinId), []byte{}, false)
+		return nil
+	}
+
+	addKmers(kvStores, proteinId, protein.Sequence)
+
+	return nil
+
+}
+
+// addKmers adds the kmers of a protein sequence to the KmerStore channel
+func addKmers(kvStores *kvstore.KVStores, proteinId []byte, sequence string) {
+
+	kmerSize := kvStores.KmerStore.KmerSize()
+
+	// sliding windows of kmerSize on Sequence
+	for i := 0; i < len(sequence)-kmerSize+1; i++ {
+		kmerKey := kvStores.KmerStore.CreateBytesKey(sequence[i : i+kmerSize])
+		kvStores.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
+	}
+
+}
+
+// MergeDuplicates keeps the smallest protein id of the identical sequences as their representative
+// (the one with kmers), moves the others into its members and adds the deduplication ratio to the database stats
+func MergeDuplicates(kvStores *kvstore.KVStores) error {
+
+	fmt.Println("# Merging duplicated sequences into their representative protein")
+
+	kStats, err := kvStores.GetStats()
+	if err != nil {
+		return err
+	}
+
+	// the proteins were counted by the input readers
+	kmerSize := kvStores.KmerStore.KmerSize()
+	kvStores.KmerStore.OpenInsertChannel()
+	err = kvStores.ProteinStore.SplitDuplicates(func(proteinId []byte, sequence string) error {
+		addKmers(kvStores, proteinId, sequence)
+		return nil
+	}, func(member *kvstore.Protein) {
+		kStats.NumberOfProteins--
+		kStats.NumberOfAA -= uint64(member.Length)
+		kStats.NumberOfKmers -= uint64(int(member.Length) - kmerSize + 1)
+	})
+	if closeErr := kvStores.KmerStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	nbOfDuplicates, err := kvStores.ProteinStore.MergeMembers()
+	if err != nil {
+		return err
+	}
+
+	kStats.NumberOfDuplicates = nbOfDuplicates
+	if nbOfProteins := kStats.NumberOfProteins + nbOfDuplicates; nbOfProteins > 0 {
+		kStats.DedupRatio = float64(nbOfDuplicates) / float64(nbOfProteins)
+	}
+	if err := kvStores.SaveStats(kStats); err != nil {
+		return err
+	}
+
+	fmt.Printf("# %d duplicated sequences (dedup ratio %.4f)\n", nbOfDuplicates, kStats.DedupRatio)
+
+	return nil
+
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// FASTA header templates (-header) : regular expressions matched against the header (without >),
+// the EntryId named group is the protein EntryId and the other named groups are its features
+type FastaHeader struct {
+	templates []*regexp.Regexp
+	features  []string
+}
+
+// Built-in header dialects
+var FastaHeaderDialects = map[string]string{
+	// >P12345 protein name
+	"plain": `^(?P<EntryId>\S+)(?:\s+(?P<ProteinName>.*))?$`,
+	// >sp|P12345|NAME_ECOLI protein name OS=Escherichia coli (strain K12) OX=83333 GN=name PE=1 SV=1
+	"uniprot": `^(?:sp|tr)\|[^|]+\|(?P<EntryId>\S+)\s+(?P<ProteinName>.*?)\s+OS=(?P<Organism>.*?)\s+OX=(?P<TaxId>\d+)(?:\s+GN=(?P<GeneName>\S+))?(?:\s+PE=\d)?(?:\s+SV=\d+)?$`,
+	// >UniRef90_P12345 Cluster: protein name n=3 Tax=Escherichia coli TaxID=562 RepID=NAME_ECOLI
+	"uniref": `^(?P<EntryId>UniRef\S+)\s+(?:Cluster:\s*)?(?P<ProteinName>.*?)\s+n=\d+\s+Tax=(?P<Organism>.*?)\s+TaxID=(?P<TaxId>\d+)\s+RepID=\S+$`,
+	// >WP_000001.1 protein name [Escherichia coli]
+	"ncbi": `^(?P<EntryId>\S+)\s+(?P<ProteinName>.*?)(?:\s+\[(?P<Organism>[^\[\]]+)\])?$`,
+}
+
+// NewFastaHeader returns the header templates of a dialect name, a regular expression
+// or a file with one dialect name or regular expression by line (tried in order).
+// The headers not matching any template are read as plain headers
+func NewFastaHeader(template string) (*FastaHeader, error) {
+
+	lines := []string{template}
+	if _, ok := FastaHeaderDialects[template]; !ok {
+		if file, err := os.Open(template); err == nil {
+			lines = []string{}
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+					lines = append(lines, line)
+				}
+			}
+			file.Close()
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if lines[len(lines)-1] != "plain" {
+		lines = append(lines, "plain")
+	}
+
+	h := &FastaHeader{}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		if dialect, ok := FastaHeaderDialects[line]; ok {
+			line = dialect
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, kvstore.BadFormatError("FASTA header template %s : %s", line, err.Error())
+		}
+		hasEntryId := false
+		for _, name := range re.SubexpNames() {
+			switch {
+			case name == "EntryId":
+				hasEntryId = true
+			case name != "" && !seen[name]:
+				seen[name] = true
+				h.features = append(h.features, name)
+			}
+		}
+		if !hasEntryId {
+			return nil, kvstore.BadFormatError("FASTA header template %s : no EntryId named group", line)
+		}
+		h.templates = append(h.templates, re)
+	}
+
+	return h, nil
+
+}
+
+// Features returns the features of the templates
+func (h *FastaHeader) Features() []string {
+	return h.features
+}
+
+// Parse returns the EntryId and the features of a header (without >) from the first matching template
+func (h *FastaHeader) Parse(header string) (string, map[string]string) {
+
+	entryId := ""
+	features := map[string]string{}
+
+	for _, re := range h.templates {
+		match := re.FindStringSubmatch(header)
+		if match == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name == "EntryId" {
+				entryId = match[i]
+			} else if name != "" && match[i] != "" {
+				features[name] = match[i]
+			}
+		}
+		break
+	}
+
+	return entryId, features
+
+}
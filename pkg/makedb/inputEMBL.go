@@ -17,87 +17,74 @@ limitations under the License.
 package makedb
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
-	"log"
-	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
 type ProteinBufEMBL struct {
 	proteinId    uint
 	proteinEntry string
+	cds          *cdsNT // CDS of a nucleotide record
 }
 
 var (
 	EMBL_DEF_FTS = []string{"ProteinName", "GeneName", "EC", "GO", "KEGG_ID", "BioCyc_ID", "HAMAP", "Organism", "TaxId", "FullTaxonomy"}
 )
 
-func runEMBL(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset uint, length uint) int {
+func runEMBL(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
 
-	file, err := os.Open(fileName)
+	scanner, closeFile, err := openInputScanner(fileName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return proteinNb, nil, err
 	}
-
-	defer file.Close()
+	defer closeFile()
 
 	jobs := make(chan ProteinBufEMBL)
 	results := make(chan int32, 10)
 	wg := new(sync.WaitGroup)
+	errs := new(firstError)
 
 	// thread pool
-	for w := 1; w <= nbThreads; w++ {
+	for w := 1; w <= input.nbThreads; w++ {
 		wg.Add(1)
-		go readBufferEMBL(jobs, results, wg, kvStores)
+		go readBufferEMBL(jobs, results, wg, input, errs)
 	}
 
-	// Go over a file line by line and queue up a ton of work
+	// Go over a file line by line and queue up a ton of work,
+	// the nucleotide records are read whole and queued CDS by CDS
+	nucleotide := false
 	go func() {
-		proteinNb := uint(0)
 		lastProtein := offset + length
 
-		buff := make([]byte, 512)
-		_, err = file.Read(buff)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		filetype := http.DetectContentType(buff)
-		file.Seek(0, 0)
-
-		var scanner *bufio.Scanner
-
-		if filetype == "application/x-gzip" {
-			reader, err := gzip.NewReader(file)
-			if err != nil {
-				log.Fatal(err)
-			}
-			scanner = bufio.NewScanner(reader)
-		} else {
-			reader := bufio.NewReader(file)
-			scanner = bufio.NewScanner(reader)
-		}
-
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
-
 		proteinEntry := ""
+		isNucleotide := false
 		line := ""
 
+	scan:
 		for scanner.Scan() {
 			line = scanner.Text()
 			if line == "//" {
+				if isNucleotide {
+					for _, cds := range parseRecordNT(proteinEntry, true) {
+						proteinNb += 1
+						if proteinNb > offset {
+							jobs <- ProteinBufEMBL{proteinId: proteinNb, cds: cds}
+						}
+						if proteinNb >= lastProtein {
+							break scan
+						}
+					}
+					proteinEntry = ""
+					isNucleotide = false
+					continue
+				}
 				proteinNb += 1
 				if proteinNb >= lastProtein {
 					jobs <- ProteinBufEMBL{proteinId: proteinNb, proteinEntry: proteinEntry}
@@ -110,12 +97,19 @@ func runEMBL(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset
 					}
 				}
 			} else {
-				if proteinNb >= offset {
+				if proteinEntry == "" && isNucleotideEMBL(line) {
+					isNucleotide = true
+					nucleotide = true
+				}
+				if proteinNb >= offset || isNucleotide {
 					proteinEntry += line
 					proteinEntry += "\n"
 				}
 			}
 		}
+		if err := scanner.Err(); err != nil {
+			errs.set(err)
+		}
 		close(jobs)
 	}()
 
@@ -132,11 +126,13 @@ func runEMBL(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset
 	countAA := uint64(0)
 	countKmers := uint64(0)
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	wgGC := new(sync.WaitGroup)
 	for v := range results {
 		countProteins += 1
 		countAA += uint64(v)
-		countKmers += uint64(v) - KMER_SIZE + 1
+		countKmers += uint64(v) - uint64(kmerSize) + 1
 		if countProteins%10000 == 0 {
 			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
 		}
@@ -145,48 +141,61 @@ func runEMBL(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset
 			wgGC.Wait()
 			wgGC.Add(2)
 			go func() {
-				kvStores.KmerStore.GarbageCollect(10, 0.5)
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
 				wgGC.Done()
 			}()
 			go func() {
-				kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
 				wgGC.Done()
 			}()
 		}
 	}
 	wgGC.Wait()
 
-	// Add Stats to protein_store
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Stats of the added proteins
+	features := EMBL_DEF_FTS
+	if nucleotide {
+		features = NT_DEF_FTS
+	}
 	kstats := &kvstore.KStats{
 		NumberOfProteins:  countProteins,
 		NumberOfAA:        countAA,
 		NumberOfKmers:     countKmers,
 		NumberOfKCombSets: 0,
 
-		Features: EMBL_DEF_FTS,
+		Features: features,
 	}
-	data, err := proto.Marshal(kstats)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	kvStores.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
-
-	return 0
+	return proteinNb, kstats, nil
 
 }
 
-func readBufferEMBL(jobs <-chan ProteinBufEMBL, results chan<- int32, wg *sync.WaitGroup, kvStores *kvstore.KVStores) {
+func readBufferEMBL(jobs <-chan ProteinBufEMBL, results chan<- int32, wg *sync.WaitGroup, input *inputContext, errs *firstError) {
 
 	defer wg.Done()
 	// line by line
 	for j := range jobs {
-		processProteinInputEMBL(j, results, kvStores)
-		// results <- 1
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		var err error
+		if j.cds != nil {
+			err = processCDSInputNT(j.proteinId, j.cds, results, input)
+		} else {
+			err = processProteinInputEMBL(j, results, input)
+		}
+		if err != nil {
+			errs.set(err)
+		}
 	}
 
 }
 
-func processProteinInputEMBL(proteinBuf ProteinBufEMBL, results chan<- int32, kvStores *kvstore.KVStores) {
+func processProteinInputEMBL(proteinBuf ProteinBufEMBL, results chan<- int32, input *inputContext) error {
 
 	textEntry := proteinBuf.proteinEntry
 	protein := &kvstore.Protein{}
@@ -223,7 +232,7 @@ func processProteinInputEMBL(proteinBuf ProteinBufEMBL, results chan<- int32, kv
 				// protein.EC = strings.TrimRight(reg.ReplaceAllString(l[17:], "${1}"), ";")
 			} else if strings.Contains(l[5:], "Flags: Fragment;") {
 				// skipping protein fragments
-				return
+				return nil
 			}
 		case "OX":
 			taxId := strings.Fields(l[5:])[0][12:]
@@ -286,29 +295,23 @@ func processProteinInputEMBL(proteinBuf ProteinBufEMBL, results chan<- int32, kv
 		}
 	}
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	// skip peptide shorter than kmerSize
-	if protein.Length < KMER_SIZE {
-		return
+	if int(protein.Length) < kmerSize {
+		return nil
 	}
 
 	protein.Features = features
 
-	results <- protein.Length
-
 	proteinId := make([]byte, 4)
 	binary.BigEndian.PutUint32(proteinId, uint32(proteinBuf.proteinId))
 
-	data, err := proto.Marshal(protein)
-	if err != nil {
-		log.Fatal(err.Error())
-	} else {
-		kvStores.ProteinStore.AddValueToChannel(proteinId, data, false)
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
 	}
+	results <- protein.Length
 
-	// sliding windows of kmerSize on Sequence
-	for i := 0; i < int(protein.Length)-KMER_SIZE+1; i++ {
-		kmerKey := kvStores.KmerStore.CreateBytesKey(protein.Sequence[i : i+KMER_SIZE])
-		kvStores.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
-	}
+	return nil
 
 }
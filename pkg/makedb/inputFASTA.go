@@ -17,18 +17,12 @@ limitations under the License.
 package makedb
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
-	"log"
-	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
@@ -37,90 +31,67 @@ type ProteinBufFASTA struct {
 	proteinEntry string
 }
 
-var (
-	FASTA_DEF_FTS = []string{"ProteinName"}
-)
-
-func runFASTA(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset uint, length uint) int {
+func runFASTA(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
 
-	file, err := os.Open(fileName)
+	scanner, closeFile, err := openInputScanner(fileName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return proteinNb, nil, err
 	}
+	defer closeFile()
 
-	defer file.Close()
+	header := input.header
+	if header == nil {
+		if header, err = NewFastaHeader("plain"); err != nil {
+			return proteinNb, nil, err
+		}
+	}
 
 	jobs := make(chan ProteinBufFASTA)
 	results := make(chan int32, 10)
 	wg := new(sync.WaitGroup)
+	errs := new(firstError)
 
 	// thread pool
-	for w := 1; w <= nbThreads; w++ {
+	for w := 1; w <= input.nbThreads; w++ {
 		wg.Add(1)
-		go readBufferFASTA(jobs, results, wg, kvStores)
+		go readBufferFASTA(jobs, results, wg, input, header, errs)
 	}
 
-	// Go over a file line by line and queue up a ton of work
+	// Go over a file line by line and queue up a ton of work,
+	// an entry is numbered by its header and the entries from offset+1 to offset+length are queued
 	go func() {
-		proteinNb := uint(0)
 		lastProtein := offset + length
 
-		buff := make([]byte, 512)
-		_, err = file.Read(buff)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		filetype := http.DetectContentType(buff)
-		file.Seek(0, 0)
-
-		var scanner *bufio.Scanner
-
-		if filetype == "application/x-gzip" {
-			reader, err := gzip.NewReader(file)
-			if err != nil {
-				log.Fatal(err)
-			}
-			scanner = bufio.NewScanner(reader)
-		} else {
-			reader := bufio.NewReader(file)
-			scanner = bufio.NewScanner(reader)
-		}
-
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
-
 		proteinEntry := ""
 		line := ""
 
 		for scanner.Scan() {
 			line = scanner.Text()
-			if line[0:1] == ">" {
+			if line == "" {
+				continue
+			}
+			if line[0] == '>' {
+				if proteinEntry != "" {
+					jobs <- ProteinBufFASTA{proteinId: proteinNb, proteinEntry: proteinEntry}
+					proteinEntry = ""
+				}
 				proteinNb += 1
-				if proteinNb >= lastProtein {
-					if proteinEntry != "" {
-						jobs <- ProteinBufFASTA{proteinId: proteinNb, proteinEntry: proteinEntry}
-					}
+				if proteinNb > lastProtein {
 					break
 				}
-				if proteinNb >= offset {
-					if proteinEntry != "" {
-						jobs <- ProteinBufFASTA{proteinId: proteinNb, proteinEntry: proteinEntry}
-						proteinEntry = ""
-					}
-				}
 			}
 
-			if proteinNb >= offset {
+			if proteinNb > offset {
 				proteinEntry += line
 				proteinEntry += "\n"
 			}
 
 		}
-		if proteinNb >= offset {
-			if proteinEntry != "" {
-				jobs <- ProteinBufFASTA{proteinId: proteinNb, proteinEntry: proteinEntry}
-			}
+		if proteinEntry != "" {
+			jobs <- ProteinBufFASTA{proteinId: proteinNb, proteinEntry: proteinEntry}
+		}
+		if err := scanner.Err(); err != nil {
+			errs.set(err)
 		}
 		close(jobs)
 	}()
@@ -138,11 +109,13 @@ func runFASTA(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset
 	countAA := uint64(0)
 	countKmers := uint64(0)
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	wgGC := new(sync.WaitGroup)
 	for v := range results {
 		countProteins += 1
 		countAA += uint64(v)
-		countKmers += uint64(v) - KMER_SIZE + 1
+		countKmers += uint64(v) - uint64(kmerSize) + 1
 		if countProteins%10000 == 0 {
 			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
 		}
@@ -151,52 +124,55 @@ func runFASTA(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset
 			wgGC.Wait()
 			wgGC.Add(2)
 			go func() {
-				kvStores.KmerStore.GarbageCollect(10, 0.5)
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
 				wgGC.Done()
 			}()
 			go func() {
-				kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
 				wgGC.Done()
 			}()
 		}
 	}
 	wgGC.Wait()
 
-	// Add Stats to protein_store
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Stats of the added proteins
 	kstats := &kvstore.KStats{
 		NumberOfProteins:  countProteins,
 		NumberOfAA:        countAA,
 		NumberOfKmers:     countKmers,
 		NumberOfKCombSets: 0,
 
-		Features: FASTA_DEF_FTS,
-	}
-	data, err := proto.Marshal(kstats)
-	if err != nil {
-		log.Fatal(err.Error())
+		Features: header.Features(),
 	}
-	kvStores.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
-
-	return 0
+	return proteinNb, kstats, nil
 
 }
 
-func readBufferFASTA(jobs <-chan ProteinBufFASTA, results chan<- int32, wg *sync.WaitGroup, kvStores *kvstore.KVStores) {
+func readBufferFASTA(jobs <-chan ProteinBufFASTA, results chan<- int32, wg *sync.WaitGroup, input *inputContext, header *FastaHeader, errs *firstError) {
 
 	defer wg.Done()
 	// line by line
 	for j := range jobs {
-		processProteinInputFASTA(j, results, kvStores)
-		// results <- 1
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		if err := processProteinInputFASTA(j, results, input, header); err != nil {
+			errs.set(err)
+		}
 	}
 
 }
 
-func processProteinInputFASTA(proteinBuf ProteinBufFASTA, results chan<- int32, kvStores *kvstore.KVStores) {
+func processProteinInputFASTA(proteinBuf ProteinBufFASTA, results chan<- int32, input *inputContext, header *FastaHeader) error {
 
 	textEntry := proteinBuf.proteinEntry
 	protein := &kvstore.Protein{}
-	features := map[string]string{}
+	var features map[string]string
 
 	for _, l := range strings.Split(textEntry, "\n") {
 
@@ -206,10 +182,7 @@ func processProteinInputFASTA(proteinBuf ProteinBufFASTA, results chan<- int32,
 
 		switch l[0:1] {
 		case ">":
-			line := strings.TrimSuffix(l, "\n")
-			headerSplit := strings.Split(line, " ")
-			protein.EntryId = headerSplit[0][1:]
-			features["ProteinName"] = strings.Join(headerSplit[1:], " ")
+			protein.EntryId, features = header.Parse(strings.TrimSpace(l[1:]))
 		default:
 			protein.Sequence += strings.ToUpper(strings.TrimSuffix(l[0:], "\n"))
 		}
@@ -217,34 +190,28 @@ func processProteinInputFASTA(proteinBuf ProteinBufFASTA, results chan<- int32,
 	}
 
 	if strings.Contains(features["ProteinName"], ", partial") {
-		return
+		return nil
 	}
 
 	protein.Length = int32(len(protein.Sequence))
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	// skip peptide shorter than kmerSize
-	if protein.Length < KMER_SIZE {
-		return
+	if int(protein.Length) < kmerSize {
+		return nil
 	}
 
 	protein.Features = features
 
-	results <- protein.Length
-
 	proteinId := make([]byte, 4)
 	binary.BigEndian.PutUint32(proteinId, uint32(proteinBuf.proteinId))
 
-	data, err := proto.Marshal(protein)
-	if err != nil {
-		log.Fatal(err.Error())
-	} else {
-		kvStores.ProteinStore.AddValueToChannel(proteinId, data, false)
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
 	}
+	results <- protein.Length
 
-	// sliding windows of kmerSize on Sequence
-	for i := 0; i < int(protein.Length)-KMER_SIZE+1; i++ {
-		kmerKey := kvStores.KmerStore.CreateBytesKey(protein.Sequence[i : i+KMER_SIZE])
-		kvStores.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
-	}
+	return nil
 
 }
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// entryIds returns the EntryId of the proteins 1 to nb ("-" for missing ids)
+func entryIds(kvStores *kvstore.KVStores, nb int) string {
+	ids := []string{}
+	for i := 1; i <= nb; i++ {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, uint32(i))
+		prot, ok := kvStores.ProteinStore.GetProtein(proteinId, false)
+		if !ok {
+			ids = append(ids, "-")
+			continue
+		}
+		ids = append(ids, prot.EntryId)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestRunFASTAWindows(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "makedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{filepath.Join(dir, "a.fa"), filepath.Join(dir, "b.fa")}
+	entries := []string{"P1 P2 P3", "P4 P5"}
+	for i, file := range files {
+		content := ""
+		for _, entryId := range strings.Fields(entries[i]) {
+			content += fmt.Sprintf(">%s protein %s\nMKVLAAGIVGLLLAQ\n\n", entryId, entryId)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		offset   uint
+		length   uint
+		expected string
+	}{
+		{0, 10, "P1 P2 P3 P4 P5"},
+		{0, 2, "P1 P2 - - -"},
+		{2, 2, "- - P3 P4 -"},
+		{4, 10, "- - - - P5"},
+	}
+
+	for _, test := range tests {
+		kvStores := kvstore.KVStoresMemoryNew(1)
+		input := &inputContext{kvStores: kvStores, nbThreads: 2}
+		kvStores.OpenInsertChannel()
+		// the entries are numbered across the files
+		proteinNb := uint(0)
+		for _, file := range files {
+			if proteinNb >= test.offset+test.length {
+				break
+			}
+			if proteinNb, _, err = runFASTA(file, input, proteinNb, test.offset, test.length); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := kvStores.CloseInsertChannel(); err != nil {
+			t.Fatal(err)
+		}
+		if ids := entryIds(kvStores, 5); ids != test.expected {
+			t.Errorf("offset %d length %d : got %s, expecting %s", test.offset, test.length, ids, test.expected)
+		}
+	}
+
+}
@@ -17,86 +17,73 @@ limitations under the License.
 package makedb
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
-	"log"
-	"net/http"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
 type ProteinBufGBK struct {
 	proteinId    uint
 	proteinEntry string
+	cds          *cdsNT // CDS of a nucleotide record
 }
 
 var (
 	GBK_DEF_FTS = []string{"ProteinName", "Organism", "FullTaxonomy"}
 )
 
-func runGBK(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset uint, length uint) int {
+func runGBK(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
 
-	file, err := os.Open(fileName)
+	scanner, closeFile, err := openInputScanner(fileName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return proteinNb, nil, err
 	}
-
-	defer file.Close()
+	defer closeFile()
 
 	jobs := make(chan ProteinBufGBK)
 	results := make(chan int32, 10)
 	wg := new(sync.WaitGroup)
+	errs := new(firstError)
 
 	// thread pool
-	for w := 1; w <= nbThreads; w++ {
+	for w := 1; w <= input.nbThreads; w++ {
 		wg.Add(1)
-		go readBufferGBK(jobs, results, wg, kvStores)
+		go readBufferGBK(jobs, results, wg, input, errs)
 	}
 
-	// Go over a file line by line and queue up a ton of work
+	// Go over a file line by line and queue up a ton of work,
+	// the nucleotide records are read whole and queued CDS by CDS
+	nucleotide := false
 	go func() {
-		proteinNb := uint(0)
 		lastProtein := offset + length
 
-		buff := make([]byte, 512)
-		_, err = file.Read(buff)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		filetype := http.DetectContentType(buff)
-		file.Seek(0, 0)
-
-		var scanner *bufio.Scanner
-
-		if filetype == "application/x-gzip" {
-			reader, err := gzip.NewReader(file)
-			if err != nil {
-				log.Fatal(err)
-			}
-			scanner = bufio.NewScanner(reader)
-		} else {
-			reader := bufio.NewReader(file)
-			scanner = bufio.NewScanner(reader)
-		}
-
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
-
 		proteinEntry := ""
+		isNucleotide := false
 		line := ""
 
+	scan:
 		for scanner.Scan() {
 			line = scanner.Text()
 			if line == "//" {
+				if isNucleotide {
+					for _, cds := range parseRecordNT(proteinEntry, false) {
+						proteinNb += 1
+						if proteinNb > offset {
+							jobs <- ProteinBufGBK{proteinId: proteinNb, cds: cds}
+						}
+						if proteinNb >= lastProtein {
+							break scan
+						}
+					}
+					proteinEntry = ""
+					isNucleotide = false
+					continue
+				}
 				proteinNb += 1
 				if proteinNb >= lastProtein {
 					jobs <- ProteinBufGBK{proteinId: proteinNb, proteinEntry: proteinEntry}
@@ -109,12 +96,19 @@ func runGBK(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 					}
 				}
 			} else {
-				if proteinNb >= offset {
+				if proteinEntry == "" && isNucleotideGBK(line) {
+					isNucleotide = true
+					nucleotide = true
+				}
+				if proteinNb >= offset || isNucleotide {
 					proteinEntry += line
 					proteinEntry += "\n"
 				}
 			}
 		}
+		if err := scanner.Err(); err != nil {
+			errs.set(err)
+		}
 		close(jobs)
 	}()
 
@@ -131,11 +125,13 @@ func runGBK(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 	countAA := uint64(0)
 	countKmers := uint64(0)
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	wgGC := new(sync.WaitGroup)
 	for v := range results {
 		countProteins += 1
 		countAA += uint64(v)
-		countKmers += uint64(v) - KMER_SIZE + 1
+		countKmers += uint64(v) - uint64(kmerSize) + 1
 		if countProteins%10000 == 0 {
 			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
 		}
@@ -144,48 +140,61 @@ func runGBK(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 			wgGC.Wait()
 			wgGC.Add(2)
 			go func() {
-				kvStores.KmerStore.GarbageCollect(10, 0.5)
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
 				wgGC.Done()
 			}()
 			go func() {
-				kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
 				wgGC.Done()
 			}()
 		}
 	}
 	wgGC.Wait()
 
-	// Add Stats to protein_store
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Stats of the added proteins
+	features := GBK_DEF_FTS
+	if nucleotide {
+		features = NT_DEF_FTS
+	}
 	kstats := &kvstore.KStats{
 		NumberOfProteins:  countProteins,
 		NumberOfAA:        countAA,
 		NumberOfKmers:     countKmers,
 		NumberOfKCombSets: 0,
 
-		Features: GBK_DEF_FTS,
+		Features: features,
 	}
-	data, err := proto.Marshal(kstats)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	kvStores.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
-
-	return 0
+	return proteinNb, kstats, nil
 
 }
 
-func readBufferGBK(jobs <-chan ProteinBufGBK, results chan<- int32, wg *sync.WaitGroup, kvStores *kvstore.KVStores) {
+func readBufferGBK(jobs <-chan ProteinBufGBK, results chan<- int32, wg *sync.WaitGroup, input *inputContext, errs *firstError) {
 
 	defer wg.Done()
 	// line by line
 	for j := range jobs {
-		processProteinInputGBK(j, results, kvStores)
-		// results <- 1
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		var err error
+		if j.cds != nil {
+			err = processCDSInputNT(j.proteinId, j.cds, results, input)
+		} else {
+			err = processProteinInputGBK(j, results, input)
+		}
+		if err != nil {
+			errs.set(err)
+		}
 	}
 
 }
 
-func processProteinInputGBK(proteinBuf ProteinBufGBK, results chan<- int32, kvStores *kvstore.KVStores) {
+func processProteinInputGBK(proteinBuf ProteinBufGBK, results chan<- int32, input *inputContext) error {
 
 	textEntry := proteinBuf.proteinEntry
 	protein := &kvstore.Protein{}
@@ -266,36 +275,30 @@ func processProteinInputGBK(proteinBuf ProteinBufGBK, results chan<- int32, kvSt
 	}
 
 	if strings.Contains(features["ProteinName"], ", partial") {
-		return
+		return nil
 	}
 
 	protein.Length = int32(len(protein.Sequence))
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	// skip peptide shorter than kmerSize
-	if protein.Length < KMER_SIZE {
-		return
+	if int(protein.Length) < kmerSize {
+		return nil
 	}
 
 	reg := regexp.MustCompile(` \[.*\]\.`)
 	features["ProteinName"] = reg.ReplaceAllString(features["ProteinName"], "${1}")
 	protein.Features = features
 
-	results <- protein.Length
-
 	proteinId := make([]byte, 4)
 	binary.BigEndian.PutUint32(proteinId, uint32(proteinBuf.proteinId))
 
-	data, err := proto.Marshal(protein)
-	if err != nil {
-		log.Fatal(err.Error())
-	} else {
-		kvStores.ProteinStore.AddValueToChannel(proteinId, data, false)
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
 	}
+	results <- protein.Length
 
-	// sliding windows of kmerSize on Sequence
-	for i := 0; i < int(protein.Length)-KMER_SIZE+1; i++ {
-		kmerKey := kvStores.KmerStore.CreateBytesKey(protein.Sequence[i : i+KMER_SIZE])
-		kvStores.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
-	}
+	return nil
 
 }
@@ -0,0 +1,442 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/search"
+)
+
+// CDS feature of a GFF3 file, the CDS lines sharing an ID (or a Parent) are the parts of one protein
+type ProteinBufGFF3 struct {
+	proteinId   uint
+	seqId       string
+	minusStrand bool
+	parts       []cdsPartGFF3
+	attributes  map[string]string
+}
+
+type cdsPartGFF3 struct {
+	start int // 1-based
+	end   int // inclusive
+	phase int
+}
+
+var (
+	GFF3_DEF_FTS = []string{"ProteinName", "GeneName", "EC", "Dbxref", "TaxId"}
+
+	// extensions of the nucleotide FASTA file next to a GFF3 file (same name)
+	companionFASTAExts = []string{".fna", ".fa", ".fasta", ".fas"}
+)
+
+func runGFF3(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
+
+	cdsList, sequences, taxIds, err := readGFF3(fileName)
+	if err != nil {
+		return proteinNb, nil, err
+	}
+
+	if len(sequences) == 0 {
+		fastaFile := companionFASTA(fileName)
+		if fastaFile == "" {
+			return proteinNb, nil, kvstore.BadFormatError("%s : no ##FASTA section and no companion FASTA file (%s)", fileName, strings.Join(companionFASTAExts, ", "))
+		}
+		fmt.Printf("# Using sequences of %s\n", fastaFile)
+		if sequences, err = readNucleotideFASTA(fastaFile); err != nil {
+			return proteinNb, nil, err
+		}
+	}
+
+	jobs := make(chan *ProteinBufGFF3)
+	results := make(chan int32, 10)
+	wg := new(sync.WaitGroup)
+	errs := new(firstError)
+
+	// thread pool
+	for w := 1; w <= input.nbThreads; w++ {
+		wg.Add(1)
+		go readBufferGFF3(jobs, results, wg, input, sequences, taxIds, errs)
+	}
+
+	// Queue up the CDS features in file order
+	go func() {
+		lastProtein := offset + length
+		for _, cds := range cdsList {
+			proteinNb += 1
+			if proteinNb > offset {
+				cds.proteinId = proteinNb
+				jobs <- cds
+			}
+			if proteinNb >= lastProtein {
+				break
+			}
+		}
+		close(jobs)
+	}()
+
+	// Collect all the results...
+	// First, make sure we close the result channel when everything was processed
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Now, add up the results from the results channel until closed
+	timeStart := time.Now()
+	countProteins := uint64(0)
+	countAA := uint64(0)
+	countKmers := uint64(0)
+
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
+	wgGC := new(sync.WaitGroup)
+	for v := range results {
+		countProteins += 1
+		countAA += uint64(v)
+		countKmers += uint64(v) - uint64(kmerSize) + 1
+		if countProteins%10000 == 0 {
+			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
+		}
+		// Valuelog GC every 100K processed proteins
+		if countProteins%1000000 == 0 {
+			wgGC.Wait()
+			wgGC.Add(2)
+			go func() {
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
+				wgGC.Done()
+			}()
+			go func() {
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				wgGC.Done()
+			}()
+		}
+	}
+	wgGC.Wait()
+
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Stats of the added proteins
+	kstats := &kvstore.KStats{
+		NumberOfProteins:  countProteins,
+		NumberOfAA:        countAA,
+		NumberOfKmers:     countKmers,
+		NumberOfKCombSets: 0,
+
+		Features: GFF3_DEF_FTS,
+	}
+	return proteinNb, kstats, nil
+
+}
+
+// readGFF3 returns the CDS features in file order, the sequences of the ##FASTA section
+// and the TaxIds of the sequence regions (Dbxref=taxon:x)
+func readGFF3(fileName string) ([]*ProteinBufGFF3, map[string]string, map[string]string, error) {
+
+	scanner, closeFile, err := openInputScanner(fileName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer closeFile()
+
+	cdsList := []*ProteinBufGFF3{}
+	cdsIds := make(map[string]*ProteinBufGFF3)
+	taxIds := make(map[string]string)
+	lineNb := 0
+
+	for scanner.Scan() {
+		lineNb++
+		line := scanner.Text()
+		if line == "##FASTA" {
+			sequences, err := scanNucleotideFASTA(scanner)
+			return cdsList, sequences, taxIds, err
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9 {
+			return nil, nil, nil, kvstore.BadFormatError("%s line %d : expecting 9 columns", fileName, lineNb)
+		}
+
+		switch fields[2] {
+		case "region":
+			for _, dbxref := range strings.Split(parseGFF3Attributes(fields[8])["Dbxref"], ";") {
+				if strings.HasPrefix(dbxref, "taxon:") {
+					taxIds[fields[0]] = strings.TrimPrefix(dbxref, "taxon:")
+				}
+			}
+		case "CDS":
+			start, errStart := strconv.Atoi(fields[3])
+			end, errEnd := strconv.Atoi(fields[4])
+			if errStart != nil || errEnd != nil || start < 1 || end < start {
+				return nil, nil, nil, kvstore.BadFormatError("%s line %d : bad CDS location %s..%s", fileName, lineNb, fields[3], fields[4])
+			}
+			phase, err := strconv.Atoi(fields[7])
+			if err != nil {
+				phase = 0
+			}
+			attributes := parseGFF3Attributes(fields[8])
+			if attributes["pseudo"] == "true" {
+				continue
+			}
+			part := cdsPartGFF3{start: start, end: end, phase: phase}
+
+			cdsId := attributes["ID"]
+			if cdsId == "" {
+				cdsId = attributes["Parent"]
+			}
+			if cds, ok := cdsIds[fields[0]+"\t"+cdsId]; ok && cdsId != "" {
+				cds.parts = append(cds.parts, part)
+				continue
+			}
+			cds := &ProteinBufGFF3{
+				seqId:       fields[0],
+				minusStrand: fields[6] == "-",
+				parts:       []cdsPartGFF3{part},
+				attributes:  attributes,
+			}
+			cdsIds[fields[0]+"\t"+cdsId] = cds
+			cdsList = append(cdsList, cds)
+		}
+	}
+
+	return cdsList, nil, taxIds, scanner.Err()
+
+}
+
+// parseGFF3Attributes decodes the column 9 attributes, multiple values are separated by ;
+func parseGFF3Attributes(column string) map[string]string {
+
+	attributes := make(map[string]string)
+
+	for _, attribute := range strings.Split(column, ";") {
+		keyVal := strings.SplitN(strings.TrimSpace(attribute), "=", 2)
+		if len(keyVal) != 2 {
+			continue
+		}
+		values := strings.Split(keyVal[1], ",")
+		for i, value := range values {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				values[i] = unescaped
+			}
+		}
+		attributes[keyVal[0]] = strings.Join(values, ";")
+	}
+
+	return attributes
+
+}
+
+// withoutCompanionFASTA removes the nucleotide FASTA files from the GFF3 inputs (ex. the files of a directory)
+func withoutCompanionFASTA(files []string) []string {
+
+	gff3Files := []string{}
+	for _, fileName := range files {
+		ext := filepath.Ext(strings.TrimSuffix(fileName, ".gz"))
+		companion := false
+		for _, fastaExt := range companionFASTAExts {
+			if ext == fastaExt {
+				companion = true
+			}
+		}
+		if !companion {
+			gff3Files = append(gff3Files, fileName)
+		}
+	}
+
+	return gff3Files
+
+}
+
+// companionFASTA returns the nucleotide FASTA file with the name of the GFF3 file, if any
+func companionFASTA(fileName string) string {
+
+	baseName := strings.TrimSuffix(fileName, ".gz")
+	for _, ext := range []string{".gff3", ".gff"} {
+		baseName = strings.TrimSuffix(baseName, ext)
+	}
+
+	for _, ext := range companionFASTAExts {
+		for _, gz := range []string{"", ".gz"} {
+			if _, err := os.Stat(baseName + ext + gz); err == nil {
+				return baseName + ext + gz
+			}
+		}
+	}
+
+	return ""
+
+}
+
+func readNucleotideFASTA(fileName string) (map[string]string, error) {
+
+	scanner, closeFile, err := openInputScanner(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+
+	return scanNucleotideFASTA(scanner)
+
+}
+
+// scanNucleotideFASTA reads the sequences by id (header up to the first space)
+func scanNucleotideFASTA(scanner *bufio.Scanner) (map[string]string, error) {
+
+	sequences := make(map[string]string)
+	seqId := ""
+	var sequence strings.Builder
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '>' {
+			if seqId != "" {
+				sequences[seqId] = sequence.String()
+			}
+			seqId = strings.Fields(line[1:] + " ")[0]
+			sequence.Reset()
+			continue
+		}
+		sequence.WriteString(line)
+	}
+	if seqId != "" {
+		sequences[seqId] = sequence.String()
+	}
+
+	return sequences, scanner.Err()
+
+}
+
+func readBufferGFF3(jobs <-chan *ProteinBufGFF3, results chan<- int32, wg *sync.WaitGroup, input *inputContext, sequences map[string]string, taxIds map[string]string, errs *firstError) {
+
+	defer wg.Done()
+	// CDS by CDS
+	for j := range jobs {
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		if err := processProteinInputGFF3(j, results, input, sequences, taxIds); err != nil {
+			errs.set(err)
+		}
+	}
+
+}
+
+func processProteinInputGFF3(cds *ProteinBufGFF3, results chan<- int32, input *inputContext, sequences map[string]string, taxIds map[string]string) error {
+
+	seq, ok := sequences[cds.seqId]
+	if !ok {
+		return kvstore.BadFormatError("no sequence for %s", cds.seqId)
+	}
+
+	// parts in transcription order
+	parts := cds.parts
+	sort.Slice(parts, func(i, j int) bool { return parts[i].start < parts[j].start })
+	if cds.minusStrand {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].start > parts[j].start })
+	}
+
+	var dna strings.Builder
+	for _, part := range parts {
+		if part.end > len(seq) {
+			return kvstore.BadFormatError("CDS %d..%d outside of %s", part.start, part.end, cds.seqId)
+		}
+		if cds.minusStrand {
+			dna.WriteString(search.ReverseComplement(seq[part.start-1 : part.end]))
+		} else {
+			dna.WriteString(seq[part.start-1 : part.end])
+		}
+	}
+
+	// the phase of the first part skips the bases of a codon started upstream
+	cdsSeq := dna.String()
+	phase := parts[0].phase
+	if phase > 0 && phase < len(cdsSeq) {
+		cdsSeq = cdsSeq[phase:]
+	}
+
+	geneticCode := 11
+	if table, err := strconv.Atoi(cds.attributes["transl_table"]); err == nil {
+		geneticCode = table
+	}
+	complete := phase == 0 && cds.attributes["partial"] != "true" && cds.attributes["start_range"] == ""
+
+	protein := &kvstore.Protein{}
+	var err error
+	if protein.Sequence, err = search.TranslateCDS(cdsSeq, geneticCode, complete); err != nil {
+		return kvstore.BadFormatError("CDS %s : %s", cds.attributes["ID"], err.Error())
+	}
+	protein.Length = int32(len(protein.Sequence))
+
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
+	// skip peptide shorter than kmerSize
+	if int(protein.Length) < kmerSize {
+		return nil
+	}
+
+	for _, attribute := range []string{"protein_id", "ID", "Name", "locus_tag"} {
+		if protein.EntryId = cds.attributes[attribute]; protein.EntryId != "" {
+			break
+		}
+	}
+
+	features := map[string]string{}
+	for feature, attribute := range map[string]string{"ProteinName": "product", "GeneName": "gene", "EC": "ec_number", "Dbxref": "Dbxref"} {
+		if value := cds.attributes[attribute]; value != "" {
+			features[feature] = value
+		}
+	}
+	if features["EC"] == "" && cds.attributes["eC_number"] != "" {
+		// Prokka spelling
+		features["EC"] = cds.attributes["eC_number"]
+	}
+	if taxId, ok := taxIds[cds.seqId]; ok {
+		features["TaxId"] = taxId
+	}
+	protein.Features = features
+
+	proteinId := make([]byte, 4)
+	binary.BigEndian.PutUint32(proteinId, uint32(cds.proteinId))
+
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
+	}
+	results <- protein.Length
+
+	return nil
+
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/search"
+)
+
+// Nucleotide (genome) records of the GenBank and EMBL input formats,
+// the proteins are their CDS features (/translation or translated from the record sequence)
+
+var (
+	NT_DEF_FTS = []string{"ProteinName", "GeneName", "EC", "Organism", "TaxId", "FullTaxonomy"}
+)
+
+// recordNT is a nucleotide record shared by its CDS
+type recordNT struct {
+	accession string
+	organism  string
+	taxonomy  string
+	taxId     string
+	sequence  string
+}
+
+// cdsNT is a CDS feature of a nucleotide record
+type cdsNT struct {
+	record     *recordNT
+	index      int // CDS number in the record
+	location   string
+	qualifiers map[string]string
+}
+
+// locationSegment is a range of a feature location (1-based, inclusive)
+type locationSegment struct {
+	start, end  int
+	minus       bool
+	lowPartial  bool // <start
+	highPartial bool // >end
+}
+
+// partialStart tells if the 5' end of the segment is partial
+func (s locationSegment) partialStart() bool {
+	if s.minus {
+		return s.highPartial
+	}
+	return s.lowPartial
+}
+
+// isNucleotideGBK tells if a GenBank LOCUS line is a nucleotide record (bp) rather than a GenPept one (aa)
+func isNucleotideGBK(locusLine string) bool {
+	return strings.HasPrefix(locusLine, "LOCUS") && strings.Contains(locusLine, " bp ")
+}
+
+// isNucleotideEMBL tells if an EMBL ID line is a nucleotide record (BP.) rather than a UniProt one (AA.)
+func isNucleotideEMBL(idLine string) bool {
+	return strings.HasPrefix(idLine, "ID ") && strings.HasSuffix(strings.TrimSpace(idLine), "BP.")
+}
+
+// parseRecordNT reads a GenBank or EMBL nucleotide record (without the // line) and returns its CDS features
+func parseRecordNT(entry string, embl bool) []*cdsNT {
+
+	record := &recordNT{}
+	cdsList := []*cdsNT{}
+
+	var sequence strings.Builder
+	var cds *cdsNT
+	qualifier := "" // qualifier with an open quoted value
+	section := ""   // FEATURES, ORGANISM or ORIGIN
+	inSource := false
+
+	for _, l := range strings.Split(entry, "\n") {
+
+		if embl {
+			// EMBL lines as GenBank ones : feature table with 5 and 21 columns indentation
+			if len(l) < 2 {
+				continue
+			}
+			switch l[0:2] {
+			case "ID":
+				if fields := strings.Fields(l[2:]); len(fields) > 0 {
+					record.accession = strings.TrimSuffix(fields[0], ";")
+				}
+				continue
+			case "OS":
+				record.organism = strings.TrimSpace(record.organism + " " + strings.TrimSpace(l[2:]))
+				continue
+			case "OC":
+				record.taxonomy = strings.TrimSpace(record.taxonomy + " " + strings.TrimSpace(l[2:]))
+				continue
+			case "FH":
+				continue
+			case "FT":
+				section = "FEATURES"
+				l = "  " + l[2:]
+			case "SQ":
+				section = "ORIGIN"
+				continue
+			case "  ":
+			default:
+				section = ""
+				continue
+			}
+		} else if len(l) > 0 && l[0] != ' ' {
+			section = strings.Fields(l)[0]
+			if section == "VERSION" && len(strings.Fields(l)) > 1 {
+				record.accession = strings.Fields(l)[1]
+			}
+			continue
+		} else if strings.HasPrefix(l, "  ORGANISM") {
+			section = "ORGANISM"
+			record.organism = strings.TrimSpace(l[10:])
+			continue
+		}
+
+		switch section {
+		case "ORGANISM":
+			if strings.TrimSpace(l) != "" {
+				record.taxonomy = strings.TrimSpace(record.taxonomy + " " + strings.TrimSpace(l))
+			}
+		case "FEATURES":
+			if len(l) < 21 {
+				continue
+			}
+			if l[5] != ' ' {
+				// new feature : key and location
+				fields := strings.Fields(l)
+				cds = nil
+				qualifier = ""
+				inSource = fields[0] == "source"
+				if fields[0] == "CDS" && len(fields) > 1 {
+					cds = &cdsNT{record: record, index: len(cdsList) + 1, location: fields[1], qualifiers: map[string]string{}}
+					cdsList = append(cdsList, cds)
+				}
+				continue
+			}
+			value := strings.TrimSpace(l[21:])
+			if qualifier != "" {
+				// continued quoted value
+				closed := strings.HasSuffix(value, "\"")
+				value = strings.TrimSuffix(value, "\"")
+				if cds != nil && qualifier == "translation" {
+					cds.qualifiers[qualifier] += value
+				} else if cds != nil {
+					cds.qualifiers[qualifier] += " " + value
+				}
+				if closed {
+					qualifier = ""
+				}
+				continue
+			}
+			if !strings.HasPrefix(value, "/") {
+				// continued location
+				if cds != nil {
+					cds.location += value
+				}
+				continue
+			}
+			nameVal := strings.SplitN(value[1:], "=", 2)
+			name, val := nameVal[0], ""
+			if len(nameVal) == 2 {
+				val = nameVal[1]
+				if strings.HasPrefix(val, "\"") {
+					val = val[1:]
+					if strings.HasSuffix(val, "\"") {
+						val = strings.TrimSuffix(val, "\"")
+					} else {
+						qualifier = name
+					}
+				}
+			}
+			if inSource && name == "db_xref" && strings.HasPrefix(val, "taxon:") && record.taxId == "" {
+				record.taxId = strings.TrimPrefix(val, "taxon:")
+			}
+			if cds != nil {
+				if _, ok := cds.qualifiers[name]; ok {
+					// repeated qualifier (EC_number, db_xref)
+					cds.qualifiers[name] += ";" + val
+				} else {
+					cds.qualifiers[name] = val
+				}
+			}
+		case "ORIGIN":
+			for _, c := range l {
+				if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+					sequence.WriteRune(c)
+				}
+			}
+		}
+	}
+
+	record.sequence = sequence.String()
+	record.taxonomy = strings.TrimSpace(record.taxonomy)
+
+	return cdsList
+
+}
+
+// parseLocation returns the segments of a feature location in transcription order
+// (complement, join and order operators, < and > partial ends), false for unsupported locations (remote entries)
+func parseLocation(location string) ([]locationSegment, bool) {
+
+	location = strings.TrimSpace(location)
+
+	if strings.HasPrefix(location, "complement(") && strings.HasSuffix(location, ")") {
+		inner, ok := parseLocation(location[len("complement(") : len(location)-1])
+		if !ok {
+			return nil, false
+		}
+		segments := make([]locationSegment, len(inner))
+		for i, s := range inner {
+			s.minus = !s.minus
+			segments[len(inner)-1-i] = s
+		}
+		return segments, true
+	}
+
+	for _, operator := range []string{"join(", "order("} {
+		if strings.HasPrefix(location, operator) && strings.HasSuffix(location, ")") {
+			segments := []locationSegment{}
+			for _, part := range splitLocation(location[len(operator) : len(location)-1]) {
+				inner, ok := parseLocation(part)
+				if !ok {
+					return nil, false
+				}
+				segments = append(segments, inner...)
+			}
+			return segments, true
+		}
+	}
+
+	if strings.ContainsAny(location, ":(^") {
+		return nil, false
+	}
+
+	lowPartial := strings.HasPrefix(location, "<")
+	highPartial := strings.Contains(location, ">")
+	positions := strings.Split(strings.NewReplacer("<", "", ">", "").Replace(location), "..")
+	start, err := strconv.Atoi(positions[0])
+	if err != nil {
+		return nil, false
+	}
+	end := start
+	if len(positions) == 2 {
+		if end, err = strconv.Atoi(positions[1]); err != nil {
+			return nil, false
+		}
+	}
+	if start < 1 || end < start {
+		return nil, false
+	}
+
+	return []locationSegment{{start: start, end: end, lowPartial: lowPartial, highPartial: highPartial}}, true
+
+}
+
+// splitLocation splits the comma separated locations of a join (nested parentheses kept)
+func splitLocation(locations string) []string {
+
+	parts := []string{}
+	depth, last := 0, 0
+	for i, c := range locations {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, locations[last:i])
+				last = i + 1
+			}
+		}
+	}
+
+	return append(parts, locations[last:])
+
+}
+
+// proteinFromCDS returns the protein of a CDS feature, nil for pseudogenes and untranslatable locations
+func proteinFromCDS(cds *cdsNT) (*kvstore.Protein, error) {
+
+	if _, ok := cds.qualifiers["pseudo"]; ok {
+		return nil, nil
+	}
+	if _, ok := cds.qualifiers["pseudogene"]; ok {
+		return nil, nil
+	}
+
+	protein := &kvstore.Protein{}
+
+	if translation := cds.qualifiers["translation"]; translation != "" {
+		protein.Sequence = strings.ToUpper(strings.ReplaceAll(translation, " ", ""))
+	} else {
+		segments, ok := parseLocation(cds.location)
+		if !ok || len(segments) == 0 {
+			return nil, nil
+		}
+		seq := cds.record.sequence
+		var dna strings.Builder
+		for _, s := range segments {
+			if s.end > len(seq) {
+				return nil, kvstore.BadFormatError("%s : CDS %s outside of the sequence", cds.record.accession, cds.location)
+			}
+			if s.minus {
+				dna.WriteString(search.ReverseComplement(seq[s.start-1 : s.end]))
+			} else {
+				dna.WriteString(seq[s.start-1 : s.end])
+			}
+		}
+		cdsSeq := dna.String()
+
+		// /codon_start (1, 2 or 3) is the first base of the first complete codon
+		codonStart := 1
+		if n, err := strconv.Atoi(cds.qualifiers["codon_start"]); err == nil && n > 1 && n <= len(cdsSeq) {
+			codonStart = n
+			cdsSeq = cdsSeq[n-1:]
+		}
+
+		// INSDC default genetic code is the standard one
+		geneticCode := 1
+		if n, err := strconv.Atoi(cds.qualifiers["transl_table"]); err == nil {
+			geneticCode = n
+		}
+
+		startCodon := codonStart == 1 && !segments[0].partialStart()
+		var err error
+		if protein.Sequence, err = search.TranslateCDS(cdsSeq, geneticCode, startCodon); err != nil {
+			return nil, kvstore.BadFormatError("%s : CDS %s : %s", cds.record.accession, cds.location, err.Error())
+		}
+	}
+	protein.Length = int32(len(protein.Sequence))
+
+	for _, qualifier := range []string{"protein_id", "locus_tag"} {
+		if protein.EntryId = cds.qualifiers[qualifier]; protein.EntryId != "" {
+			break
+		}
+	}
+	if protein.EntryId == "" {
+		protein.EntryId = cds.record.accession + "_" + strconv.Itoa(cds.index)
+	}
+
+	features := map[string]string{}
+	for feature, qualifier := range map[string]string{"ProteinName": "product", "GeneName": "gene", "EC": "EC_number"} {
+		if value := cds.qualifiers[qualifier]; value != "" {
+			features[feature] = value
+		}
+	}
+	for feature, value := range map[string]string{"Organism": cds.record.organism, "FullTaxonomy": cds.record.taxonomy, "TaxId": cds.record.taxId} {
+		if value != "" {
+			features[feature] = value
+		}
+	}
+	protein.Features = features
+
+	return protein, nil
+
+}
+
+// processCDSInputNT adds the protein of a CDS feature
+func processCDSInputNT(proteinNb uint, cds *cdsNT, results chan<- int32, input *inputContext) error {
+
+	protein, err := proteinFromCDS(cds)
+	if err != nil || protein == nil {
+		return err
+	}
+
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
+	// skip peptide shorter than kmerSize
+	if int(protein.Length) < kmerSize {
+		return nil
+	}
+
+	proteinId := make([]byte, 4)
+	binary.BigEndian.PutUint32(proteinId, uint32(proteinNb))
+
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
+	}
+	results <- protein.Length
+
+	return nil
+
+}
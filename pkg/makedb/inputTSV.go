@@ -18,17 +18,14 @@ package makedb
 
 import (
 	"bufio"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
-	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
@@ -37,109 +34,216 @@ type ProteinBufTSV struct {
 	proteinEntry kvstore.Protein
 }
 
-func runTSV(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset uint, length uint) int {
+// TSV column layout : the EntryId, the Sequence and the feature columns.
+// A list column is split on its separator and stored joined with ";" as the other list features
+type TSVColumn struct {
+	Feature string // EntryId, Sequence or the feature name ("" for an ignored column)
+	ListSep string // separator of a list column
+}
+
+// TSV schema (-schema) : the columns by header name or 1-based position,
+// the columns missing from the schema are ignored
+type TSVSchema struct {
+	columns map[string]TSVColumn
+}
+
+// NewTSVSchema reads a schema file, one column by line :
+// column <tab> EntryId, Sequence or feature name [<tab> list:separator]
+func NewTSVSchema(fileName string) (*TSVSchema, error) {
 
 	file, err := os.Open(fileName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
-
 	defer file.Close()
 
-	jobs := make(chan ProteinBufTSV)
-	results := make(chan int32, 10)
-	wg := new(sync.WaitGroup)
-
-	// thread pool
-	for w := 1; w <= nbThreads; w++ {
-		wg.Add(1)
-		go readBufferTSV(jobs, results, wg, kvStores)
+	schema := &TSVSchema{columns: map[string]TSVColumn{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return nil, kvstore.BadFormatError("%s : schema line %s is not column<tab>name[<tab>type]", fileName, line)
+		}
+		column := TSVColumn{Feature: fields[1]}
+		if len(fields) == 3 {
+			if column.ListSep, err = parseTSVType(fields[2]); err != nil {
+				return nil, kvstore.BadFormatError("%s : %s", fileName, err.Error())
+			}
+		}
+		schema.columns[fields[0]] = column
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(schema.columns) == 0 {
+		return nil, kvstore.BadFormatError("%s : empty schema", fileName)
 	}
 
-	features := []string{}
+	return schema, nil
 
-	// Go over a file line by line and queue up a ton of work
-	go func() {
-		proteinNb := uint(0)
+}
 
-		buff := make([]byte, 512)
-		_, err = file.Read(buff)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		filetype := http.DetectContentType(buff)
-		file.Seek(0, 0)
+// parseTSVType returns the separator of a list type (list:separator, list alone is ;), "" for text
+func parseTSVType(columnType string) (string, error) {
+	switch {
+	case columnType == "text":
+		return "", nil
+	case columnType == "list":
+		return ";", nil
+	case strings.HasPrefix(columnType, "list:") && len(columnType) > len("list:"):
+		return columnType[len("list:"):], nil
+	}
+	return "", fmt.Errorf("column type %s unrecognized (text, list or list:separator)", columnType)
+}
+
+// tsvLayout returns the layout of the header columns from the schema or, without a schema,
+// from the header names (EntryID, Sequence and the features, with an optional [list:separator] suffix)
+func tsvLayout(header []string, schema *TSVSchema) ([]TSVColumn, error) {
 
-		var scanner *bufio.Scanner
+	layout := make([]TSVColumn, len(header))
 
-		if filetype == "application/x-gzip" {
-			reader, err := gzip.NewReader(file)
+	for i, name := range header {
+		if schema != nil {
+			if column, ok := schema.columns[name]; ok {
+				layout[i] = column
+			} else if column, ok := schema.columns[strconv.Itoa(i+1)]; ok {
+				layout[i] = column
+			}
+			continue
+		}
+		column := TSVColumn{Feature: name}
+		if open := strings.LastIndex(name, "["); open > 0 && strings.HasSuffix(name, "]") {
+			listSep, err := parseTSVType(name[open+1 : len(name)-1])
 			if err != nil {
-				log.Fatal(err)
+				return nil, kvstore.BadFormatError("TSV header %s : %s", name, err.Error())
 			}
-			scanner = bufio.NewScanner(reader)
-		} else {
-			reader := bufio.NewReader(file)
-			scanner = bufio.NewScanner(reader)
+			column = TSVColumn{Feature: name[:open], ListSep: listSep}
+		}
+		layout[i] = column
+	}
+
+	hasEntryId := false
+	hasSequence := false
+	for i, column := range layout {
+		switch strings.ToLower(column.Feature) {
+		case "entryid":
+			hasEntryId = true
+			layout[i].Feature = "EntryId"
+		case "sequence":
+			hasSequence = true
+			layout[i].Feature = "Sequence"
+		}
+	}
+	if !hasEntryId {
+		return nil, kvstore.BadFormatError("TSV file doesn't contain 'EntryID' header")
+	}
+	if !hasSequence {
+		return nil, kvstore.BadFormatError("TSV file doesn't contain 'Sequence' header")
+	}
+
+	return layout, nil
+
+}
+
+func runTSV(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
+
+	scanner, closeFile, err := openInputScanner(fileName)
+	if err != nil {
+		return proteinNb, nil, err
+	}
+	defer closeFile()
+
+	// this is the header
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return proteinNb, nil, err
 		}
+		return proteinNb, nil, kvstore.BadFormatError("%s : empty file", fileName)
+	}
+	layout, err := tsvLayout(strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t"), input.schema)
+	if err != nil {
+		return proteinNb, nil, err
+	}
 
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
+	jobs := make(chan ProteinBufTSV)
+	results := make(chan int32, 10)
+	wg := new(sync.WaitGroup)
+	errs := new(firstError)
+
+	// thread pool
+	for w := 1; w <= input.nbThreads; w++ {
+		wg.Add(1)
+		go readBufferTSV(jobs, results, wg, input, errs)
+	}
+
+	// Go over a file line by line and queue up a ton of work
+	go func() {
+		lastProtein := offset + length
 
 		line := ""
-		firstLine := true
 		_cols := []string{}
 
 		for scanner.Scan() {
-			line = scanner.Text()
-			if firstLine {
-				// this is the header
-				features = strings.Split(line, "\t")
-				hasEntryId := false
-				hasSequence := false
-				for _, f := range features {
-					if strings.ToLower(f) == "entryid" {
-						hasEntryId = true
-					} else if strings.ToLower(f) == "sequence" {
-						hasSequence = true
-					}
-				}
-				if !hasEntryId {
-					log.Fatal("TSV file doesn't contain 'EntryID' header")
-				}
-				if !hasSequence {
-					log.Fatal("TSV file doesn't contain 'Sequence' header")
-				}
-
-				firstLine = false
+			line = strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			proteinNb += 1
+			if proteinNb <= offset {
 				continue
 			}
+			if proteinNb > lastProtein {
+				break
+			}
 
-			line = strings.TrimRight(line, "\n")
 			_cols = strings.Split(line, "\t")
 			protein := &kvstore.Protein{}
 			protein.Features = map[string]string{}
-			protein.Sequence = ""
-			protein.EntryId = ""
 
 			for i, f := range _cols {
-				if strings.ToLower(features[i]) == "entryid" {
+				if i >= len(layout) {
+					break
+				}
+				switch column := layout[i]; column.Feature {
+				case "":
+				case "EntryId":
 					protein.EntryId = f
-				} else if strings.ToLower(features[i]) == "sequence" {
+				case "Sequence":
 					protein.Sequence = f
 					protein.Length = int32(len(f))
-				} else {
-					protein.Features[features[i]] = f
+				default:
+					if column.ListSep != "" {
+						items := []string{}
+						for _, item := range strings.Split(f, column.ListSep) {
+							if item = strings.TrimSpace(item); item != "" {
+								items = append(items, item)
+							}
+						}
+						f = strings.Join(items, ";")
+					}
+					if f == "" {
+						continue
+					}
+					if _, ok := protein.Features[column.Feature]; ok {
+						protein.Features[column.Feature] += ";" + f
+					} else {
+						protein.Features[column.Feature] = f
+					}
 				}
 			}
 
 			// skip peptide shorter than kmerSize
-			if protein.Length < KMER_SIZE || protein.Sequence == "" || protein.EntryId == "" {
+			if int(protein.Length) < input.kvStores.KmerStore.KmerSize() || protein.Sequence == "" || protein.EntryId == "" {
 				continue
 			}
 			jobs <- ProteinBufTSV{proteinId: proteinNb, proteinEntry: *protein}
-			proteinNb += 1
+		}
+		if err := scanner.Err(); err != nil {
+			errs.set(err)
 		}
 		close(jobs)
 	}()
@@ -157,11 +261,13 @@ func runTSV(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 	countAA := uint64(0)
 	countKmers := uint64(0)
 
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
 	wgGC := new(sync.WaitGroup)
 	for v := range results {
 		countProteins += 1
 		countAA += uint64(v)
-		countKmers += uint64(v) - KMER_SIZE + 1
+		countKmers += uint64(v) - uint64(kmerSize) + 1
 		if countProteins%10000 == 0 {
 			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
 		}
@@ -170,26 +276,32 @@ func runTSV(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 			wgGC.Wait()
 			wgGC.Add(2)
 			go func() {
-				kvStores.KmerStore.GarbageCollect(10, 0.5)
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
 				wgGC.Done()
 			}()
 			go func() {
-				kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
 				wgGC.Done()
 			}()
 		}
 	}
 	wgGC.Wait()
 
-	// Remove entryid and sequence from features
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Features of the layout in column order
 	finalFeatures := []string{}
-	for _, f := range features {
-		if strings.ToLower(f) != "entryid" && strings.ToLower(f) != "sequence" {
-			finalFeatures = append(finalFeatures, f)
+	seen := map[string]bool{"": true, "EntryId": true, "Sequence": true}
+	for _, column := range layout {
+		if !seen[column.Feature] {
+			seen[column.Feature] = true
+			finalFeatures = append(finalFeatures, column.Feature)
 		}
 	}
 
-	// Add Stats to protein_store
+	// Stats of the added proteins
 	kstats := &kvstore.KStats{
 		NumberOfProteins:  countProteins,
 		NumberOfAA:        countAA,
@@ -198,44 +310,36 @@ func runTSV(fileName string, kvStores *kvstore.KVStores, nbThreads int, offset u
 
 		Features: finalFeatures,
 	}
-	data, err := proto.Marshal(kstats)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	kvStores.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
-
-	return 0
+	return proteinNb, kstats, nil
 
 }
 
-func readBufferTSV(jobs <-chan ProteinBufTSV, results chan<- int32, wg *sync.WaitGroup, kvStores *kvstore.KVStores) {
+func readBufferTSV(jobs <-chan ProteinBufTSV, results chan<- int32, wg *sync.WaitGroup, input *inputContext, errs *firstError) {
 
 	defer wg.Done()
 	// line by line
 	for j := range jobs {
-		processProteinInputTSV(j, results, kvStores)
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		if err := processProteinInputTSV(j, results, input); err != nil {
+			errs.set(err)
+		}
 	}
 
 }
 
-func processProteinInputTSV(proteinBuf ProteinBufTSV, results chan<- int32, kvStores *kvstore.KVStores) {
-
-	results <- proteinBuf.proteinEntry.Length
+func processProteinInputTSV(proteinBuf ProteinBufTSV, results chan<- int32, input *inputContext) error {
 
 	proteinId := make([]byte, 4)
 	binary.BigEndian.PutUint32(proteinId, uint32(proteinBuf.proteinId))
 
-	data, err := proto.Marshal(&proteinBuf.proteinEntry)
-	if err != nil {
-		log.Fatal(err.Error())
-	} else {
-		kvStores.ProteinStore.AddValueToChannel(proteinId, data, false)
+	if err := input.addProtein(proteinId, &proteinBuf.proteinEntry); err != nil {
+		return err
 	}
+	results <- proteinBuf.proteinEntry.Length
 
-	// sliding windows of kmerSize on Sequence
-	for i := 0; i < int(proteinBuf.proteinEntry.Length)-KMER_SIZE+1; i++ {
-		kmerKey := kvStores.KmerStore.CreateBytesKey(proteinBuf.proteinEntry.Sequence[i : i+KMER_SIZE])
-		kvStores.KmerStore.AddValueToChannel(kmerKey, proteinId, false)
-	}
+	return nil
 
 }
@@ -0,0 +1,358 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+type ProteinBufXML struct {
+	proteinId    uint
+	proteinEntry string
+}
+
+var (
+	XML_DEF_FTS = []string{"ProteinName", "GeneName", "EC", "GO", "KEGG_ID", "BioCyc_ID", "HAMAP", "Organism", "TaxId", "FullTaxonomy", "Keywords", "ProteinExistence", "SequenceFeatures"}
+)
+
+// UniProt XML entry (https://www.uniprot.org/docs/uniprot.xsd), only the elements used as features
+type entryXML struct {
+	Name    string `xml:"name"`
+	Protein struct {
+		RecommendedName *proteinNameXML  `xml:"recommendedName"`
+		SubmittedNames  []proteinNameXML `xml:"submittedName"`
+	} `xml:"protein"`
+	Genes []struct {
+		Names []typedValueXML `xml:"name"`
+	} `xml:"gene"`
+	Organism struct {
+		Names        []typedValueXML  `xml:"name"`
+		DbReferences []dbReferenceXML `xml:"dbReference"`
+		Lineage      []string         `xml:"lineage>taxon"`
+	} `xml:"organism"`
+	DbReferences     []dbReferenceXML `xml:"dbReference"`
+	ProteinExistence typedValueXML    `xml:"proteinExistence"`
+	Keywords         []string         `xml:"keyword"`
+	Features         []featureXML     `xml:"feature"`
+	Evidences        []evidenceXML    `xml:"evidence"`
+	Sequence         struct {
+		Fragment string `xml:"fragment,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"sequence"`
+}
+
+type proteinNameXML struct {
+	FullName  string   `xml:"fullName"`
+	EcNumbers []string `xml:"ecNumber"`
+}
+
+type typedValueXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type dbReferenceXML struct {
+	Type string `xml:"type,attr"`
+	Id   string `xml:"id,attr"`
+}
+
+// sequence feature (domain, site, chain..) with the keys of its evidences
+type featureXML struct {
+	Type        string `xml:"type,attr"`
+	Description string `xml:"description,attr"`
+	Evidence    string `xml:"evidence,attr"`
+}
+
+// evidence of the entry, the type is an ECO code
+type evidenceXML struct {
+	Type string `xml:"type,attr"`
+	Key  string `xml:"key,attr"`
+}
+
+func runXML(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error) {
+
+	scanner, closeFile, err := openInputScanner(fileName)
+	if err != nil {
+		return proteinNb, nil, err
+	}
+	defer closeFile()
+
+	jobs := make(chan ProteinBufXML)
+	results := make(chan int32, 10)
+	wg := new(sync.WaitGroup)
+	errs := new(firstError)
+
+	// thread pool
+	for w := 1; w <= input.nbThreads; w++ {
+		wg.Add(1)
+		go readBufferXML(jobs, results, wg, input, errs)
+	}
+
+	// Go over a file line by line and queue up the <entry> elements,
+	// UniProt puts the opening and closing entry tags on their own line
+	go func() {
+		lastProtein := offset + length
+
+		proteinEntry := ""
+		inEntry := false
+		line := ""
+
+		for scanner.Scan() {
+			line = scanner.Text()
+			tag := strings.TrimSpace(line)
+			if !inEntry {
+				if strings.HasPrefix(tag, "<entry ") || tag == "<entry>" {
+					inEntry = true
+				} else {
+					continue
+				}
+			}
+			if proteinNb >= offset {
+				proteinEntry += line
+				proteinEntry += "\n"
+			}
+			if tag == "</entry>" {
+				inEntry = false
+				proteinNb += 1
+				if proteinEntry != "" {
+					jobs <- ProteinBufXML{proteinId: proteinNb, proteinEntry: proteinEntry}
+					proteinEntry = ""
+				}
+				if proteinNb >= lastProtein {
+					break
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			errs.set(err)
+		} else if inEntry && proteinEntry != "" {
+			errs.set(kvstore.BadFormatError("%s : truncated entry after protein %d", fileName, proteinNb))
+		}
+		close(jobs)
+	}()
+
+	// Collect all the results...
+	// First, make sure we close the result channel when everything was processed
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Now, add up the results from the results channel until closed
+	timeStart := time.Now()
+	countProteins := uint64(0)
+	countAA := uint64(0)
+	countKmers := uint64(0)
+
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
+	wgGC := new(sync.WaitGroup)
+	for v := range results {
+		countProteins += 1
+		countAA += uint64(v)
+		countKmers += uint64(v) - uint64(kmerSize) + 1
+		if countProteins%10000 == 0 {
+			fmt.Printf("Processed %d proteins in %f minutes\n", countProteins, time.Since(timeStart).Minutes())
+		}
+		// Valuelog GC every 100K processed proteins
+		if countProteins%1000000 == 0 {
+			wgGC.Wait()
+			wgGC.Add(2)
+			go func() {
+				input.kvStores.KmerStore.GarbageCollect(10, 0.5)
+				wgGC.Done()
+			}()
+			go func() {
+				input.kvStores.ProteinStore.GarbageCollect(1, 0.5)
+				wgGC.Done()
+			}()
+		}
+	}
+	wgGC.Wait()
+
+	if err := errs.get(); err != nil {
+		return proteinNb, nil, err
+	}
+
+	// Stats of the added proteins
+	kstats := &kvstore.KStats{
+		NumberOfProteins:  countProteins,
+		NumberOfAA:        countAA,
+		NumberOfKmers:     countKmers,
+		NumberOfKCombSets: 0,
+
+		Features: XML_DEF_FTS,
+	}
+	return proteinNb, kstats, nil
+
+}
+
+func readBufferXML(jobs <-chan ProteinBufXML, results chan<- int32, wg *sync.WaitGroup, input *inputContext, errs *firstError) {
+
+	defer wg.Done()
+	// entry by entry
+	for j := range jobs {
+		// keep draining the jobs after an error
+		if errs.get() != nil {
+			continue
+		}
+		if err := processProteinInputXML(j, results, input); err != nil {
+			errs.set(err)
+		}
+	}
+
+}
+
+func processProteinInputXML(proteinBuf ProteinBufXML, results chan<- int32, input *inputContext) error {
+
+	entry := &entryXML{}
+	if err := xml.Unmarshal([]byte(proteinBuf.proteinEntry), entry); err != nil {
+		return kvstore.BadFormatError("protein %d : %s", proteinBuf.proteinId, err.Error())
+	}
+
+	// skipping protein fragments
+	if entry.Sequence.Fragment != "" {
+		return nil
+	}
+
+	protein := &kvstore.Protein{}
+	features := map[string]string{}
+
+	protein.EntryId = entry.Name
+
+	ecNumbers := []string{}
+	if name := entry.Protein.RecommendedName; name != nil {
+		features["ProteinName"] = name.FullName
+		ecNumbers = append(ecNumbers, name.EcNumbers...)
+	}
+	for _, name := range entry.Protein.SubmittedNames {
+		if features["ProteinName"] != "" {
+			features["ProteinName"] += ";;"
+		}
+		features["ProteinName"] += name.FullName
+		ecNumbers = append(ecNumbers, name.EcNumbers...)
+	}
+	if len(ecNumbers) > 0 {
+		features["EC"] = strings.Join(ecNumbers, ";")
+	}
+
+	for _, gene := range entry.Genes {
+		for _, name := range gene.Names {
+			if name.Type == "primary" && features["GeneName"] == "" {
+				features["GeneName"] = name.Value
+			}
+		}
+	}
+
+	// Organism as in the EMBL OS line : scientific name (common name)
+	organism, commonName := "", ""
+	for _, name := range entry.Organism.Names {
+		switch name.Type {
+		case "scientific":
+			organism = name.Value
+		case "common":
+			commonName = name.Value
+		}
+	}
+	if organism != "" && commonName != "" {
+		organism += " (" + commonName + ")"
+	}
+	if organism != "" {
+		features["Organism"] = organism
+	}
+	for _, ref := range entry.Organism.DbReferences {
+		if ref.Type == "NCBI Taxonomy" {
+			features["TaxId"] = ref.Id
+		}
+	}
+	if len(entry.Organism.Lineage) > 0 {
+		features["FullTaxonomy"] = strings.Join(entry.Organism.Lineage, "; ") + "."
+	}
+
+	dbFeatures := map[string]string{"GO": "GO", "KEGG": "KEGG_ID", "BioCyc": "BioCyc_ID", "HAMAP": "HAMAP"}
+	for _, ref := range entry.DbReferences {
+		if feature, ok := dbFeatures[ref.Type]; ok {
+			if _, ok := features[feature]; ok {
+				features[feature] += ";"
+			}
+			features[feature] += ref.Id
+		}
+	}
+
+	if len(entry.Keywords) > 0 {
+		features["Keywords"] = strings.Join(entry.Keywords, ";")
+	}
+	if entry.ProteinExistence.Type != "" {
+		features["ProteinExistence"] = entry.ProteinExistence.Type
+	}
+
+	// sequence features as type:description {evidence codes}
+	if len(entry.Features) > 0 {
+		evidences := map[string]string{}
+		for _, evidence := range entry.Evidences {
+			evidences[evidence.Key] = evidence.Type
+		}
+		seqFeatures := []string{}
+		for _, ft := range entry.Features {
+			seqFeature := ft.Type
+			if ft.Description != "" {
+				seqFeature += ":" + ft.Description
+			}
+			codes := []string{}
+			for _, key := range strings.Fields(ft.Evidence) {
+				if code, ok := evidences[key]; ok {
+					codes = append(codes, code)
+				}
+			}
+			if len(codes) > 0 {
+				seqFeature += " {" + strings.Join(codes, ", ") + "}"
+			}
+			seqFeatures = append(seqFeatures, seqFeature)
+		}
+		features["SequenceFeatures"] = strings.Join(seqFeatures, ";")
+	}
+
+	protein.Sequence = strings.Join(strings.Fields(entry.Sequence.Value), "")
+	protein.Length = int32(len(protein.Sequence))
+
+	kmerSize := input.kvStores.KmerStore.KmerSize()
+
+	// skip peptide shorter than kmerSize
+	if int(protein.Length) < kmerSize {
+		return nil
+	}
+
+	protein.Features = features
+
+	proteinId := make([]byte, 4)
+	binary.BigEndian.PutUint32(proteinId, uint32(proteinBuf.proteinId))
+
+	if err := input.addProtein(proteinId, protein); err != nil {
+		return err
+	}
+	results <- protein.Length
+
+	return nil
+
+}
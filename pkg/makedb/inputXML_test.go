@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package makedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+const entryFixtureXML = `<?xml version="1.0" encoding="UTF-8"?>
+<uniprot xmlns="http://uniprot.org/uniprot">
+<entry dataset="Swiss-Prot" created="1986-07-21" modified="2020-02-26" version="1">
+  <accession>P00001</accession>
+  <name>TEST_ECOLI</name>
+  <protein>
+    <recommendedName>
+      <fullName evidence="1">Test protein</fullName>
+      <ecNumber>1.1.1.1</ecNumber>
+    </recommendedName>
+  </protein>
+  <gene>
+    <name type="primary">tst</name>
+  </gene>
+  <organism>
+    <name type="scientific">Escherichia coli</name>
+    <dbReference type="NCBI Taxonomy" id="562"/>
+    <lineage>
+      <taxon>Bacteria</taxon>
+      <taxon>Proteobacteria</taxon>
+    </lineage>
+  </organism>
+  <dbReference type="GO" id="GO:0005737"/>
+  <proteinExistence type="evidence at protein level"/>
+  <keyword id="KW-0560">Oxidoreductase</keyword>
+  <feature type="chain" id="PRO_1" description="Test protein">
+    <location><begin position="1"/><end position="20"/></location>
+  </feature>
+  <feature type="active site" description="Proton acceptor" evidence="1 2">
+    <location><position position="5"/></location>
+  </feature>
+  <feature type="helix" evidence="3">
+    <location><begin position="8"/><end position="12"/></location>
+  </feature>
+  <evidence type="ECO:0000269" key="1"/>
+  <evidence type="ECO:0000255" key="2"/>
+  <evidence type="ECO:0007829" key="3"/>
+  <sequence length="20" mass="2000" checksum="X" modified="1986-07-21" version="1">
+MKVLAAGIVG LLLAQWERTY
+</sequence>
+</entry>
+</uniprot>
+`
+
+func TestRunXMLFeatures(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "makedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "entry.xml")
+	if err := ioutil.WriteFile(file, []byte(entryFixtureXML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kvStores := kvstore.KVStoresMemoryNew(1)
+	input := &inputContext{kvStores: kvStores, nbThreads: 1}
+	kvStores.OpenInsertChannel()
+	if _, _, err := runXML(file, input, 0, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.CloseInsertChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	prot, ok := kvStores.ProteinStore.GetProtein([]byte{0, 0, 0, 1}, true)
+	if !ok {
+		t.Fatal("runXML did not store the entry")
+	}
+	if prot.EntryId != "TEST_ECOLI" || prot.Sequence != "MKVLAAGIVGLLLAQWERTY" {
+		t.Errorf("runXML entry %s sequence %s", prot.EntryId, prot.Sequence)
+	}
+
+	expected := map[string]string{
+		"ProteinName":      "Test protein",
+		"EC":               "1.1.1.1",
+		"GeneName":         "tst",
+		"Organism":         "Escherichia coli",
+		"TaxId":            "562",
+		"FullTaxonomy":     "Bacteria; Proteobacteria.",
+		"GO":               "GO:0005737",
+		"Keywords":         "Oxidoreductase",
+		"ProteinExistence": "evidence at protein level",
+		"SequenceFeatures": "chain:Test protein;active site:Proton acceptor {ECO:0000269, ECO:0000255};helix {ECO:0007829}",
+	}
+	for feature, value := range expected {
+		if prot.Features[feature] != value {
+			t.Errorf("feature %s is %q, expecting %q", feature, prot.Features[feature], value)
+		}
+	}
+
+}
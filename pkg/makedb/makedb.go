@@ -17,66 +17,384 @@ limitations under the License.
 package makedb
 
 import (
+	"bufio"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/zorino/kaamer/pkg/indexdb"
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-const (
-	KMER_SIZE = 7 // 7 is currently the only supported kmer size
-)
+// MakedbOptions are the settings of a database build
+type MakedbOptions struct {
+	DBPath         string
+	InputPath      string // comma separated files, glob patterns, directories or - for stdin
+	InputFmt       string
+	NbOfThreads    int
+	Offset         uint // the entries numbered from Offset+1 to Offset+Length are added
+	Length         uint
+	MaxSize        bool
+	NoIndex        bool
+	KmerSize       int
+	Alphabet       string
+	Seed           string // spaced seed mask, replaces KmerSize when set
+	Compress       bool
+	Dedup          bool
+	HeaderTemplate string // FASTA header template (-header)
+	SchemaFile     string // TSV schema file (-schema)
+	StopKmers      indexdb.StopKmerOptions
+}
 
-func NewMakedb(dbPath string, inputPath string, inputFmt string, threadByWorker int, offset uint, lenght uint, maxSize bool, noIndex bool) {
+// inputContext is the database and the settings shared by the input readers
+type inputContext struct {
+	kvStores  *kvstore.KVStores
+	nbThreads int
+	header    *FastaHeader // nil for plain FASTA headers
+	schema    *TSVSchema   // nil for typed TSV header columns
+	dedup     bool         // identical sequences deduplication
+}
 
-	runtime.GOMAXPROCS(128)
+func NewMakedb(options MakedbOptions) error {
 
-	os.Mkdir(dbPath, 0700)
+	runtime.GOMAXPROCS(128)
 
-	if threadByWorker < 1 {
-		threadByWorker = 1
+	if options.NbOfThreads < 1 {
+		options.NbOfThreads = 1
 	}
 
-	inputFmt = strings.ToLower(inputFmt)
+	if options.Seed != "" && !kvstore.ValidSeed(options.Seed) {
+		return fmt.Errorf("Seed must be a 0/1 mask starting and ending with 1 with %d to %d positions set to 1", kvstore.MinKmerSize, kvstore.MaxKmerSize)
+	} else if options.Seed == "" && (options.KmerSize < kvstore.MinKmerSize || options.KmerSize > kvstore.MaxKmerSize) {
+		return fmt.Errorf("Kmer size must be between %d and %d", kvstore.MinKmerSize, kvstore.MaxKmerSize)
+	}
 
-	fmt.Printf("# Making Database %s from %s\n", dbPath, inputPath)
-	fmt.Printf("# Using %d CPU\n", threadByWorker)
+	alphabet := strings.ToLower(options.Alphabet)
+	if _, ok := kvstore.Alphabets[alphabet]; !ok {
+		return fmt.Errorf("Alphabet %s unrecognized", alphabet)
+	}
 
-	kvStores := kvstore.KVStoresNew(dbPath, threadByWorker, maxSize, false, false)
-	kvStores.OpenInsertChannel()
+	inputFmt := strings.ToLower(options.InputFmt)
 
+	var run inputReader
 	switch inputFmt {
 	case "embl":
-		runEMBL(inputPath, kvStores, threadByWorker, offset, lenght)
+		run = runEMBL
 	case "tsv":
-		runTSV(inputPath, kvStores, threadByWorker, offset, lenght)
-	case "gbk":
-		runGBK(inputPath, kvStores, threadByWorker, offset, lenght)
-	case "genbank":
-		runGBK(inputPath, kvStores, threadByWorker, offset, lenght)
+		run = runTSV
+	case "gbk", "genbank":
+		run = runGBK
 	case "fasta":
-		runFASTA(inputPath, kvStores, threadByWorker, offset, lenght)
+		run = runFASTA
+	case "xml":
+		run = runXML
+	case "gff3", "gff":
+		run = runGFF3
 	default:
-		fmt.Println("Input format unrecognized !")
-		os.Exit(1)
+		return kvstore.BadFormatError("input format %s unrecognized", inputFmt)
+	}
+
+	files, err := inputFiles(options.InputPath)
+	if err != nil {
+		return err
 	}
-	kvStores.CloseInsertChannel()
-	kvStores.Close()
+	if inputFmt == "gff3" || inputFmt == "gff" {
+		if files = withoutCompanionFASTA(files); len(files) == 0 {
+			return fmt.Errorf("No GFF3 input file")
+		}
+	}
+
+	input := &inputContext{nbThreads: options.NbOfThreads}
+
+	if options.HeaderTemplate != "" {
+		if inputFmt != "fasta" {
+			return fmt.Errorf("FASTA header template (-header) needs the fasta input format")
+		}
+		if input.header, err = NewFastaHeader(options.HeaderTemplate); err != nil {
+			return err
+		}
+	}
+
+	if options.SchemaFile != "" {
+		if inputFmt != "tsv" {
+			return fmt.Errorf("TSV schema (-schema) needs the tsv input format")
+		}
+		if input.schema, err = NewTSVSchema(options.SchemaFile); err != nil {
+			return err
+		}
+	}
+
+	os.Mkdir(options.DBPath, 0700)
 
-	kvStores = kvstore.KVStoresNew(dbPath, threadByWorker, maxSize, false, false)
+	fmt.Printf("# Making Database %s from %s\n", options.DBPath, options.InputPath)
+	fmt.Printf("# Using %d CPU\n", options.NbOfThreads)
+	if options.Seed != "" {
+		fmt.Printf("# Using spaced seed %s\n", options.Seed)
+	} else {
+		fmt.Printf("# Using kmer size of %d\n", options.KmerSize)
+	}
+	fmt.Printf("# Using %s alphabet\n", alphabet)
+
+	kvStores, err := kvstore.KVStoresNew(options.DBPath, options.NbOfThreads, options.MaxSize, false, false)
+	if err != nil {
+		return err
+	}
+	if options.Seed != "" {
+		kvStores.KmerStore.SetSeed(options.Seed)
+	} else {
+		kvStores.KmerStore.SetKmerSize(options.KmerSize)
+	}
+	if err := kvStores.KmerStore.SetAlphabet(alphabet); err != nil {
+		kvStores.Close()
+		return err
+	}
+	if options.Compress {
+		kvStores.ProteinStore.SetSequenceEncoding(kvstore.SequenceEncodingFlate)
+	}
+	if options.Dedup {
+		fmt.Printf("# Deduplicating identical sequences\n")
+		input.dedup = true
+	}
+	input.kvStores = kvStores
+	kvStores.OpenInsertChannel()
+
+	// Add build settings to protein_store (completed by indexdb)
+	ksettings := &kvstore.KSettings{
+		FormatVersion:    kvstore.CurrentFormatVersion,
+		CreationDate:     time.Now().Format("2006-01-02"),
+		OriginalFile:     strings.Join(files, ","),
+		KmerSize:         int32(kvStores.KmerStore.KmerSize()),
+		Alphabet:         alphabet,
+		Seed:             kvStores.KmerStore.Seed(),
+		SequenceEncoding: kvStores.ProteinStore.SequenceEncoding(),
+	}
+	data, err := proto.Marshal(ksettings)
+	if err != nil {
+		kvStores.CloseInsertChannel()
+		kvStores.Close()
+		return err
+	}
+	kvStores.ProteinStore.AddValueToChannel([]byte("db_settings"), data, true)
+
+	// the proteins are numbered across the input files
+	kstats := &kvstore.KStats{}
+	proteinNb := uint(0)
+	for _, fileName := range files {
+		if proteinNb >= options.Offset+options.Length {
+			break
+		}
+		if len(files) > 1 {
+			fmt.Printf("# Reading %s\n", fileName)
+		}
+		var fileStats *kvstore.KStats
+		if proteinNb, fileStats, err = run(fileName, input, proteinNb, options.Offset, options.Length); err != nil {
+			break
+		}
+		addStats(kstats, fileStats)
+	}
+	if err == nil {
+		// Add Stats to protein_store
+		if data, err = proto.Marshal(kstats); err == nil {
+			kvStores.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
+		}
+	}
+	if closeErr := kvStores.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && options.Dedup {
+		err = MergeDuplicates(kvStores)
+	}
+
+	if closeErr := kvStores.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	kvStores, err = kvstore.KVStoresNew(options.DBPath, options.NbOfThreads, options.MaxSize, false, false)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("# GC KmerStore...\n")
 	kvStores.KmerStore.GarbageCollect(10, 0.5)
 	fmt.Printf("# GC ProteinStore...\n")
 	kvStores.ProteinStore.GarbageCollect(10, 0.5)
 
-	kvStores.Close()
+	if err := kvStores.Close(); err != nil {
+		return err
+	}
+
+	if !options.NoIndex {
+		return indexdb.NewIndexDB(options.DBPath, options.NbOfThreads, options.MaxSize, options.StopKmers)
+	}
+
+	return nil
+
+}
+
+// inputReader reads the entries of an input file numbered after proteinNb, the entries numbered from offset+1
+// to offset+length are added. It returns the last entry number read and the stats of the added proteins
+type inputReader func(fileName string, input *inputContext, proteinNb uint, offset uint, length uint) (uint, *kvstore.KStats, error)
+
+const stdinInput = "-"
+
+// openInputScanner returns a line scanner of a plain or gzipped file (- for stdin)
+func openInputScanner(fileName string) (*bufio.Scanner, func() error, error) {
+
+	file := os.Stdin
+	if fileName != stdinInput {
+		var err error
+		if file, err = os.Open(fileName); err != nil {
+			return nil, nil, err
+		}
+	}
+	closeFile := func() error {
+		if file == os.Stdin {
+			return nil
+		}
+		return file.Close()
+	}
+
+	// the input type is peeked, stdin can't seek
+	reader := bufio.NewReader(file)
+	buff, err := reader.Peek(512)
+	if len(buff) == 0 && (err == nil || err == io.EOF) {
+		closeFile()
+		return nil, nil, kvstore.BadFormatError("%s : empty file", fileName)
+	} else if err != nil && err != io.EOF {
+		closeFile()
+		return nil, nil, err
+	}
+	filetype := http.DetectContentType(buff)
+
+	var scanner *bufio.Scanner
 
-	if !noIndex {
-		indexdb.NewIndexDB(dbPath, threadByWorker, maxSize)
+	if filetype == "application/x-gzip" {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			closeFile()
+			return nil, nil, err
+		}
+		scanner = bufio.NewScanner(gzipReader)
+	} else {
+		scanner = bufio.NewScanner(reader)
 	}
 
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 1024*1024)
+
+	return scanner, closeFile, nil
+
+}
+
+// inputFiles returns the input files of a comma separated list of files, glob patterns,
+// directories (their files in name order) and - for stdin
+func inputFiles(inputPath string) ([]string, error) {
+
+	files := []string{}
+
+	for _, input := range strings.Split(inputPath, ",") {
+		input = strings.TrimSpace(input)
+		switch {
+		case input == "":
+			continue
+		case input == stdinInput:
+			files = append(files, input)
+			continue
+		case strings.ContainsAny(input, "*?["):
+			matches, err := filepath.Glob(input)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No input file matching %s", input)
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+			continue
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, input)
+			continue
+		}
+		dirFiles, err := ioutil.ReadDir(input)
+		if err != nil {
+			return nil, err
+		}
+		nbFiles := len(files)
+		for _, f := range dirFiles {
+			if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+				files = append(files, filepath.Join(input, f.Name()))
+			}
+		}
+		if len(files) == nbFiles {
+			return nil, fmt.Errorf("No input file in directory %s", input)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No input file")
+	}
+
+	return files, nil
+
+}
+
+// addStats adds the stats of an input file to the stats of the database (features in order of appearance)
+func addStats(kstats *kvstore.KStats, fileStats *kvstore.KStats) {
+
+	kstats.NumberOfProteins += fileStats.NumberOfProteins
+	kstats.NumberOfAA += fileStats.NumberOfAA
+	kstats.NumberOfKmers += fileStats.NumberOfKmers
+
+	for _, feature := range fileStats.Features {
+		found := false
+		for _, f := range kstats.Features {
+			if f == feature {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kstats.Features = append(kstats.Features, feature)
+		}
+	}
+
+}
+
+// firstError keeps the first error of the goroutines reading an input file
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+func (e *firstError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
 }
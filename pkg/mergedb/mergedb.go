@@ -17,20 +17,16 @@ limitations under the License.
 package mergedb
 
 import (
-	"bytes"
-	"context"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
 
-	"github.com/dgraph-io/badger/v3"
-	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/golang/protobuf/proto"
 	copy "github.com/zorino/kaamer/internal/helper/copy"
 	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/statsdb"
 )
 
 type DBMerger struct {
@@ -39,7 +35,7 @@ type DBMerger struct {
 	KVToMerge sync.Map
 }
 
-func NewMergedb(dbsPath string, outPath string, maxSize bool) {
+func NewMergedb(dbsPath string, outPath string, maxSize bool) (err error) {
 
 	// For SSD throughput (as done in badger/graphdb) see :
 	// https://groups.google.com/forum/#!topic/golang-nuts/jPb_h3TvlKE/discussion
@@ -54,23 +50,34 @@ func NewMergedb(dbsPath string, outPath string, maxSize bool) {
 	pattern := dbsPath + "/*"
 	allDBs, err := filepath.Glob(pattern)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
+	}
+	if len(allDBs) == 0 {
+		return fmt.Errorf("No database found in %s", dbsPath)
 	}
 
 	fmt.Printf("# Syncing kv store 1 as the base store for the merge..\n")
 	os.Mkdir(outPath, 0700)
-	copy.Dir(allDBs[0], outPath)
+	if err := copy.Dir(allDBs[0], outPath); err != nil {
+		return err
+	}
+	kvstore.RemoveKmerIndex(outPath)
 	allDBs = allDBs[1:]
 
-	kvStores1 := kvstore.KVStoresNew(outPath, nbOfThreads, maxSize, false, false)
+	kvStores1, err := kvstore.KVStoresNew(outPath, nbOfThreads, maxSize, false, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := kvStores1.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
-	dbStats := &kvstore.KStats{}
-	dbStatsByte, ok := kvStores1.ProteinStore.GetValue([]byte("db_stats"))
-	if !ok {
-		fmt.Println("Couldn't find db stats")
-		os.Exit(1)
+	dbStats, err := kvStores1.GetStats()
+	if err != nil {
+		return fmt.Errorf("%s : %w", allDBs[0], err)
 	}
-	proto.Unmarshal(dbStatsByte, dbStats)
 
 	// Merge all DB into the first DB
 	for _, db := range allDBs {
@@ -79,130 +86,129 @@ func NewMergedb(dbsPath string, outPath string, maxSize bool) {
 
 			fmt.Printf("# Merging database %s into %s...\n", db, outPath)
 
-			kvStores2 := kvstore.KVStoresNew(db, 1, maxSize, false, false)
-
-			_dbStats := &kvstore.KStats{}
-			_dbStatsByte, ok := kvStores2.ProteinStore.GetValue([]byte("db_stats"))
-			if !ok {
-				fmt.Println("Couldn't find db stats")
-				os.Exit(1)
+			if err := mergeDB(kvStores1, db, dbStats, nbOfThreads, maxSize); err != nil {
+				return err
 			}
-			proto.Unmarshal(_dbStatsByte, _dbStats)
-			dbStats.NumberOfProteins += _dbStats.NumberOfProteins
-			dbStats.NumberOfAA += _dbStats.NumberOfAA
-			dbStats.NumberOfKmers += _dbStats.NumberOfKmers
-
-			wg := new(sync.WaitGroup)
-			wg.Add(2)
-			go MergeStores(kvStores1.KmerStore.KVStore, kvStores2.KmerStore.KVStore, nbOfThreads, wg)
-			go MergeStores(kvStores1.ProteinStore.KVStore, kvStores2.ProteinStore.KVStore, 2, wg)
-			wg.Wait()
-
-			wg.Add(2)
-			go func(wg *sync.WaitGroup) {
-				defer wg.Done()
-				kvStores1.KmerStore.GarbageCollect(100, 0.5)
-			}(wg)
-			go func(wg *sync.WaitGroup) {
-				defer wg.Done()
-				kvStores1.ProteinStore.GarbageCollect(100, 0.5)
-			}(wg)
-			wg.Wait()
-
-			kvStores2.Close()
 
 		}
 
 	}
 
+	if dbStats.NumberOfDuplicates > 0 {
+		dbStats.DedupRatio = float64(dbStats.NumberOfDuplicates) / float64(dbStats.NumberOfProteins+dbStats.NumberOfDuplicates)
+	}
+
 	data, err := proto.Marshal(dbStats)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 	kvStores1.ProteinStore.OpenInsertChannel()
 	kvStores1.ProteinStore.AddValueToChannel([]byte("db_stats"), data, true)
-	kvStores1.ProteinStore.CloseInsertChannel()
+	if err := kvStores1.ProteinStore.CloseInsertChannel(); err != nil {
+		return err
+	}
 	kvStores1.ProteinStore.Flush()
 
-	kvStores1.KmerStore.DB.Flatten(4)
-	kvStores1.ProteinStore.DB.Flatten(4)
+	if err := statsdb.RemoveReport(kvStores1); err != nil {
+		return err
+	}
+
+	kvStores1.KmerStore.Storage.Flatten(4)
+	kvStores1.ProteinStore.Storage.Flatten(4)
 
 	// Final garbage collect before closing
 	kvStores1.KmerStore.GarbageCollect(100, 0.5)
 	kvStores1.ProteinStore.GarbageCollect(100, 0.5)
-	kvStores1.Close()
-
-}
 
-func MergeStores(kvStore1 *kvstore.KVStore, kvStore2 *kvstore.KVStore, nbOfThreads int, wg *sync.WaitGroup) {
-
-	defer wg.Done()
-	// Stream keys
-	stream := kvStore2.DB.NewStream()
-
-	kvStore1.OpenInsertChannel()
-	// db.NewStreamAt(readTs) for managed mode.
+	return nil
 
-	// -- Optional settings
-	stream.NumGo = nbOfThreads            // Set number of goroutines to use for iteration.
-	stream.Prefix = nil                   // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
+}
 
-	// ChooseKey is called concurrently for every key. If left nil, assumes true by default.
-	stream.ChooseKey = nil
+// mergeDB merges the stores of the database db into kvStores1 and adds its stats to dbStats
+func mergeDB(kvStores1 *kvstore.KVStores, db string, dbStats *kvstore.KStats, nbOfThreads int, maxSize bool) (err error) {
 
-	// KeyToList is called concurrently for chosen keys. This can be used to convert
-	// Badger data into custom key-values. If nil, uses stream.ToList, a default
-	// implementation, which picks all valid key-values.
+	kvStores2, err := kvstore.KVStoresNew(db, 1, maxSize, false, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := kvStores2.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
-	// stream.KeyToList = nil
-	stream.KeyToList = func(key []byte, it *badger.Iterator) (*pb.KVList, error) {
+	if kvStores2.KmerStore.Seed() != kvStores1.KmerStore.Seed() {
+		return fmt.Errorf("Kmer seed of %s (%s) differs from the merged database (%s)", db, kvStores2.KmerStore.Seed(), kvStores1.KmerStore.Seed())
+	}
+	if kvStores2.KmerStore.Alphabet() != kvStores1.KmerStore.Alphabet() {
+		return fmt.Errorf("Alphabet of %s (%s) differs from the merged database (%s)", db, kvStores2.KmerStore.Alphabet(), kvStores1.KmerStore.Alphabet())
+	}
+	if kvStores2.ProteinStore.SequenceEncoding() != kvStores1.ProteinStore.SequenceEncoding() {
+		return fmt.Errorf("Sequence encoding of %s (%s) differs from the merged database (%s)", db, kvStores2.ProteinStore.SequenceEncoding(), kvStores1.ProteinStore.SequenceEncoding())
+	}
 
-		valCopy := []byte{}
-		keyCopy := []byte{}
+	_dbStats, err := kvStores2.GetStats()
+	if err != nil {
+		return fmt.Errorf("%s : %w", db, err)
+	}
+	dbStats.NumberOfProteins += _dbStats.NumberOfProteins
+	dbStats.NumberOfAA += _dbStats.NumberOfAA
+	dbStats.NumberOfKmers += _dbStats.NumberOfKmers
+	dbStats.NumberOfDuplicates += _dbStats.NumberOfDuplicates
+
+	var kmerErr, proteinErr error
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		kmerErr = MergeStores(kvStores1.KmerStore.KVStore, kvStores2.KmerStore.KVStore, nbOfThreads)
+	}()
+	go func() {
+		defer wg.Done()
+		proteinErr = MergeStores(kvStores1.ProteinStore.KVStore, kvStores2.ProteinStore.KVStore, 2)
+	}()
+	wg.Wait()
+	if kmerErr != nil {
+		return kmerErr
+	}
+	if proteinErr != nil {
+		return proteinErr
+	}
 
-		for ; it.Valid(); it.Next() {
+	wg.Add(2)
+	go func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		kvStores1.KmerStore.GarbageCollect(100, 0.5)
+	}(wg)
+	go func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		kvStores1.ProteinStore.GarbageCollect(100, 0.5)
+	}(wg)
+	wg.Wait()
 
-			item := it.Item()
-			if item.IsDeletedOrExpired() {
-				break
-			}
-			if item.DiscardEarlierVersions() {
-				break
-			}
-			if !bytes.Equal(key, item.Key()) {
-				break
-			}
+	return nil
 
-			valCopy, err := item.ValueCopy(valCopy)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+}
 
-			keyCopy = item.KeyCopy(keyCopy)
+func MergeStores(kvStore1 *kvstore.KVStore, kvStore2 *kvstore.KVStore, nbOfThreads int) error {
 
-			kvStore1.AddValueToChannel(keyCopy, valCopy, false)
+	kvStore1.OpenInsertChannel()
 
+	// Stream keys with all their values (versions)
+	err := kvStore2.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		for _, val := range values {
+			kvStore1.AddValueToChannel(key, val, false)
 		}
-
-		return nil, nil
-
-	}
-
-	// -- End of optional settings.
-
-	// Send is called serially, while Stream.Orchestrate is running.
-	stream.Send = nil
-
-	// // Run the stream
-	// Run the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		log.Fatal(err.Error)
-	}
+		return nil
+	})
 
 	// Done.
-	kvStore1.CloseInsertChannel()
-	kvStore1.DB.Sync()
+	if closeErr := kvStore1.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+	kvStore1.Storage.Sync()
 	kvStore1.Flush()
 
+	return err
+
 }
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migratedb
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// Migration from a format version to the next one
+type migration func(kvStores *kvstore.KVStores, kSettings *kvstore.KSettings) error
+
+var migrations = map[int32]migration{
+	0: migrateV0,
+	1: migrateV1,
+	2: migrateV2,
+}
+
+func NewMigrateDB(dbPath string, nbOfThreads int, maxSize bool) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	kvStores, err := kvstore.KVStoresOpen(dbPath, nbOfThreads, maxSize, true, false)
+	if err != nil {
+		return err
+	}
+	defer kvStores.Close()
+
+	kSettings, err := kvStores.GetSettings()
+	if errors.Is(err, kvstore.ErrMissingSettings) {
+		if _, err := kvStores.GetStats(); err != nil {
+			return fmt.Errorf("%w (incomplete makedb ?)", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if kSettings.FormatVersion > kvstore.CurrentFormatVersion {
+		return kvstore.BadFormatError("database format version %d is newer than the supported version %d", kSettings.FormatVersion, kvstore.CurrentFormatVersion)
+	}
+
+	if kSettings.FormatVersion == kvstore.CurrentFormatVersion {
+		fmt.Printf("Database is already at format version %d\n", kSettings.FormatVersion)
+		return nil
+	}
+
+	for kSettings.FormatVersion < kvstore.CurrentFormatVersion {
+		fmt.Printf("# Migrating database from format version %d to %d\n", kSettings.FormatVersion, kSettings.FormatVersion+1)
+		if err := migrations[kSettings.FormatVersion](kvStores, kSettings); err != nil {
+			return err
+		}
+		kSettings.FormatVersion++
+		if err := kvStores.SaveSettings(kSettings); err != nil {
+			return err
+		}
+	}
+
+	if !kSettings.DatabaseIndexed {
+		fmt.Println("Database is not indexed, run kaamer-db -index")
+	}
+
+	return nil
+
+}
+
+// Version 0 databases were built with literal 7-mers and had settings only once indexed
+func migrateV0(kvStores *kvstore.KVStores, kSettings *kvstore.KSettings) error {
+
+	if kSettings.KmerSize == 0 {
+		kSettings.KmerSize = kvstore.DefaultKmerSize
+	}
+	if kSettings.Alphabet == "" {
+		kSettings.Alphabet = kvstore.LiteralAlphabet
+	}
+
+	return nil
+
+}
+
+// Version 1 databases were indexed with protobuf kcomb values
+func migrateV1(kvStores *kvstore.KVStores, kSettings *kvstore.KSettings) error {
+
+	if kSettings.DatabaseIndexed && kSettings.KCombEncoding == "" {
+		kSettings.KCombEncoding = kvstore.KCombEncodingProto
+		kvStores.KCombStore.SetEncoding(kvstore.KCombEncodingProto)
+	}
+
+	return nil
+
+}
+
+// Version 2 databases stored the sequence inside the protein annotations
+func migrateV2(kvStores *kvstore.KVStores, kSettings *kvstore.KSettings) error {
+
+	kSettings.SequenceEncoding = kvstore.SequenceEncodingRaw
+	kvStores.ProteinStore.SetSequenceEncoding(kvstore.SequenceEncodingRaw)
+
+	proteinStore := kvStores.ProteinStore
+	proteinStore.OpenInsertChannel()
+
+	err := proteinStore.Storage.Stream(nil, proteinStore.NbOfThreads, func(key []byte, values [][]byte) error {
+		// protein ids only (not the db_stats / db_settings entries)
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+		prot := &kvstore.Protein{}
+		if err := proto.Unmarshal(values[0], prot); err != nil {
+			return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+		}
+		if prot.Sequence != "" {
+			return proteinStore.AddProteinToChannel(key, prot)
+		}
+		return nil
+	})
+
+	if closeErr := proteinStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+
+	return err
+
+}
@@ -0,0 +1,477 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package removedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zorino/kaamer/pkg/filterdb"
+	"github.com/zorino/kaamer/pkg/kvstore"
+	"github.com/zorino/kaamer/pkg/statsdb"
+)
+
+// changes of the protein_store
+type proteinChanges struct {
+	removed        map[uint32]*kvstore.Protein // proteins without any entry left
+	updated        map[uint32]*kvstore.Protein // proteins with some of their entries removed (new annotations)
+	previous       map[uint32]*kvstore.Protein // annotations of the updated proteins before the removal
+	nbOfEntries    uint64                      // entries removed
+	nbOfDuplicates uint64                      // members removed
+}
+
+// NewRemoveDB removes the protein entries listed in entryIds or matching the filter from an indexed database
+// a protein keeps its kmers as long as one of its entries (deduplicated members) is left,
+// otherwise its kmers point to new kcomb sets without it and the kmers left without protein are dropped
+func NewRemoveDB(dbPath string, entryIds map[string]bool, filter *filterdb.Filter, nbOfThreads int, maxSize bool) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	if len(entryIds) == 0 && filter.IsEmpty() {
+		return errors.New("No entry to remove (-ids, -organism, -taxonomy, -ec or -taxids) !")
+	}
+
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, maxSize, true, false)
+	if err != nil {
+		return err
+	}
+	if err := removeDB(kvStores, entryIds, filter, nbOfThreads); err != nil {
+		kvStores.Close()
+		return err
+	}
+
+	// the exported kmer index is stale
+	kvstore.RemoveKmerIndex(dbPath)
+
+	return kvStores.Close()
+
+}
+
+func removeDB(kvStores *kvstore.KVStores, entryIds map[string]bool, filter *filterdb.Filter, nbOfThreads int) error {
+
+	kSettings, err := kvStores.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) {
+		return err
+	}
+	if !kSettings.DatabaseIndexed {
+		return fmt.Errorf("%w (run kaamer-db -index)", kvstore.ErrNotIndexed)
+	}
+	dbStats, err := kvStores.GetStats()
+	if err != nil {
+		return err
+	}
+
+	isRemoved := func(entry *kvstore.Protein) bool {
+		return entryIds[entry.EntryId] || (!filter.IsEmpty() && filter.Match(entry))
+	}
+	changes, err := findProteins(kvStores, isRemoved, nbOfThreads)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Removing %d entries (%d proteins without entry left)\n", changes.nbOfEntries, len(changes.removed))
+	if changes.nbOfEntries == 0 {
+		return nil
+	}
+
+	// the ids of the removed proteins are never given again (see -add)
+	if kSettings.LastProteinId, err = kvStores.LastProteinId(nbOfThreads); err != nil {
+		return err
+	}
+	if err := kvStores.SaveSettings(kSettings); err != nil {
+		return err
+	}
+
+	// sequences of the removed proteins (for their kmers)
+	removedIds := make([][]byte, 0, len(changes.removed))
+	for id := range changes.removed {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		removedIds = append(removedIds, proteinId)
+	}
+	sequences := make(map[uint32]string)
+	for start := 0; start < len(removedIds); start += 1000 {
+		end := start + 1000
+		if end > len(removedIds) {
+			end = len(removedIds)
+		}
+		proteins, err := kvStores.ProteinStore.GetProteins(removedIds[start:end], true)
+		if err != nil {
+			return err
+		}
+		for i, prot := range proteins {
+			if prot != nil {
+				sequences[binary.BigEndian.Uint32(removedIds[start+i])] = prot.Sequence
+			}
+		}
+	}
+
+	if err := updateProteins(kvStores, changes, kSettings); err != nil {
+		return err
+	}
+
+	if err := removeKmers(kvStores, sequences, dbStats); err != nil {
+		return err
+	}
+
+	if err := removeKCombSets(kvStores, changes.removed, nbOfThreads); err != nil {
+		return err
+	}
+
+	// stats
+	kmerSize := kvStores.KmerStore.KmerSize()
+	for _, prot := range changes.removed {
+		dbStats.NumberOfProteins--
+		dbStats.NumberOfAA -= uint64(prot.Length)
+		if int(prot.Length) >= kmerSize {
+			dbStats.NumberOfKmers -= uint64(int(prot.Length) - kmerSize + 1)
+		}
+	}
+	dbStats.NumberOfDuplicates -= changes.nbOfDuplicates
+	dbStats.DedupRatio = 0
+	if dbStats.NumberOfDuplicates > 0 {
+		dbStats.DedupRatio = float64(dbStats.NumberOfDuplicates) / float64(dbStats.NumberOfProteins+dbStats.NumberOfDuplicates)
+	}
+	if dbStats.NumberOfKCombSets, err = kvStores.KCombStore.CountKeys(nil); err != nil {
+		return err
+	}
+	if err := kvStores.SaveStats(dbStats); err != nil {
+		return err
+	}
+
+	return statsdb.RemoveReport(kvStores)
+
+}
+
+// findProteins returns the proteins with removed entries
+func findProteins(kvStores *kvstore.KVStores, isRemoved func(*kvstore.Protein) bool, nbOfThreads int) (*proteinChanges, error) {
+
+	changes := &proteinChanges{
+		removed:  make(map[uint32]*kvstore.Protein),
+		updated:  make(map[uint32]*kvstore.Protein),
+		previous: make(map[uint32]*kvstore.Protein),
+	}
+	mu := new(sync.Mutex)
+
+	err := kvStores.ProteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+		prot := &kvstore.Protein{}
+		if err := proto.Unmarshal(values[0], prot); err != nil {
+			return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+		}
+
+		// the first entry left represents the protein
+		entries := append([]*kvstore.Protein{prot}, prot.Members...)
+		kept := []*kvstore.Protein{}
+		for _, entry := range entries {
+			if !isRemoved(entry) {
+				kept = append(kept, &kvstore.Protein{EntryId: entry.EntryId, Length: entry.Length, Features: entry.Features})
+			}
+		}
+		if len(kept) == len(entries) {
+			return nil
+		}
+
+		id := binary.BigEndian.Uint32(key)
+		mu.Lock()
+		defer mu.Unlock()
+		changes.nbOfEntries += uint64(len(entries) - len(kept))
+		if len(kept) == 0 {
+			changes.removed[id] = prot
+			changes.nbOfDuplicates += uint64(len(prot.Members))
+			return nil
+		}
+		protein := kept[0]
+		protein.Length = prot.Length
+		if len(kept) > 1 {
+			protein.Members = kept[1:]
+		}
+		changes.updated[id] = protein
+		changes.previous[id] = prot
+		changes.nbOfDuplicates += uint64(len(entries) - len(kept))
+
+		return nil
+
+	})
+
+	return changes, err
+
+}
+
+// updateProteins deletes the removed proteins and saves the updated ones with their EntryId and names index
+func updateProteins(kvStores *kvstore.KVStores, changes *proteinChanges, kSettings *kvstore.KSettings) error {
+
+	proteinStore := kvStores.ProteinStore
+
+	// EntryId keys are only deleted when they still point to the protein
+	deleteEntryId := func(batch kvstore.Batch, entryId string, proteinId []byte) error {
+		if val, ok := proteinStore.GetProteinKey(entryId); ok && bytes.Equal(val, proteinId) {
+			return batch.Delete(kvstore.EntryIdKey(entryId))
+		}
+		return nil
+	}
+
+	batch := proteinStore.Storage.NewBatch()
+	for id, prot := range changes.removed {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		if err := batch.Delete(proteinId); err != nil {
+			return err
+		}
+		if err := batch.Delete(kvstore.SequenceKey(proteinId)); err != nil {
+			return err
+		}
+		for _, entry := range append([]*kvstore.Protein{prot}, prot.Members...) {
+			if err := deleteEntryId(batch, entry.EntryId, proteinId); err != nil {
+				return err
+			}
+		}
+		for _, key := range kvstore.NameKeys(proteinId, prot) {
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	for id, prot := range changes.previous {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		kept := make(map[string]bool)
+		for _, entry := range append([]*kvstore.Protein{changes.updated[id]}, changes.updated[id].Members...) {
+			kept[entry.EntryId] = true
+		}
+		for _, entry := range append([]*kvstore.Protein{prot}, prot.Members...) {
+			if !kept[entry.EntryId] {
+				if err := deleteEntryId(batch, entry.EntryId, proteinId); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range kvstore.NameKeys(proteinId, prot) {
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	// annotations of the updated proteins (the sequence is unchanged)
+	proteinStore.OpenInsertChannel()
+	var err error
+	for id, protein := range changes.updated {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		var data []byte
+		if data, err = proto.Marshal(protein); err != nil {
+			break
+		}
+		proteinStore.AddValueToChannel(proteinId, data, false)
+		if kSettings.IDsIndexed {
+			proteinStore.AddValueToChannel(kvstore.EntryIdKey(protein.EntryId), proteinId, false)
+		}
+		if kSettings.NamesIndexed {
+			proteinStore.AddNamesToChannel(proteinId, protein)
+		}
+	}
+	if closeErr := proteinStore.CloseInsertChannel(); err == nil {
+		err = closeErr
+	}
+
+	return err
+
+}
+
+// removeKmers removes the proteins from the kcomb set of their kmers (new kcomb sets)
+// and deletes the kmers left without protein
+func removeKmers(kvStores *kvstore.KVStores, sequences map[uint32]string, dbStats *kvstore.KStats) error {
+
+	fmt.Println("# Removing the kmers of the proteins from the key combination store")
+
+	kmerSize := kvStores.KmerStore.KmerSize()
+	kmerProteins := make(map[string]map[uint32]bool)
+	for id, sequence := range sequences {
+		for i := 0; i < len(sequence)-kmerSize+1; i++ {
+			kmerKey := string(kvStores.KmerStore.CreateBytesKey(sequence[i : i+kmerSize]))
+			if kmerProteins[kmerKey] == nil {
+				kmerProteins[kmerKey] = make(map[uint32]bool)
+			}
+			kmerProteins[kmerKey][id] = true
+		}
+	}
+
+	stopKmers := make(map[string]*kvstore.StopKmer)
+	for _, stopKmer := range dbStats.StopKmers {
+		stopKmers[stopKmer.Kmer] = stopKmer
+	}
+
+	kmerUpdates := make(map[string][]byte)
+	kmersDeleted := 0
+
+	kvStores.KCombStore.OpenKCombBatch()
+
+	var err error
+	for kmerKey, removedIds := range kmerProteins {
+
+		key := []byte(kmerKey)
+		var combKey []byte
+		if combKey, err = kvStores.KmerStore.Storage.Get(key); err == kvstore.ErrKeyNotFound {
+			err = nil
+			continue
+		} else if err != nil {
+			break
+		}
+
+		if bytes.Equal(combKey, kvstore.StopKmerValue) {
+			if stopKmer, ok := stopKmers[kvStores.KmerStore.DecodeKmer(key)]; ok {
+				if stopKmer.NumberOfProteins > uint64(len(removedIds)) {
+					stopKmer.NumberOfProteins -= uint64(len(removedIds))
+				} else {
+					delete(stopKmers, stopKmer.Kmer)
+					kmerUpdates[kmerKey] = nil
+					kmersDeleted++
+				}
+			}
+			continue
+		}
+
+		var combVal []byte
+		if combVal, err = kvStores.KCombStore.Storage.Get(combKey); err != nil {
+			err = fmt.Errorf("kmer %x kcomb : %w", key, err)
+			break
+		}
+		var ids []uint32
+		if ids, err = kvStores.KCombStore.DecodeProteinKeys(combVal); err != nil {
+			break
+		}
+		keys := [][]byte{}
+		for _, id := range ids {
+			if !removedIds[id] {
+				proteinId := make([]byte, 4)
+				binary.BigEndian.PutUint32(proteinId, id)
+				keys = append(keys, proteinId)
+			}
+		}
+		if len(keys) == len(ids) {
+			continue
+		}
+		if len(keys) == 0 {
+			kmerUpdates[kmerKey] = nil
+			kmersDeleted++
+			continue
+		}
+
+		var newCombKey []byte
+		if newCombKey, err = kvStores.KCombStore.CreateKCombKey(keys); err != nil {
+			break
+		}
+		kmerUpdates[kmerKey] = newCombKey
+
+	}
+
+	if closeErr := kvStores.KCombStore.CloseKCombBatch(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// deleted first to drop the older versions (as done by UpdateValue)
+	batch := kvStores.KmerStore.Storage.NewBatch()
+	for key := range kmerUpdates {
+		if err := batch.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+	batch = kvStores.KmerStore.Storage.NewBatch()
+	for key, val := range kmerUpdates {
+		if val == nil {
+			continue
+		}
+		if err := batch.Set([]byte(key), val); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("# %d kmers updated (%d deleted)\n", len(kmerUpdates), kmersDeleted)
+
+	dbStats.StopKmers = make([]*kvstore.StopKmer, 0, len(stopKmers))
+	for _, stopKmer := range stopKmers {
+		dbStats.StopKmers = append(dbStats.StopKmers, stopKmer)
+	}
+	sort.Slice(dbStats.StopKmers, func(i, j int) bool {
+		return dbStats.StopKmers[i].NumberOfProteins > dbStats.StopKmers[j].NumberOfProteins
+	})
+
+	return nil
+
+}
+
+// removeKCombSets deletes the kcomb sets holding a removed protein
+// (none of them is used anymore once the kmers of the removed proteins point to their new kcomb set)
+func removeKCombSets(kvStores *kvstore.KVStores, removed map[uint32]*kvstore.Protein, nbOfThreads int) error {
+
+	kCombKeys := [][]byte{}
+	mu := new(sync.Mutex)
+
+	err := kvStores.KCombStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		ids, err := kvStores.KCombStore.DecodeProteinKeys(values[0])
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, ok := removed[id]; ok {
+				mu.Lock()
+				kCombKeys = append(kCombKeys, append([]byte{}, key...))
+				mu.Unlock()
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := kvStores.KCombStore.Storage.NewBatch()
+	for _, key := range kCombKeys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+
+}
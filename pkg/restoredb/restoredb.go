@@ -17,7 +17,6 @@ limitations under the License.
 package restoredb
 
 import (
-	"log"
 	"os"
 	"runtime"
 
@@ -25,7 +24,7 @@ import (
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-func RestoreDB(backupPath string, output string, maxSize bool) {
+func RestoreDB(backupPath string, output string, maxSize bool) error {
 	// For SSD throughput (as done in badger/graphdb) see :
 	// https://groups.google.com/forum/#!topic/golang-nuts/jPb_h3TvlKE/discussion
 	runtime.GOMAXPROCS(128)
@@ -42,14 +41,20 @@ func RestoreDB(backupPath string, output string, maxSize bool) {
 
 	// kvStores1 := kvstore.KVStoresNew(dbPath, nbOfThreads, options.MemoryMap, options.FileIO)
 
-	Restore(backupPath+"/kmer_store.bdg", output+"/kmer_store", maxSize)
-	Restore(backupPath+"/protein_store.bdg", output+"/protein_store", maxSize)
+	if err := Restore(backupPath+"/kmer_store.bdg", output+"/kmer_store", maxSize); err != nil {
+		return err
+	}
+	if err := Restore(backupPath+"/protein_store.bdg", output+"/protein_store", maxSize); err != nil {
+		return err
+	}
 
 	// kvStores1.Close()
 
+	return nil
+
 }
 
-func Restore(backupFile string, storeDir string, maxSize bool) {
+func Restore(backupFile string, storeDir string, maxSize bool) error {
 
 	opts := badger.DefaultOptions(storeDir)
 	opts.Dir = storeDir
@@ -61,17 +66,20 @@ func Restore(backupFile string, storeDir string, maxSize bool) {
 
 	db, err := badger.Open(opts)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
 	backupFileReader, err := os.Open(backupFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		db.Close()
+		return err
 	}
+	defer backupFileReader.Close()
 
 	err = db.Load(backupFileReader, 100)
 	if err != nil {
-		log.Fatal(err.Error())
+		db.Close()
+		return err
 	}
 
 	db.Flatten(8)
@@ -83,6 +91,6 @@ again:
 		goto again
 	}
 
-	db.Close()
+	return db.Close()
 
 }
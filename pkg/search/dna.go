@@ -17,6 +17,7 @@ limitations under the License.
 package search
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 )
@@ -62,6 +63,34 @@ func ReverseComplement(dna string) string {
 
 }
 
+// TranslateCDS translates a coding sequence with one of the GCodes, a start codon in first position
+// is read as a methionine (startCodon) and the final stop codon is dropped,
+// codons with ambiguous bases give X and the trailing incomplete codon is ignored
+func TranslateCDS(dna string, geneticCode int, startCodon bool) (string, error) {
+
+	gcode, ok := GCodes[geneticCode]
+	if !ok {
+		return "", fmt.Errorf("Genetic code %d unsupported", geneticCode)
+	}
+
+	dna = strings.ToLower(dna)
+	protein := make([]byte, 0, len(dna)/3)
+
+	for i := 0; i+3 <= len(dna); i += 3 {
+		aa, ok := gcode[dna[i:i+3]]
+		if !ok {
+			protein = append(protein, 'X')
+		} else if i == 0 && startCodon && aa.Start {
+			protein = append(protein, 'M')
+		} else {
+			protein = append(protein, aa.AA[0])
+		}
+	}
+
+	return strings.TrimSuffix(string(protein), "*"), nil
+
+}
+
 func GetORFs(dna string, geneticCode int) []ORF {
 
 	orfs := []ORF{}
@@ -195,7 +224,7 @@ func GetFrame(frameNumber int, dna string) string {
 
 }
 
-func SetBestStartCodon(queryResult *QueryResult) {
+func SetBestStartCodon(queryResult *QueryResult, kmerSize int) {
 
 	var bestHits []Hit
 	bestHitScore := int64(0)
@@ -260,7 +289,7 @@ func SetBestStartCodon(queryResult *QueryResult) {
 		for _k, _positions := range queryResult.SearchResults.PositionHits {
 			queryResult.SearchResults.PositionHits[_k] = _positions[bestStart:]
 		}
-		queryResult.Query.SizeInKmer = len(queryResult.Query.Sequence) - KMER_SIZE + 1
+		queryResult.Query.SizeInKmer = len(queryResult.Query.Sequence) - kmerSize + 1
 		if queryResult.Query.Sequence[len(queryResult.Query.Sequence)-1:] == "*" {
 			queryResult.Query.SizeInKmer = queryResult.Query.SizeInKmer - 1
 		}
@@ -276,7 +305,7 @@ Below are unused functions
 Keep for furtur references
 */
 
-func ResolveORFs(queryResults []QueryResult) []QueryResult {
+func ResolveORFs(queryResults []QueryResult, kmerSize int) []QueryResult {
 
 	goodResults := new([]QueryResult)
 	var startPositions []int
@@ -293,7 +322,7 @@ func ResolveORFs(queryResults []QueryResult) []QueryResult {
 	})
 
 	for _, r := range queryResults {
-		SetBestStartCodon(&r)
+		SetBestStartCodon(&r, kmerSize)
 		PruneORFs(r, &startPositions, &endPositions, goodResults)
 	}
 
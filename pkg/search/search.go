@@ -22,7 +22,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"regexp"
@@ -32,7 +32,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	cnt "github.com/zorino/counters"
 	"github.com/zorino/kaamer/pkg/align"
 	"github.com/zorino/kaamer/pkg/kvstore"
@@ -42,7 +41,6 @@ const (
 	NUCLEOTIDE    = 0
 	PROTEIN       = 1
 	READS         = 2
-	KMER_SIZE     = 7
 	DNA_QUERY     = "DNA Query"
 	PROTEIN_QUERY = "Protein Query"
 )
@@ -70,10 +68,17 @@ type SearchOptions struct {
 	MinKRatio        float64
 }
 
+// NeedSequences tells if the hit sequences are part of the output (alignment or json)
+func (searchOptions SearchOptions) NeedSequences() bool {
+	return searchOptions.Align || searchOptions.OutFormat == "json"
+}
+
 type SearchResults struct {
 	Counter      *cnt.CounterBox
 	Hits         HitList
 	PositionHits map[uint32][]bool
+	StopKmers    int   // query kmers skipped as stop kmers of the database
+	Err          error `json:"-"` // first kmer lookup error, the query fails
 }
 
 type KeyPos struct {
@@ -139,7 +144,7 @@ func sortMapByValue(hitFrequencies *sync.Map) HitList {
 		if okKey && okValue {
 			idUint32, err := strconv.Atoi(key)
 			if err != nil {
-				log.Fatal(err.Error())
+				return true
 			}
 			pl[i] = Hit{uint32(idUint32), item.Value(), &align.AlignmentResult{}}
 			i++
@@ -147,11 +152,18 @@ func sortMapByValue(hitFrequencies *sync.Map) HitList {
 		return true
 	})
 
+	pl = pl[:i]
 	sort.Sort(sort.Reverse(pl))
 	return pl
 }
 
-func NewSearchResult(searchOptions SearchOptions, _dbStats kvstore.KStats, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, r *http.Request) []QueryResult {
+// NewSearchResult runs the search and writes its results to w
+// (check the query file with CheckQueryFile first, errors are returned once the response is started)
+func NewSearchResult(searchOptions SearchOptions, _dbStats kvstore.KStats, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, r *http.Request) ([]QueryResult, error) {
+
+	if searchOptions.InputType != "path" {
+		defer os.Remove(searchOptions.File)
+	}
 
 	// Query cancellation
 	cancelQuery := false
@@ -169,21 +181,28 @@ func NewSearchResult(searchOptions SearchOptions, _dbStats kvstore.KStats, kvSto
 
 	dbStats = _dbStats
 
+	var err error
 	switch searchOptions.SequenceType {
 	case READS:
-		FastqSearch(searchOptions, kvStores, nbOfThreads, w, true, &cancelQuery)
+		err = FastqSearch(searchOptions, kvStores, nbOfThreads, w, true, &cancelQuery)
 	case NUCLEOTIDE:
-		NucleotideSearch(searchOptions, kvStores, nbOfThreads, w, false, &cancelQuery)
+		err = NucleotideSearch(searchOptions, kvStores, nbOfThreads, w, false, &cancelQuery)
 	case PROTEIN:
-		ProteinSearch(searchOptions, kvStores, nbOfThreads, w, &cancelQuery)
+		err = ProteinSearch(searchOptions, kvStores, nbOfThreads, w, &cancelQuery)
 	}
 
-	if searchOptions.InputType != "path" {
-		os.Remove(searchOptions.File)
-	}
+	return queryResults, err
 
-	return queryResults
+}
 
+// KMatchRatio returns the fraction of the query kmers matched by a hit,
+// the stop kmers of the query can't match and are left out
+func (queryResult *QueryResult) KMatchRatio(hit Hit) float64 {
+	searchableKmers := queryResult.Query.SizeInKmer - queryResult.SearchResults.StopKmers
+	if searchableKmers < 1 {
+		searchableKmers = 1
+	}
+	return float64(hit.Kmatch) / float64(searchableKmers)
 }
 
 func (queryResult *QueryResult) FilterResults(searchOptions SearchOptions) {
@@ -192,7 +211,7 @@ func (queryResult *QueryResult) FilterResults(searchOptions SearchOptions) {
 	var lastGoodHitPosition = len(queryResult.SearchResults.Hits) - 1
 
 	for i, hit := range queryResult.SearchResults.Hits {
-		if (float64(hit.Kmatch)/float64(queryResult.Query.SizeInKmer)) < searchOptions.MinKRatio || hit.Kmatch < searchOptions.MinKMatch {
+		if queryResult.KMatchRatio(hit) < searchOptions.MinKRatio || hit.Kmatch < searchOptions.MinKMatch {
 			if lastGoodHitPosition == (len(queryResult.SearchResults.Hits) - 1) {
 				lastGoodHitPosition = i - 1
 			}
@@ -219,7 +238,44 @@ func (queryResult *QueryResult) FilterResults(searchOptions SearchOptions) {
 
 }
 
-func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, cancelQuery *bool) {
+// CheckQueryFile tells if a query file can be read (plain text or gzip, not empty)
+func CheckQueryFile(fileName string) error {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = queryFileType(file)
+	return err
+
+}
+
+// queryFileType returns the content type of a query file and rewinds it
+func queryFileType(file *os.File) (string, error) {
+
+	buff := make([]byte, 32)
+	n, err := file.Read(buff)
+	if err == io.EOF || n == 0 {
+		return "", kvstore.BadFormatError("empty query file")
+	} else if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	filetype := http.DetectContentType(buff[:n])
+	if filetype != "application/x-gzip" && filetype != "text/plain; charset=utf-8" {
+		return "", kvstore.BadFormatError("query file of type %s, expecting text or gzip", filetype)
+	}
+
+	return filetype, nil
+
+}
+
+func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, kmerSize int, cancelQuery *bool) error {
 
 	loc := Location{
 		StartPosition:     1,
@@ -238,36 +294,28 @@ func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, ca
 
 	// queries := []Query{}
 	file, err := os.Open(fileName)
-	defer file.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer file.Close()
 
 	// check filetype
-	buff := make([]byte, 32)
-	_, err = file.Read(buff)
+	filetype, err := queryFileType(file)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	file.Seek(0, 0)
-
-	filetype := http.DetectContentType(buff)
 
 	scanner := new(bufio.Scanner)
 
 	if filetype == "application/x-gzip" {
 		gz, err := gzip.NewReader(file)
 		if err != nil {
-			fmt.Println(err.Error())
-			return
+			return err
 		}
 		scanner = bufio.NewScanner(gz)
 		defer gz.Close()
-	} else if filetype == "text/plain; charset=utf-8" {
-		scanner = bufio.NewScanner(file)
 	} else {
-		return
+		scanner = bufio.NewScanner(file)
 	}
 
 	buf := make([]byte, 0, 64*1024)
@@ -287,7 +335,7 @@ func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, ca
 		}
 		if l[0] == '>' {
 			if query.Sequence != "" {
-				query.SizeInKmer = len(query.Sequence) - KMER_SIZE + 1
+				query.SizeInKmer = len(query.Sequence) - kmerSize + 1
 				if query.Sequence[len(query.Sequence)-1:] == "*" {
 					query.SizeInKmer--
 				}
@@ -311,7 +359,7 @@ func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, ca
 	}
 
 	if query.Sequence != "" {
-		query.SizeInKmer = len(query.Sequence) - KMER_SIZE + 1
+		query.SizeInKmer = len(query.Sequence) - kmerSize + 1
 		if query.Sequence[len(query.Sequence)-1:] == "*" {
 			query.SizeInKmer--
 		}
@@ -319,9 +367,11 @@ func GetQueriesFasta(fileName string, queryChan chan<- Query, isProtein bool, ca
 		queryChan <- query
 	}
 
+	return scanner.Err()
+
 }
 
-func GetQueriesFastq(fileName string, queryChan chan<- Query, cancelQuery *bool) {
+func GetQueriesFastq(fileName string, queryChan chan<- Query, kmerSize int, cancelQuery *bool) error {
 
 	loc := Location{
 		StartPosition:     1,
@@ -340,21 +390,16 @@ func GetQueriesFastq(fileName string, queryChan chan<- Query, cancelQuery *bool)
 
 	// queries := []Query{}
 	file, err := os.Open(fileName)
-	defer file.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer file.Close()
 
 	// check filetype
-	buff := make([]byte, 32)
-	_, err = file.Read(buff)
+	filetype, err := queryFileType(file)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	file.Seek(0, 0)
-
-	filetype := http.DetectContentType(buff)
 
 	scanner := new(bufio.Scanner)
 
@@ -362,15 +407,12 @@ func GetQueriesFastq(fileName string, queryChan chan<- Query, cancelQuery *bool)
 		// fmt.Println("Loaded gzip file")
 		gz, err := gzip.NewReader(file)
 		if err != nil {
-			fmt.Println(err.Error())
-			return
+			return err
 		}
 		scanner = bufio.NewScanner(gz)
-		// defer gz.Close()
-	} else if filetype == "text/plain; charset=utf-8" {
-		scanner = bufio.NewScanner(file)
+		defer gz.Close()
 	} else {
-		return
+		scanner = bufio.NewScanner(file)
 	}
 
 	isSequence := regexp.MustCompile(`^[ATGCNatgcn]+$`).MatchString
@@ -392,7 +434,7 @@ func GetQueriesFastq(fileName string, queryChan chan<- Query, cancelQuery *bool)
 		if l[0] == '@' {
 			seqNb += 1
 			if query.Sequence != "" {
-				query.SizeInKmer = len(query.Sequence) - KMER_SIZE + 1
+				query.SizeInKmer = len(query.Sequence) - kmerSize + 1
 				query.Location.EndPosition = len(query.Sequence)
 				queryChan <- query
 				query = Query{Sequence: "", Name: "", SizeInKmer: 0}
@@ -404,11 +446,13 @@ func GetQueriesFastq(fileName string, queryChan chan<- Query, cancelQuery *bool)
 	}
 
 	if query.Sequence != "" {
-		query.SizeInKmer = len(query.Sequence) - KMER_SIZE + 1
+		query.SizeInKmer = len(query.Sequence) - kmerSize + 1
 		query.Location.EndPosition = len(query.Sequence)
 		queryChan <- query
 	}
 
+	return scanner.Err()
+
 }
 
 func (searchRes *SearchResults) KmerSearch(keyChan <-chan KeyPos, kvStores *kvstore.KVStores, wg *sync.WaitGroup, matchPositionChan chan<- MatchPosition, searchOptions SearchOptions) {
@@ -418,22 +462,25 @@ func (searchRes *SearchResults) KmerSearch(keyChan <-chan KeyPos, kvStores *kvst
 	defer wg.Done()
 	for keyPos := range keyChan {
 
-		if kCombId, err := kvStores.KmerStore.GetValueFromBadger(keyPos.Key); err == nil {
-
-			if len(kCombId) < 1 {
-				continue
-			}
-
-			kCombVal, _ := kvStores.KCombStore.GetValueFromBadger(kCombId)
-			kC := &kvstore.KComb{}
-			proto.Unmarshal(kCombVal, kC)
+		// the remaining keys are drained after an error
+		if searchRes.Err != nil {
+			continue
+		}
 
-			for _, id := range kC.ProteinKeys {
+		proteinKeys, err := kvStores.GetProteinKeys(keyPos.Key)
+		switch err {
+		case nil:
+			for _, id := range proteinKeys {
 				searchRes.Counter.GetCounter(strconv.Itoa(int(id))).Increment()
 				if extractPos {
 					matchPositionChan <- MatchPosition{HitId: id, QPos: keyPos.Pos, QSize: keyPos.QSize}
 				}
 			}
+		case kvstore.ErrStopKmer:
+			searchRes.StopKmers++
+		case kvstore.ErrKeyNotFound:
+		default:
+			searchRes.Err = err
 		}
 	}
 
@@ -451,25 +498,58 @@ func (searchRes *SearchResults) StoreMatchPositions(matchPosition <-chan MatchPo
 
 }
 
-func (queryResult *QueryResult) FetchHitsInformation(kvStores *kvstore.KVStores) {
+// FetchHitsInformation loads the hit proteins, with their sequence only when needed
+// (the hits missing from the protein_store are left out of HitEntries)
+func (queryResult *QueryResult) FetchHitsInformation(kvStores *kvstore.KVStores, withSequence bool) error {
 
+	hitKeys := []uint32{}
+	proteinIds := [][]byte{}
 	for _, h := range queryResult.SearchResults.Hits {
 		if _, ok := queryResult.HitEntries[h.Key]; !ok {
 			proteinId := make([]byte, 4)
 			binary.BigEndian.PutUint32(proteinId, h.Key)
-			val, err := kvStores.ProteinStore.GetValueFromBadger(proteinId)
-			if err != nil {
-				return
-			}
-			prot := &kvstore.Protein{}
-			proto.Unmarshal(val, prot)
-			queryResult.HitEntries[h.Key] = *prot
+			hitKeys = append(hitKeys, h.Key)
+			proteinIds = append(proteinIds, proteinId)
+		}
+	}
+
+	proteins, err := kvStores.ProteinStore.GetProteins(proteinIds, withSequence)
+	if err != nil {
+		return err
+	}
+
+	for i, prot := range proteins {
+		if prot == nil {
+			continue
 		}
+		queryResult.HitEntries[hitKeys[i]] = *prot
 	}
 
+	return nil
+
+}
+
+// searchError keeps the first error of the query searches
+type searchError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *searchError) set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+func (e *searchError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
 }
 
-func QueryResultHandler(queryResult <-chan QueryResult, queryWriter chan<- []byte, w http.ResponseWriter, wg *sync.WaitGroup, searchOptions SearchOptions) {
+func QueryResultHandler(queryResult <-chan QueryResult, queryWriter chan<- []byte, w http.ResponseWriter, wg *sync.WaitGroup, searchOptions SearchOptions, kmerSize int) {
 
 	defer wg.Done()
 
@@ -511,14 +591,14 @@ func QueryResultHandler(queryResult <-chan QueryResult, queryWriter chan<- []byt
 				output += "\t"
 				output += qR.HitEntries[h.Key].EntryId
 				output += "\t"
-				output += fmt.Sprintf("%.2f", (float32(h.Kmatch) / float32(qR.Query.SizeInKmer) * float32(100.00)))
+				output += fmt.Sprintf("%.2f", qR.KMatchRatio(h)*100)
 				output += "\t"
 				output += strconv.Itoa(qR.Query.SizeInKmer)
 				output += "\t"
 				output += strconv.Itoa(int(h.Kmatch))
 				output += "\t"
 				if searchOptions.ExtractPositions {
-					posString = FormatPositionsToString(qR.SearchResults.PositionHits[h.Key], false)
+					posString = FormatPositionsToString(qR.SearchResults.PositionHits[h.Key], false, kmerSize)
 					output += fmt.Sprintf("%d", strings.Count(posString, ","))
 				} else {
 					output += "N/A"
@@ -590,7 +670,7 @@ func QueryResultHandler(queryResult <-chan QueryResult, queryWriter chan<- []byt
 
 				if searchOptions.ExtractPositions {
 					output += "\t"
-					output += FormatPositionsToString(qR.SearchResults.PositionHits[h.Key], true)
+					output += FormatPositionsToString(qR.SearchResults.PositionHits[h.Key], true, kmerSize)
 				}
 
 				if searchOptions.Annotations {
@@ -691,7 +771,7 @@ func SetResponseFormatAndHeader(w http.ResponseWriter, searchOptions SearchOptio
 
 }
 
-func FormatPositionsToString(positions []bool, withAlignment bool) string {
+func FormatPositionsToString(positions []bool, withAlignment bool, kmerSize int) string {
 
 	currentStart := 0
 	inSequence := false
@@ -712,7 +792,7 @@ func FormatPositionsToString(positions []bool, withAlignment bool) string {
 					}
 					endPos = pos + 1
 					if withAlignment {
-						endPos = endPos + KMER_SIZE - 1
+						endPos = endPos + kmerSize - 1
 					}
 					positionsString += (strconv.Itoa(currentStart) + "-" + (strconv.Itoa(endPos)))
 					inSequence = false
@@ -732,7 +812,7 @@ func FormatPositionsToString(positions []bool, withAlignment bool) string {
 		}
 		endPos = len(positions)
 		if withAlignment {
-			endPos = endPos + KMER_SIZE - 1
+			endPos = endPos + kmerSize - 1
 		}
 		positionsString += (strconv.Itoa(currentStart) + "-" + (strconv.Itoa(endPos)))
 	}
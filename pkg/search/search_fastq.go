@@ -24,21 +24,23 @@ import (
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, fastq bool, cancelQuery *bool) {
+func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, fastq bool, cancelQuery *bool) error {
 
 	file := searchOptions.File
+	kmerSize := kvStores.KmerStore.KmerSize()
 
 	queryChan := make(chan Query)
 
 	wgReader := new(sync.WaitGroup)
 	wgReader.Add(1)
+	var readErr error
 
 	go func() {
 		defer wgReader.Done()
 		if fastq {
-			GetQueriesFastq(file, queryChan, cancelQuery)
+			readErr = GetQueriesFastq(file, queryChan, kmerSize, cancelQuery)
 		} else {
-			GetQueriesFasta(file, queryChan, false, cancelQuery)
+			readErr = GetQueriesFasta(file, queryChan, false, kmerSize, cancelQuery)
 		}
 		close(queryChan)
 	}()
@@ -54,10 +56,11 @@ func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfTh
 	wgResHandler := new(sync.WaitGroup)
 	for i := 0; i < nbOfThreads; i++ {
 		wgResHandler.Add(1)
-		go QueryResultHandler(queryResultChan, queryWriterChan, w, wgResHandler, searchOptions)
+		go QueryResultHandler(queryResultChan, queryWriterChan, w, wgResHandler, searchOptions, kmerSize)
 	}
 
 	wgSearch := new(sync.WaitGroup)
+	searchErrs := new(searchError)
 
 	for i := 0; i < nbOfThreads; i++ {
 
@@ -78,10 +81,15 @@ func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfTh
 
 				for _, o := range orfs {
 
+					// the remaining queries are drained after an error
+					if searchErrs.get() != nil {
+						break
+					}
+
 					q = Query{
 						Sequence:   o.Sequence,
 						Name:       s.Name,
-						SizeInKmer: (len(o.Sequence)) - KMER_SIZE + 1,
+						SizeInKmer: (len(o.Sequence)) - kmerSize + 1,
 						Location:   o.Location,
 						Contig:     s.Contig,
 						Type:       DNA_QUERY,
@@ -106,7 +114,7 @@ func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfTh
 					go searchRes.KmerSearch(keyChan, kvStores, wg, matchPositionChan, searchOptions)
 
 					for i := 0; i < q.SizeInKmer; i++ {
-						key = kvStores.KmerStore.CreateBytesKey(q.Sequence[i : i+KMER_SIZE])
+						key = kvStores.KmerStore.CreateBytesKey(q.Sequence[i : i+kmerSize])
 						keyChan <- KeyPos{Key: key, Pos: i, QSize: q.SizeInKmer}
 					}
 
@@ -115,13 +123,21 @@ func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfTh
 					close(matchPositionChan)
 					wgMP.Wait()
 
+					if searchRes.Err != nil {
+						searchErrs.set(searchRes.Err)
+						continue
+					}
+
 					searchRes.Hits = sortMapByValue(searchRes.Counter.GetCountersMap())
 					if len(searchRes.Hits) > 0 && searchRes.Hits[0].Kmatch >= searchOptions.MinKMatch {
 						qR = QueryResult{Query: q, SearchResults: searchRes, HitEntries: map[uint32]kvstore.Protein{}}
-						SetBestStartCodon(&qR)
+						SetBestStartCodon(&qR, kmerSize)
 						qR.FilterResults(searchOptions)
 						if qR.SearchResults.Hits.Len() > 0 {
-							qR.FetchHitsInformation(kvStores)
+							if err := qR.FetchHitsInformation(kvStores, searchOptions.NeedSequences()); err != nil {
+								searchErrs.set(err)
+								continue
+							}
 							queryResultChan <- qR
 						}
 					}
@@ -145,4 +161,10 @@ func FastqSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfTh
 	close(queryWriterChan)
 	wgResWriter.Wait()
 
+	if readErr != nil {
+		return readErr
+	}
+
+	return searchErrs.get()
+
 }
@@ -24,18 +24,20 @@ import (
 	"github.com/zorino/kaamer/pkg/kvstore"
 )
 
-func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, cancelQuery *bool) {
+func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOfThreads int, w http.ResponseWriter, cancelQuery *bool) error {
 
 	file := searchOptions.File
+	kmerSize := kvStores.KmerStore.KmerSize()
 
 	queryChan := make(chan Query, 5)
 
 	wgReader := new(sync.WaitGroup)
 	wgReader.Add(1)
+	var readErr error
 
 	go func() {
 		defer wgReader.Done()
-		GetQueriesFasta(file, queryChan, true, cancelQuery)
+		readErr = GetQueriesFasta(file, queryChan, true, kmerSize, cancelQuery)
 		close(queryChan)
 	}()
 
@@ -50,10 +52,11 @@ func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOf
 	wgResHandler := new(sync.WaitGroup)
 	for i := 0; i < nbOfThreads; i++ {
 		wgResHandler.Add(1)
-		go QueryResultHandler(queryResultChan, queryWriterChan, w, wgResHandler, searchOptions)
+		go QueryResultHandler(queryResultChan, queryWriterChan, w, wgResHandler, searchOptions, kmerSize)
 	}
 
 	wgSearch := new(sync.WaitGroup)
+	searchErrs := new(searchError)
 
 	for i := 0; i < nbOfThreads; i++ {
 
@@ -71,8 +74,14 @@ func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOf
 
 				q.Type = PROTEIN_QUERY
 
-				if q.SizeInKmer < 7 {
-					return
+				// shorter than the kmer size of the database
+				if q.SizeInKmer < 1 {
+					continue
+				}
+
+				// the remaining queries are drained after an error
+				if searchErrs.get() != nil {
+					continue
 				}
 
 				searchRes = &SearchResults{}
@@ -93,7 +102,7 @@ func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOf
 
 				key := []byte{}
 				for k := 0; k < q.SizeInKmer; k++ {
-					key = kvStores.KmerStore.CreateBytesKey(q.Sequence[k : k+KMER_SIZE])
+					key = kvStores.KmerStore.CreateBytesKey(q.Sequence[k : k+kmerSize])
 					keyChan <- KeyPos{Key: key, Pos: k, QSize: q.SizeInKmer}
 				}
 
@@ -102,12 +111,20 @@ func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOf
 				close(matchPositionChan)
 				wgMP.Wait()
 
+				if searchRes.Err != nil {
+					searchErrs.set(searchRes.Err)
+					continue
+				}
+
 				searchRes.Hits = sortMapByValue(searchRes.Counter.GetCountersMap())
 
 				queryResult = QueryResult{Query: q, SearchResults: searchRes, HitEntries: map[uint32]kvstore.Protein{}}
 				queryResult.FilterResults(searchOptions)
 				if queryResult.SearchResults.Hits.Len() > 0 {
-					queryResult.FetchHitsInformation(kvStores)
+					if err := queryResult.FetchHitsInformation(kvStores, searchOptions.NeedSequences()); err != nil {
+						searchErrs.set(err)
+						continue
+					}
 					queryResultChan <- queryResult
 				}
 
@@ -128,4 +145,10 @@ func ProteinSearch(searchOptions SearchOptions, kvStores *kvstore.KVStores, nbOf
 
 	wgResWriter.Wait()
 
+	if readErr != nil {
+		return readErr
+	}
+
+	return searchErrs.get()
+
 }
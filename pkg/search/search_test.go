@@ -0,0 +1,249 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cnt "github.com/zorino/counters"
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+// testKVStores returns in-memory stores where each kmer is found in the given protein ids
+func testKVStores(t *testing.T, kmers map[string][]uint32, stopKmers []string) *kvstore.KVStores {
+
+	kvStores := kvstore.KVStoresMemoryNew(1)
+
+	kvStores.KCombStore.OpenKCombBatch()
+	for kmer, ids := range kmers {
+		keys := [][]byte{}
+		for _, id := range ids {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, id)
+			keys = append(keys, key)
+		}
+		kCombKey, err := kvStores.KCombStore.CreateKCombKey(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kvStores.KmerStore.Storage.Set(kvStores.KmerStore.CreateBytesKey(kmer), kCombKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvStores.KCombStore.CloseKCombBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kmer := range stopKmers {
+		if err := kvStores.KmerStore.Storage.Set(kvStores.KmerStore.CreateBytesKey(kmer), kvstore.StopKmerValue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return kvStores
+
+}
+
+func TestKmerSearch(t *testing.T) {
+
+	kvStores := testKVStores(t, map[string][]uint32{
+		"MKVLAAG": {1, 2},
+		"KVLAAGW": {2},
+	}, []string{"VLAAGWW"})
+
+	query := []string{"MKVLAAG", "KVLAAGW", "VLAAGWW", "LAAGWWY"}
+
+	searchRes := &SearchResults{}
+	searchRes.Counter = cnt.NewCounterBox()
+	searchRes.PositionHits = make(map[uint32][]bool)
+
+	keyChan := make(chan KeyPos, len(query))
+	matchPositionChan := make(chan MatchPosition, 10)
+	wgMP := new(sync.WaitGroup)
+	wgMP.Add(1)
+	go searchRes.StoreMatchPositions(matchPositionChan, wgMP)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go searchRes.KmerSearch(keyChan, kvStores, wg, matchPositionChan, SearchOptions{SequenceType: PROTEIN, ExtractPositions: true})
+	for pos, kmer := range query {
+		keyChan <- KeyPos{Key: kvStores.KmerStore.CreateBytesKey(kmer), Pos: pos, QSize: len(query)}
+	}
+	close(keyChan)
+	wg.Wait()
+	close(matchPositionChan)
+	wgMP.Wait()
+
+	hits := sortMapByValue(searchRes.Counter.GetCountersMap())
+	if len(hits) != 2 || hits[0].Key != 2 || hits[0].Kmatch != 2 || hits[1].Key != 1 || hits[1].Kmatch != 1 {
+		t.Fatalf("KmerSearch hits %v, expecting protein 2 with 2 kmers and protein 1 with 1 kmer", hits)
+	}
+
+	if searchRes.StopKmers != 1 {
+		t.Errorf("KmerSearch counted %d stop kmers, expecting 1", searchRes.StopKmers)
+	}
+
+	if positions := searchRes.PositionHits[2]; len(positions) != len(query) || !positions[0] || !positions[1] || positions[2] {
+		t.Errorf("KmerSearch positions of protein 2 are %v", positions)
+	}
+
+}
+
+func TestKmerSearchError(t *testing.T) {
+
+	kvStores := testKVStores(t, map[string][]uint32{"MKVLAAG": {1}}, nil)
+	// kmer with a missing kcomb
+	if err := kvStores.KmerStore.Storage.Set(kvStores.KmerStore.CreateBytesKey("KVLAAGW"), []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	searchRes := &SearchResults{}
+	searchRes.Counter = cnt.NewCounterBox()
+
+	keyChan := make(chan KeyPos, 2)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go searchRes.KmerSearch(keyChan, kvStores, wg, nil, SearchOptions{SequenceType: PROTEIN})
+	keyChan <- KeyPos{Key: kvStores.KmerStore.CreateBytesKey("KVLAAGW"), Pos: 0, QSize: 2}
+	keyChan <- KeyPos{Key: kvStores.KmerStore.CreateBytesKey("MKVLAAG"), Pos: 1, QSize: 2}
+	close(keyChan)
+	wg.Wait()
+
+	if searchRes.Err != kvstore.ErrCorruptKComb {
+		t.Fatalf("KmerSearch error %v, expecting ErrCorruptKComb", searchRes.Err)
+	}
+
+}
+
+func TestFetchHitsInformation(t *testing.T) {
+
+	kvStores := kvstore.KVStoresMemoryNew(1)
+	kvStores.ProteinStore.OpenInsertChannel()
+	for _, id := range []uint32{1, 3} {
+		proteinId := make([]byte, 4)
+		binary.BigEndian.PutUint32(proteinId, id)
+		if err := kvStores.ProteinStore.AddProteinToChannel(proteinId, &kvstore.Protein{EntryId: fmt.Sprintf("P%d", id), Sequence: "MKVLAAG", Length: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvStores.ProteinStore.CloseInsertChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	queryResult := QueryResult{
+		SearchResults: &SearchResults{Hits: HitList{{Key: 1}, {Key: 2}, {Key: 3}}},
+		HitEntries:    map[uint32]kvstore.Protein{},
+	}
+	if err := queryResult.FetchHitsInformation(kvStores, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queryResult.HitEntries) != 2 || queryResult.HitEntries[1].EntryId != "P1" || queryResult.HitEntries[3].EntryId != "P3" {
+		t.Fatalf("FetchHitsInformation loaded %v, expecting the proteins 1 and 3", queryResult.HitEntries)
+	}
+	if queryResult.HitEntries[3].Sequence != "MKVLAAG" {
+		t.Errorf("FetchHitsInformation sequence %q, expecting MKVLAAG", queryResult.HitEntries[3].Sequence)
+	}
+
+}
+
+func TestFilterResultsStopKmers(t *testing.T) {
+
+	queryResult := QueryResult{
+		Query:         Query{SizeInKmer: 100},
+		SearchResults: &SearchResults{Hits: HitList{{Key: 1, Kmatch: 12}, {Key: 2, Kmatch: 8}}, StopKmers: 80},
+	}
+	queryResult.FilterResults(SearchOptions{MaxResults: 10, MinKMatch: 5, MinKRatio: 0.5})
+
+	// 12 and 8 matches of the 20 query kmers that aren't stop kmers
+	if len(queryResult.SearchResults.Hits) != 1 || queryResult.SearchResults.Hits[0].Key != 1 {
+		t.Fatalf("FilterResults kept %v, expecting the hit 1", queryResult.SearchResults.Hits)
+	}
+
+	// the ratio of the output is the one filtered
+	if ratio := queryResult.KMatchRatio(queryResult.SearchResults.Hits[0]); ratio != 0.6 {
+		t.Errorf("KMatchRatio %g, expecting 0.6", ratio)
+	}
+
+}
+
+func TestProteinSearchShortQueries(t *testing.T) {
+
+	kvStores := kvstore.KVStoresMemoryNew(1)
+	kvStores.KmerStore.SetKmerSize(5)
+
+	kvStores.KCombStore.OpenKCombBatch()
+	kCombKey, err := kvStores.KCombStore.CreateKCombKey([][]byte{{0, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.KCombStore.CloseKCombBatch(); err != nil {
+		t.Fatal(err)
+	}
+	for _, kmer := range []string{"MKVLA", "KVLAA"} {
+		if err := kvStores.KmerStore.Storage.Set(kvStores.KmerStore.CreateBytesKey(kmer), kCombKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvStores.ProteinStore.OpenInsertChannel()
+	if err := kvStores.ProteinStore.AddProteinToChannel([]byte{0, 0, 0, 1}, &kvstore.Protein{EntryId: "P1", Sequence: "MKVLAAG", Length: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvStores.ProteinStore.CloseInsertChannel(); err != nil {
+		t.Fatal(err)
+	}
+
+	// more queries without kmer than search threads, then a query of 6 residues (2 kmers of 5)
+	file, err := ioutil.TempFile("", "queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(file, ">short%d\nMKV\n", i)
+	}
+	fmt.Fprintf(file, ">q1\nMKVLAA\n")
+	file.Close()
+
+	w := httptest.NewRecorder()
+	cancelQuery := false
+	done := make(chan error)
+	go func() {
+		done <- ProteinSearch(SearchOptions{File: file.Name(), OutFormat: "tsv", MaxResults: 10}, kvStores, 2, w, &cancelQuery)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ProteinSearch blocked by the queries without kmer")
+	}
+
+	if !strings.Contains(w.Body.String(), "q1\tP1") {
+		t.Errorf("ProteinSearch output %q, expecting the hit P1 of q1", w.Body.String())
+	}
+
+}
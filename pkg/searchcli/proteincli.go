@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package searchcli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+type ProteinRequestOptions struct {
+	ServerHost string
+	EntryIds   []string
+	OutFormat  string
+	OutputFile string
+}
+
+// NewProteinRequest fetches full protein records by EntryId (json or fasta output)
+func NewProteinRequest(options ProteinRequestOptions) {
+
+	out := os.Stdout
+	if options.OutputFile != "stdout" {
+		var err error
+		out, err = os.Create(options.OutputFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer out.Close()
+	}
+
+	for _, entryId := range options.EntryIds {
+
+		resp, err := http.Get(options.ServerHost + "/api/protein/" + url.PathEscape(entryId))
+		if err != nil || resp.StatusCode == 502 {
+			fmt.Printf("No kaamer-db server running at %s\n", options.ServerHost)
+			os.Exit(1)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if resp.StatusCode != 200 {
+			fmt.Fprint(os.Stderr, string(body))
+			continue
+		}
+
+		if options.OutFormat != "fasta" {
+			fmt.Fprintln(out, string(body))
+			continue
+		}
+
+		prot := &kvstore.Protein{}
+		if err := json.Unmarshal(body, prot); err != nil {
+			log.Fatal(err.Error())
+		}
+		header := prot.EntryId
+		if name, ok := prot.Features["ProteinName"]; ok && name != "" {
+			header += " " + name
+		}
+		fmt.Fprintf(out, ">%s\n", header)
+		for i := 0; i < len(prot.Sequence); i += 60 {
+			end := i + 60
+			if end > len(prot.Sequence) {
+				end = len(prot.Sequence)
+			}
+			fmt.Fprintln(out, prot.Sequence[i:end])
+		}
+
+	}
+
+}
+
+// SplitEntryIds splits a comma separated list of EntryIds
+func SplitEntryIds(entryIds string) []string {
+
+	ids := []string{}
+	for _, id := range strings.Split(entryIds, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+
+}
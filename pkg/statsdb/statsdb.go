@@ -0,0 +1,449 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+const DefaultTopOrganisms = 10
+
+// protein_store key of the report saved by -stats and the indexing
+var reportKey = []byte("db_report")
+
+// ErrMissingReport : the database has no saved report (run kaamer-db -stats)
+var ErrMissingReport = errors.New("Missing database report")
+
+// Report of the content of a database (kaamer-db -stats and /api/dbinfo?detailed=true)
+// the annotation coverage and the organisms count every entry (members of deduplicated proteins included),
+// the lengths count the proteins with kmers
+type Report struct {
+	Stats             *kvstore.KStats
+	NumberOfEntries   uint64
+	NumberOfKCombSets uint64
+	KmerOccupancy     KmerOccupancy
+	KCombSizes        Distribution // number of proteins of the kcomb sets
+	Lengths           Distribution // protein lengths
+	FeatureCoverage   []FeatureCoverage
+	TopOrganisms      []OrganismCount
+}
+
+type KmerOccupancy struct {
+	NumberOfKmers  uint64       // distinct kmers of the database
+	PossibleKmers  float64      // alphabet ^ kmer weight
+	Occupancy      float64      // NumberOfKmers / PossibleKmers
+	StopKmers      uint64       // kmers dropped from the index
+	ProteinsByKmer Distribution // number of proteins sharing a kmer (stop kmers included)
+}
+
+type FeatureCoverage struct {
+	Feature  string
+	Entries  uint64 // entries with a value for the feature
+	Fraction float64
+}
+
+type OrganismCount struct {
+	Organism string
+	Entries  uint64
+}
+
+// Distribution summary of a count, the histogram buckets are powers of 2 (1, 2, 3-4, 5-8, ...)
+type Distribution struct {
+	Count     uint64 // number of values
+	Min       uint64
+	Max       uint64
+	Mean      float64
+	Median    uint64
+	P5        uint64
+	P25       uint64
+	P75       uint64
+	P95       uint64
+	Histogram []Bucket
+}
+
+type Bucket struct {
+	Min   uint64
+	Max   uint64
+	Count uint64
+}
+
+// counts of each value, summarized as a Distribution
+type valueCounts map[uint64]uint64
+
+func (counts valueCounts) distribution() Distribution {
+
+	d := Distribution{Histogram: []Bucket{}}
+
+	values := make([]uint64, 0, len(counts))
+	sum := float64(0)
+	for v, n := range counts {
+		values = append(values, v)
+		d.Count += n
+		sum += float64(v) * float64(n)
+	}
+	if d.Count == 0 {
+		return d
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	d.Min = values[0]
+	d.Max = values[len(values)-1]
+	d.Mean = sum / float64(d.Count)
+
+	// percentiles
+	percentiles := []struct {
+		fraction float64
+		value    *uint64
+	}{{0.05, &d.P5}, {0.25, &d.P25}, {0.5, &d.Median}, {0.75, &d.P75}, {0.95, &d.P95}}
+	cumulative := uint64(0)
+	p := 0
+	for _, v := range values {
+		cumulative += counts[v]
+		for p < len(percentiles) && float64(cumulative) >= percentiles[p].fraction*float64(d.Count) {
+			*percentiles[p].value = v
+			p++
+		}
+	}
+
+	// power of 2 buckets
+	for _, v := range values {
+		bucketMin, bucketMax := uint64(0), uint64(0)
+		if v > 0 {
+			bucketMax = 1
+			for bucketMax < v {
+				bucketMax *= 2
+			}
+			bucketMin = bucketMax/2 + 1
+		}
+		if last := len(d.Histogram) - 1; last >= 0 && d.Histogram[last].Max == bucketMax {
+			d.Histogram[last].Count += counts[v]
+		} else {
+			d.Histogram = append(d.Histogram, Bucket{Min: bucketMin, Max: bucketMax, Count: counts[v]})
+		}
+	}
+
+	return d
+
+}
+
+// NewStatsDB saves the report of a database and prints it as text or json (outFormat) on stdout or in outFile
+func NewStatsDB(dbPath string, nbOfThreads int, outFormat string, outFile string, topOrganisms int) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	if outFormat != "text" && outFormat != "json" {
+		return fmt.Errorf("Output format %s unrecognized (text or json)", outFormat)
+	}
+
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, false, false, false)
+	if err != nil {
+		return err
+	}
+	defer kvStores.Close()
+
+	report, err := SaveReport(kvStores, nbOfThreads, topOrganisms)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if outFormat == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+	}
+
+	return report.WriteText(out)
+
+}
+
+// NewReport computes the report of an opened database
+func NewReport(kvStores *kvstore.KVStores, nbOfThreads int, topOrganisms int) (*Report, error) {
+
+	dbStats, err := kvStores.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	kSettings, err := kvStores.GetSettings()
+	if err != nil && err != kvstore.ErrMissingSettings {
+		return nil, err
+	}
+
+	report := &Report{Stats: dbStats}
+
+	if err := report.addProteins(kvStores, nbOfThreads, topOrganisms); err != nil {
+		return nil, err
+	}
+
+	// kcomb sets (indexed databases)
+	kCombSizes := make(map[uint64]uint64)
+	if kSettings.DatabaseIndexed {
+		counts := valueCounts{}
+		mu := new(sync.Mutex)
+		err := kvStores.KCombStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+			proteinKeys, err := kvStores.KCombStore.DecodeProteinKeys(values[0])
+			if err != nil {
+				return err
+			}
+			size := uint64(len(proteinKeys))
+			mu.Lock()
+			kCombSizes[binary.BigEndian.Uint64(key)] = size
+			counts[size]++
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.NumberOfKCombSets = uint64(len(kCombSizes))
+		report.KCombSizes = counts.distribution()
+	}
+
+	// kmers, pointing to their kcomb set once indexed
+	proteinsByKmer := valueCounts{}
+	mu := new(sync.Mutex)
+	err = kvStores.KmerStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		var size uint64
+		if !kSettings.DatabaseIndexed {
+			size = uint64(len(kvstore.RemoveDuplicatesFromSlice(values)))
+		} else if bytes.Equal(values[0], kvstore.StopKmerValue) {
+			// counted from the stats below
+			return nil
+		} else if len(values[0]) != 8 {
+			return kvstore.CorruptValueError("kmer %x : kcomb key of %d bytes", key, len(values[0]))
+		} else {
+			size = kCombSizes[binary.BigEndian.Uint64(values[0])]
+		}
+		mu.Lock()
+		proteinsByKmer[size]++
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, stopKmer := range dbStats.StopKmers {
+		proteinsByKmer[stopKmer.NumberOfProteins]++
+	}
+
+	occupancy := &report.KmerOccupancy
+	occupancy.StopKmers = uint64(len(dbStats.StopKmers))
+	occupancy.ProteinsByKmer = proteinsByKmer.distribution()
+	occupancy.NumberOfKmers = occupancy.ProteinsByKmer.Count
+	occupancy.PossibleKmers = kvStores.KmerStore.KmerSpace()
+	if occupancy.PossibleKmers > 0 {
+		occupancy.Occupancy = float64(occupancy.NumberOfKmers) / occupancy.PossibleKmers
+	}
+
+	return report, nil
+
+}
+
+// SaveReport computes the report of an opened database and saves it in the protein_store
+// (served by the API at /api/dbinfo?detailed=true)
+func SaveReport(kvStores *kvstore.KVStores, nbOfThreads int, topOrganisms int) (*Report, error) {
+
+	report, err := NewReport(kvStores, nbOfThreads, topOrganisms)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, kvStores.ProteinStore.UpdateValue(reportKey, data)
+
+}
+
+// RemoveReport deletes the saved report of a database, stale once its content changes
+// (the report is only computed by kaamer-db -stats)
+func RemoveReport(kvStores *kvstore.KVStores) error {
+	return kvStores.ProteinStore.Storage.Delete(reportKey)
+}
+
+// GetReport returns the report saved in the protein_store
+// (ErrMissingReport when the database has none)
+func GetReport(kvStores *kvstore.KVStores) (*Report, error) {
+
+	data, ok := kvStores.ProteinStore.GetValue(reportKey)
+	if !ok {
+		return nil, ErrMissingReport
+	}
+
+	report := &Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, kvstore.CorruptValueError("db_report : %s", err.Error())
+	}
+
+	return report, nil
+
+}
+
+// addProteins adds the protein lengths, the annotation coverage and the top organisms
+func (report *Report) addProteins(kvStores *kvstore.KVStores, nbOfThreads int, topOrganisms int) error {
+
+	lengths := valueCounts{}
+	featureCounts := make(map[string]uint64)
+	organismCounts := make(map[string]uint64)
+	mu := new(sync.Mutex)
+
+	err := kvStores.ProteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+		prot := &kvstore.Protein{}
+		if err := proto.Unmarshal(values[0], prot); err != nil {
+			return kvstore.CorruptValueError("protein %x : %s", key, err.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		lengths[uint64(prot.Length)]++
+		for _, entry := range append([]*kvstore.Protein{prot}, prot.Members...) {
+			report.NumberOfEntries++
+			for _, feature := range report.Stats.Features {
+				if entry.Features[feature] != "" {
+					featureCounts[feature]++
+				}
+			}
+			if organism := entry.Features["Organism"]; organism != "" {
+				organismCounts[organism]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	report.Lengths = lengths.distribution()
+
+	report.FeatureCoverage = []FeatureCoverage{}
+	for _, feature := range report.Stats.Features {
+		coverage := FeatureCoverage{Feature: feature, Entries: featureCounts[feature]}
+		if report.NumberOfEntries > 0 {
+			coverage.Fraction = float64(coverage.Entries) / float64(report.NumberOfEntries)
+		}
+		report.FeatureCoverage = append(report.FeatureCoverage, coverage)
+	}
+
+	report.TopOrganisms = []OrganismCount{}
+	for organism, count := range organismCounts {
+		report.TopOrganisms = append(report.TopOrganisms, OrganismCount{Organism: organism, Entries: count})
+	}
+	sort.Slice(report.TopOrganisms, func(i, j int) bool {
+		if report.TopOrganisms[i].Entries != report.TopOrganisms[j].Entries {
+			return report.TopOrganisms[i].Entries > report.TopOrganisms[j].Entries
+		}
+		return report.TopOrganisms[i].Organism < report.TopOrganisms[j].Organism
+	})
+	if topOrganisms >= 0 && len(report.TopOrganisms) > topOrganisms {
+		report.TopOrganisms = report.TopOrganisms[:topOrganisms]
+	}
+
+	return nil
+
+}
+
+// WriteText writes the report in a human readable form
+func (report *Report) WriteText(out io.Writer) error {
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Proteins\t%d\n", report.Stats.NumberOfProteins)
+	fmt.Fprintf(w, "Entries\t%d\n", report.NumberOfEntries)
+	if report.Stats.NumberOfDuplicates > 0 {
+		fmt.Fprintf(w, "Duplicates\t%d (dedup ratio %.4f)\n", report.Stats.NumberOfDuplicates, report.Stats.DedupRatio)
+	}
+	fmt.Fprintf(w, "Amino acids\t%d\n", report.Stats.NumberOfAA)
+	fmt.Fprintf(w, "Kmers (positions)\t%d\n", report.Stats.NumberOfKmers)
+	fmt.Fprintf(w, "KComb sets\t%d\n", report.NumberOfKCombSets)
+
+	occupancy := report.KmerOccupancy
+	fmt.Fprintf(w, "\n// Kmer occupancy\n")
+	fmt.Fprintf(w, "Distinct kmers\t%d of %.0f possible (%.4f%%)\n", occupancy.NumberOfKmers, occupancy.PossibleKmers, occupancy.Occupancy*100)
+	fmt.Fprintf(w, "Stop kmers\t%d\n", occupancy.StopKmers)
+	fmt.Fprintf(w, "\n// Proteins by kmer\n")
+	writeDistribution(w, occupancy.ProteinsByKmer)
+
+	if report.NumberOfKCombSets > 0 {
+		fmt.Fprintf(w, "\n// Proteins by kcomb set\n")
+		writeDistribution(w, report.KCombSizes)
+	}
+
+	fmt.Fprintf(w, "\n// Protein lengths\n")
+	writeDistribution(w, report.Lengths)
+
+	fmt.Fprintf(w, "\n// Annotation coverage\n")
+	for _, coverage := range report.FeatureCoverage {
+		fmt.Fprintf(w, "%s\t%d\t(%.2f%%)\n", coverage.Feature, coverage.Entries, coverage.Fraction*100)
+	}
+
+	if len(report.TopOrganisms) > 0 {
+		fmt.Fprintf(w, "\n// Top organisms\n")
+		for _, organism := range report.TopOrganisms {
+			fmt.Fprintf(w, "%s\t%d\n", organism.Organism, organism.Entries)
+		}
+	}
+
+	return w.Flush()
+
+}
+
+func writeDistribution(w io.Writer, d Distribution) {
+
+	fmt.Fprintf(w, "min / p5 / p25 / median / p75 / p95 / max\t%d / %d / %d / %d / %d / %d / %d\n", d.Min, d.P5, d.P25, d.Median, d.P75, d.P95, d.Max)
+	fmt.Fprintf(w, "mean\t%.2f\n", d.Mean)
+	for _, b := range d.Histogram {
+		bucket := fmt.Sprintf("%d", b.Max)
+		if b.Min != b.Max {
+			bucket = fmt.Sprintf("%d-%d", b.Min, b.Max)
+		}
+		fmt.Fprintf(w, "  %s\t%d\t(%.2f%%)\n", bucket, b.Count, float64(b.Count)/float64(d.Count)*100)
+	}
+
+}
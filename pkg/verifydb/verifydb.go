@@ -0,0 +1,313 @@
+/*
+Copyright 2019 The kaamer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package verifydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/golang/protobuf/proto"
+	"github.com/zorino/kaamer/pkg/kvstore"
+)
+
+var ErrInconsistent = errors.New("Database is inconsistent")
+
+// number of failing keys reported by check
+const maxExamples = 10
+
+// check of the database content with the first failing keys as examples
+type check struct {
+	name     string
+	checked  uint64
+	failed   uint64
+	examples []string
+	mu       sync.Mutex
+}
+
+func (c *check) add(ok bool, format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked++
+	if ok {
+		return
+	}
+	c.failed++
+	if len(c.examples) < maxExamples {
+		c.examples = append(c.examples, fmt.Sprintf(format, a...))
+	}
+}
+
+// count of the stats against the count found in the stores
+type countCheck struct {
+	name  string
+	stats uint64
+	found uint64
+}
+
+// content of the protein_store
+type proteinContent struct {
+	ids            []uint32 // sorted protein ids
+	nbOfAA         uint64
+	nbOfKmers      uint64
+	nbOfDuplicates uint64
+	nbOfMemberKeys uint64 // members not merged (interrupted -dedup)
+	decodeCheck    *check // protein values that can't be decoded
+}
+
+func (p *proteinContent) has(id uint32) bool {
+	i := sort.Search(len(p.ids), func(i int) bool { return p.ids[i] >= id })
+	return i < len(p.ids) && p.ids[i] == id
+}
+
+// NewVerifyDB checks the consistency of a database and prints a report
+// sample (0-1] : fraction of the kmers and kcomb sets checked (the counts are always checked)
+func NewVerifyDB(dbPath string, nbOfThreads int, sample float64) error {
+
+	runtime.GOMAXPROCS(128)
+
+	if nbOfThreads < 1 {
+		nbOfThreads = 1
+	}
+
+	if sample <= 0 || sample > 1 {
+		return fmt.Errorf("Sample must be a fraction between 0 and 1 (got %g)", sample)
+	}
+
+	if _, err := os.Stat(dbPath); err != nil {
+		return err
+	}
+
+	kvStores, err := kvstore.KVStoresNew(dbPath, nbOfThreads, false, false, true)
+	if err != nil {
+		return err
+	}
+	defer kvStores.Close()
+
+	if sample < 1 {
+		fmt.Printf("# Verifying database %s (sampling %g of the kmers and kcomb sets)\n", dbPath, sample)
+	} else {
+		fmt.Printf("# Verifying database %s\n", dbPath)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	nbOfErrors := uint64(0)
+	report := func(name string, ok bool, details string) {
+		status := "ok"
+		if !ok {
+			status = "ERROR"
+			nbOfErrors++
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", name, status, details)
+	}
+	reportCheck := func(c *check) {
+		report(c.name, c.failed == 0, fmt.Sprintf("%d checked, %d failed", c.checked, c.failed))
+		for _, example := range c.examples {
+			fmt.Fprintf(w, "  \t\t%s\n", example)
+		}
+	}
+
+	// stats and settings (missing or corrupt)
+	errDetails := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	dbStats, err := kvStores.GetStats()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingStats) && !errors.Is(err, kvstore.ErrCorruptValue) {
+		return err
+	}
+	report("db_stats", err == nil, errDetails(err))
+	if err != nil {
+		dbStats = nil
+	}
+
+	kSettings, err := kvStores.GetSettings()
+	if err != nil && !errors.Is(err, kvstore.ErrMissingSettings) && !errors.Is(err, kvstore.ErrCorruptValue) {
+		return err
+	}
+	report("db_settings", err == nil, errDetails(err))
+	indexed := kSettings.DatabaseIndexed
+	if err != nil {
+		// guess the index from the kcomb_store
+		nbOfKCombSets, err := kvStores.KCombStore.CountKeys(nil)
+		if err != nil {
+			return err
+		}
+		indexed = nbOfKCombSets > 0
+	}
+
+	proteins, err := readProteins(kvStores, nbOfThreads)
+	if err != nil {
+		return err
+	}
+	reportCheck(proteins.decodeCheck)
+
+	sampled := func(key []byte) bool {
+		return sample >= 1 || xxhash.Checksum64(key) < uint64(sample*math.MaxUint64)
+	}
+
+	// kmer_store values
+	kmerCheck := &check{name: "kmer -> protein"}
+	if indexed {
+		kmerCheck.name = "kmer -> kcomb"
+	}
+	nbOfStopKmers := uint64(0)
+	mu := new(sync.Mutex)
+	err = kvStores.KmerStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		if indexed && bytes.Equal(values[0], kvstore.StopKmerValue) {
+			mu.Lock()
+			nbOfStopKmers++
+			mu.Unlock()
+			return nil
+		}
+		if !sampled(key) {
+			return nil
+		}
+		if !indexed {
+			for _, val := range values {
+				kmerCheck.add(len(val) == 4 && proteins.has(binary.BigEndian.Uint32(val)), "kmer %x : missing protein %x", key, val)
+			}
+			return nil
+		}
+		_, err := kvStores.KCombStore.Storage.Get(values[0])
+		if err != nil && err != kvstore.ErrKeyNotFound {
+			return err
+		}
+		kmerCheck.add(err == nil, "kmer %x : missing kcomb %x", key, values[0])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reportCheck(kmerCheck)
+
+	// kcomb_store values
+	nbOfKCombSets := uint64(0)
+	if indexed {
+		kCombCheck := &check{name: "kcomb -> protein"}
+		err = kvStores.KCombStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+			mu.Lock()
+			nbOfKCombSets++
+			mu.Unlock()
+			if !sampled(key) {
+				return nil
+			}
+			proteinKeys, err := kvStores.KCombStore.DecodeProteinKeys(values[0])
+			if err != nil {
+				kCombCheck.add(false, "kcomb %x : %s", key, err.Error())
+				return nil
+			}
+			for _, id := range proteinKeys {
+				kCombCheck.add(proteins.has(id), "kcomb %x : missing protein %08x", key, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		reportCheck(kCombCheck)
+	}
+
+	report("unmerged members", proteins.nbOfMemberKeys == 0, fmt.Sprintf("%d left by an interrupted -dedup", proteins.nbOfMemberKeys))
+
+	// stats counts
+	if dbStats != nil {
+		counts := []countCheck{
+			{"NumberOfProteins", dbStats.NumberOfProteins, uint64(len(proteins.ids))},
+			{"NumberOfAA", dbStats.NumberOfAA, proteins.nbOfAA},
+			{"NumberOfKmers", dbStats.NumberOfKmers, proteins.nbOfKmers},
+			{"NumberOfDuplicates", dbStats.NumberOfDuplicates, proteins.nbOfDuplicates},
+		}
+		if indexed {
+			counts = append(counts, countCheck{"StopKmers", uint64(len(dbStats.StopKmers)), nbOfStopKmers})
+			// not recorded by the older versions of -index
+			if dbStats.NumberOfKCombSets > 0 {
+				counts = append(counts, countCheck{"NumberOfKCombSets", dbStats.NumberOfKCombSets, nbOfKCombSets})
+			}
+		}
+		for _, c := range counts {
+			report(c.name, c.stats == c.found, fmt.Sprintf("%d in stats, %d found", c.stats, c.found))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if nbOfErrors > 0 {
+		return fmt.Errorf("%w : %d failed checks", ErrInconsistent, nbOfErrors)
+	}
+
+	fmt.Println("# Database is consistent")
+
+	return nil
+
+}
+
+// readProteins reads the protein ids and counts of the protein_store
+func readProteins(kvStores *kvstore.KVStores, nbOfThreads int) (*proteinContent, error) {
+
+	proteins := &proteinContent{decodeCheck: &check{name: "protein values"}}
+	kmerSize := kvStores.KmerStore.KmerSize()
+	mu := new(sync.Mutex)
+
+	err := kvStores.ProteinStore.Storage.Stream(nil, nbOfThreads, func(key []byte, values [][]byte) error {
+		if kvstore.IsMemberKey(key) {
+			mu.Lock()
+			proteins.nbOfMemberKeys++
+			mu.Unlock()
+			return nil
+		}
+		if !kvstore.IsProteinKey(key) {
+			return nil
+		}
+		prot := &kvstore.Protein{}
+		err := proto.Unmarshal(values[0], prot)
+		proteins.decodeCheck.add(err == nil, "protein %x : %v", key, err)
+		mu.Lock()
+		defer mu.Unlock()
+		proteins.ids = append(proteins.ids, binary.BigEndian.Uint32(key))
+		if err != nil {
+			// counted as a protein without content
+			return nil
+		}
+		proteins.nbOfAA += uint64(prot.Length)
+		if int(prot.Length) >= kmerSize {
+			proteins.nbOfKmers += uint64(int(prot.Length) - kmerSize + 1)
+		}
+		proteins.nbOfDuplicates += uint64(len(prot.Members))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(proteins.ids, func(i, j int) bool { return proteins.ids[i] < proteins.ids[j] })
+
+	return proteins, nil
+
+}